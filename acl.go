@@ -0,0 +1,61 @@
+package main
+
+import (
+    "net"
+    "net/netip"
+)
+
+// Access control
+//
+// query:     clients allowed to query at all (local records)
+// recursion: clients allowed to have queries forwarded upstream
+// Empty list allows everyone. Denied clients get REFUSED
+// or nothing at all when configured to drop.
+
+type ACL struct {
+    query []netip.Prefix
+    recursion []netip.Prefix
+
+    // drop instead of REFUSED
+    drop bool
+}
+
+func NewACL(query, recursion []netip.Prefix, drop bool) *ACL {
+    return &ACL{query, recursion, drop}
+}
+
+func (a *ACL) AllowQuery(addr net.Addr) bool {
+    return aclMatch(a.query, addr)
+}
+
+func (a *ACL) AllowRecursion(addr net.Addr) bool {
+    return aclMatch(a.recursion, addr)
+}
+
+func (a *ACL) Action() string {
+    if a.drop {
+        return ACL_DROP
+    }
+
+    return ACL_REFUSE
+}
+
+func aclMatch(list []netip.Prefix, addr net.Addr) bool {
+    if len(list) == 0 {
+        return true
+    }
+
+    ip, ok := clientIP(addr)
+    if !ok {
+        // unknown transport, nothing to match on
+        return false
+    }
+
+    for _, p := range list {
+        if p.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
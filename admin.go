@@ -0,0 +1,316 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "errors"
+    "strings"
+    "net/http"
+    "crypto/subtle"
+    "encoding/json"
+)
+
+//
+// Admin HTTP API, live record management
+//
+// Authenticated with 'Authorization: Bearer <admin.token>'.
+//
+//   GET    /records[?name=]          all records (RR files and admin)
+//   POST   /records                  add one record
+//   PUT    /records/{name}           replace admin records of name
+//   DELETE /records/{name}[?value=]  delete admin records of name
+//
+// Record: {"name": "host.domain", "type": "A", "value": "10.0.0.1",
+//          "ptr": true, "expire": "<RFC3339>" or "expire_in": <seconds>}
+// type is optional for A/AAAA (taken from value), CNAME/MX/NXDOMAIN need it.
+// Records from RR files are listed but can't be changed here.
+
+type Admin struct {
+    cache *Cache
+
+    // records changed here
+    rr *DynamicRecords
+
+    token string
+
+    // default domain
+    domain string
+}
+
+type adminRecord struct {
+    Name     string `json:"name"`
+    Type     string `json:"type,omitempty"`
+    Value    string `json:"value"`
+    Ptr      bool   `json:"ptr,omitempty"`
+    Expire   string `json:"expire,omitempty"`
+    ExpireIn int    `json:"expire_in,omitempty"`
+    Source   string `json:"source,omitempty"`
+}
+
+var errAdminNotFound = errors.New("No such admin record(s)")
+var errAdminDuplicate = errors.New("Record exists")
+
+func NewAdmin(c *Cache, rr *DynamicRecords, token, domain string) *Admin {
+    return &Admin{c, rr, token, domain}
+}
+
+// serves admin API, blocking
+func (a *Admin) Serve(l net.Listener) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /records", a.list)
+    mux.HandleFunc("POST /records", a.add)
+    mux.HandleFunc("PUT /records/{name}", a.update)
+    mux.HandleFunc("DELETE /records/{name}", a.delete)
+
+    srv := &http.Server{
+        Handler:           a.auth(mux),
+        ReadHeaderTimeout: STREAM_IDLE * time.Second,
+        ErrorLog:          sWarn.Logger,
+    }
+
+    sInfo.Printf("Admin API listening on: %s", l.Addr().String())
+    if err := srv.Serve(l); err != nil {
+        sCrit.Printf("Admin API listener failed: %s", err.Error())
+    }
+}
+
+func (a *Admin) auth(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+        t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if !ok || subtle.ConstantTimeCompare([]byte(t), []byte(a.token)) != 1 {
+            sWarn.Printf("Admin API unauthorized: %s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+            rw.Header().Set("WWW-Authenticate", "Bearer")
+            http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+            return
+        }
+
+        h.ServeHTTP(rw, r)
+    })
+}
+
+func (a *Admin) list(rw http.ResponseWriter, r *http.Request) {
+    name := r.URL.Query().Get("name")
+    if name != "" {
+        name = defaultDomain(name, a.domain)
+    }
+
+    ar := make([]adminRecord, 0)
+    for _, rr := range a.cache.Records() {
+        if name == "" || rr.host == name {
+            ar = append(ar, newAdminRecord(rr))
+        }
+    }
+
+    adminJSON(rw, http.StatusOK, ar)
+}
+
+func (a *Admin) add(rw http.ResponseWriter, r *http.Request) {
+    var ar adminRecord
+    if err := adminBody(r, &ar); err != nil {
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    rec, err := ar.record(a.domain)
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    err = a.cache.Change(a.rr, func(rr []*Record) ([]*Record, error) {
+        for _, o := range rr {
+            if o.same(rec) {
+                return nil, errAdminDuplicate
+            }
+        }
+
+        return append(rr, rec), nil
+    })
+    if err != nil {
+        a.error(rw, r, err)
+        return
+    }
+
+    sInfo.Printf("Admin API added: %s (%s)", rec.String(), r.RemoteAddr)
+    adminJSON(rw, http.StatusCreated, newAdminRecord(rec))
+}
+
+func (a *Admin) update(rw http.ResponseWriter, r *http.Request) {
+    name := defaultDomain(r.PathValue("name"), a.domain)
+
+    var ar []adminRecord
+    if err := adminBody(r, &ar); err != nil {
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    recs := make([]*Record, 0, len(ar))
+    for _, x := range ar {
+        if x.Name == "" {
+            x.Name = name
+        }
+
+        rec, err := x.record(a.domain)
+        if err != nil {
+            http.Error(rw, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        if rec.host != name {
+            http.Error(rw, fmt.Sprintf("Record name does not match: %s", rec.host), http.StatusBadRequest)
+            return
+        }
+
+        recs = append(recs, rec)
+    }
+
+    err := a.cache.Change(a.rr, func(rr []*Record) ([]*Record, error) {
+        n := make([]*Record, 0, len(rr)+len(recs))
+        for _, o := range rr {
+            if o.host != name {
+                n = append(n, o)
+            }
+        }
+
+        return append(n, recs...), nil
+    })
+    if err != nil {
+        a.error(rw, r, err)
+        return
+    }
+
+    sInfo.Printf("Admin API updated: %s, records: %d (%s)", name, len(recs), r.RemoteAddr)
+
+    out := make([]adminRecord, len(recs))
+    for i, rec := range recs {
+        out[i] = newAdminRecord(rec)
+    }
+
+    adminJSON(rw, http.StatusOK, out)
+}
+
+func (a *Admin) delete(rw http.ResponseWriter, r *http.Request) {
+    name := defaultDomain(r.PathValue("name"), a.domain)
+    value := r.URL.Query().Get("value")
+
+    err := a.cache.Change(a.rr, func(rr []*Record) ([]*Record, error) {
+        n := make([]*Record, 0, len(rr))
+        for _, o := range rr {
+            if o.host == name && (value == "" || o.value == value || o.value == defaultDomain(value, a.domain)) {
+                continue
+            }
+
+            n = append(n, o)
+        }
+
+        if len(n) == len(rr) {
+            return nil, errAdminNotFound
+        }
+
+        return n, nil
+    })
+    if err != nil {
+        a.error(rw, r, err)
+        return
+    }
+
+    sInfo.Printf("Admin API deleted: %s %s (%s)", name, value, r.RemoteAddr)
+    rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) error(rw http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case errors.Is(err, errAdminNotFound):
+        http.Error(rw, err.Error(), http.StatusNotFound)
+    case errors.Is(err, errAdminDuplicate):
+        http.Error(rw, err.Error(), http.StatusConflict)
+    case errors.Is(err, errRecordSave):
+        sCrit.Printf("Admin API %s %s: %s", r.Method, r.URL.Path, err.Error())
+        http.Error(rw, err.Error(), http.StatusInternalServerError)
+    default:
+        // records don't build together
+        // e.g. CNAME to unknown A record
+        http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+    }
+}
+
+func adminBody(r *http.Request, v any) error {
+    d := json.NewDecoder(http.MaxBytesReader(nil, r.Body, ADMIN_MAX_BODY))
+    d.DisallowUnknownFields()
+
+    if err := d.Decode(v); err != nil {
+        return fmt.Errorf("Invalid JSON: %s", err.Error())
+    }
+
+    return nil
+}
+
+func adminJSON(rw http.ResponseWriter, status int, v any) {
+    rw.Header().Set("Content-Type", "application/json")
+    rw.WriteHeader(status)
+    json.NewEncoder(rw).Encode(v)
+}
+
+func newAdminRecord(r *Record) adminRecord {
+    ar := adminRecord{Name: r.host, Type: r.Type(), Value: r.value, Ptr: r.ptr, Source: r.src}
+    if !r.expire.IsZero() {
+        ar.Expire = r.expire.UTC().Format(time.RFC3339)
+    }
+
+    return ar
+}
+
+// validated as RR file line
+func (ar adminRecord) record(domain string) (*Record, error) {
+    t := strings.ToUpper(ar.Type)
+    if ar.Name == "" || ar.Value == "" && t != "NXDOMAIN" {
+        return nil, errors.New("Record requires name and value")
+    }
+
+    // one column each
+    if strings.ContainsAny(ar.Name+ar.Value, " \t\r\n") {
+        return nil, errors.New("Record name and value must not contain white space")
+    }
+
+    line := ar.Name + " " + ar.Value
+    switch t {
+    case "", "A", "AAAA":
+    case "CNAME":       line += " cname"
+    case "MX":          line += " mx"
+    case "NXDOMAIN":    line = ar.Name + " " + RR_NXDOMAIN
+    default:
+        return nil, fmt.Errorf("Unsupported record type: %s", ar.Type)
+    }
+
+    if ar.Ptr {
+        line += " ptr"
+    }
+
+    switch {
+    case ar.Expire != "" && ar.ExpireIn != 0:
+        return nil, errors.New("Record has both expire and expire_in")
+    case ar.Expire != "":
+        line += " expire:" + ar.Expire
+    case ar.ExpireIn < 0:
+        return nil, errors.New("Record expire_in must be positive")
+    case ar.ExpireIn > 0:
+        line += " expire:" + time.Now().Add(time.Duration(ar.ExpireIn) * time.Second).UTC().Format(time.RFC3339)
+    }
+
+    r, err := parseRecord(line, domain)
+    if err != nil {
+        return nil, err
+    }
+
+    if t != "" && t != r.Type() {
+        return nil, fmt.Errorf("Record type %s does not match value: %s", ar.Type, ar.Value)
+    }
+
+    if r.expired(time.Now()) {
+        return nil, errors.New("Record already expired")
+    }
+
+    r.src = ADMIN_SOURCE
+    return r, nil
+}
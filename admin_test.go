@@ -0,0 +1,100 @@
+package main
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+)
+
+// admin API against cache of one RR file
+
+// loggers of the cache and server, discarded
+func testLogs() {
+    if cInfo.Logger != nil {
+        return
+    }
+
+    cInfo, cWarn, cCrit, cDebg, cTrce = NewHandles(os.DevNull, logCache)
+    sInfo, sWarn, sCrit, sDebg, sTrce = NewHandles(os.DevNull, logServer)
+}
+
+// file of lines in temp dir
+func testFile(t *testing.T, name string, lines ...string) string {
+    t.Helper()
+
+    f := filepath.Join(t.TempDir(), name)
+    if err := os.WriteFile(f, []byte(strings.Join(lines, "\n") + "\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    return f
+}
+
+func testAdmin(t *testing.T) *Admin {
+    t.Helper()
+    testLogs()
+
+    f := testFile(t, "local.rr", "host.example 192.0.2.1")
+    c := NewCache("example", []string{f}, nil, RR_CONFLICT_MERGE, nil)
+
+    d, err := NewDynamicRecords(ADMIN_SOURCE, "", "example")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := c.AddDynamic(d); err != nil {
+        t.Fatal(err)
+    }
+
+    return NewAdmin(c, d, "token", "example")
+}
+
+func testAdminAdd(a *Admin, body string) *httptest.ResponseRecorder {
+    rw := httptest.NewRecorder()
+    a.add(rw, httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body)))
+
+    return rw
+}
+
+func TestAdminCnameLoop(t *testing.T) {
+    a := testAdmin(t)
+
+    // x -> host, y -> x -> host
+    for _, body := range []string{
+        `{"name": "x.example", "type": "CNAME", "value": "host.example"}`,
+        `{"name": "y.example", "type": "CNAME", "value": "x.example"}`,
+    } {
+        if rw := testAdminAdd(a, body); rw.Code != http.StatusCreated {
+            t.Fatalf("add: %d %s", rw.Code, rw.Body.String())
+        }
+    }
+
+    // x -> y -> x
+    rw := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodPut, "/records/x.example", strings.NewReader(`[{"type": "CNAME", "value": "y.example"}]`))
+    r.SetPathValue("name", "x.example")
+    a.update(rw, r)
+
+    if rw.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("loop: %d %s, want %d", rw.Code, rw.Body.String(), http.StatusUnprocessableEntity)
+    }
+    if !strings.Contains(rw.Body.String(), "CNAME loop") {
+        t.Errorf("loop: %s", rw.Body.String())
+    }
+
+    // previous answers kept
+    for _, n := range []string{"x.example", "y.example"} {
+        c := a.cache.Get(A, n)
+        if c == nil || c.rr[len(c.rr)-1][1] != "192.0.2.1" {
+            t.Errorf("%s: answer not kept", n)
+        }
+    }
+
+    // loop to itself
+    if rw := testAdminAdd(a, `{"name": "z.example", "type": "CNAME", "value": "z.example"}`); rw.Code != http.StatusUnprocessableEntity {
+        t.Errorf("self loop: %d %s, want %d", rw.Code, rw.Body.String(), http.StatusUnprocessableEntity)
+    }
+}
@@ -34,6 +34,9 @@ type Answer struct {
 
     // type of answer
     t int
+
+    // file:line of the local records answered
+    src []string
 }
 
 // cache is used for A record lookup
@@ -44,12 +47,13 @@ func NewMx(q, mxhost string, cache map[int]map[string]*Answer) (*Answer, error)
                  make([]byte, PACKET_SIZE-HEADER_LEN),
                  make(map[string]int),
                  0,
-                 MX}
+                 MX,
+                 nil}
 
     // add A record
     a.addi = append(a.addi, cache[A][mxhost].rr...)
 
-    if debug {
+    if cDebg.On() {
         cDebg.Print("New MX: " + a.QandR())
     }
 
@@ -105,7 +109,7 @@ func NewMx(q, mxhost string, cache map[int]map[string]*Answer) (*Answer, error)
 // cache is used for A record lookup
 func NewCname(q string, r []string, cache map[int]map[string]*Answer) (*Answer, error) {
 
-    // TODO - make sure there's no CNAME loop!
+    // r is loop free (cnameChain)
 
     a := &Answer{make([][]string, 0),
                  make([][]string, 0),
@@ -113,7 +117,8 @@ func NewCname(q string, r []string, cache map[int]map[string]*Answer) (*Answer,
                  make([]byte, PACKET_SIZE-HEADER_LEN),
                  make(map[string]int),
                  0,
-                 CNAME}
+                 CNAME,
+                 nil}
     i := 0
     next := ""
     for i, next = range r {
@@ -197,9 +202,10 @@ func NewPtr(q, soa string) *Answer {
                  make([]byte, PACKET_SIZE-HEADER_LEN),
                  make(map[string]int),
                  0,
-                 PTR}
+                 PTR,
+                 nil}
 
-    if debug {
+    if cDebg.On() {
         cDebg.Print("New PTR: " + a.QandR())
     }
 
@@ -248,9 +254,10 @@ func NewAAAA(h string, ip []string) (*Answer, error) {
                  make([]byte, PACKET_SIZE-HEADER_LEN),
                  make(map[string]int),
                  0,
-                 AAAA}
+                 AAAA,
+                 nil}
 
-    if debug {
+    if cDebg.On() {
         cDebg.Print("New AAAA: " + a.QandR())
     }
 
@@ -297,9 +304,10 @@ func NewA(h string, ip []string) (*Answer, error) {
                  make([]byte, PACKET_SIZE-HEADER_LEN),
                  make(map[string]int),
                  0,
-                 A}
+                 A,
+                 nil}
 
-    if debug {
+    if cDebg.On() {
         cDebg.Print("New A: " + a.QandR())
     }
 
@@ -325,6 +333,70 @@ func NewA(h string, ip []string) (*Answer, error) {
     return a, nil
 }
 
+func NewTxt(h string, txt []string) (*Answer, error) {
+    rr := make([][]string, len(txt))
+    for i, t := range txt {
+        rr[i] = []string{h, t}
+    }
+
+    a := &Answer{rr,
+                 make([][]string, 0),
+                 make([]byte, HEADER_LEN),
+                 make([]byte, PACKET_SIZE-HEADER_LEN),
+                 make(map[string]int),
+                 0,
+                 TXT,
+                 nil}
+
+    if cDebg.On() {
+        cDebg.Print("New TXT: " + a.QandR())
+    }
+
+    a.RespHeaders()
+    a.Question()
+
+    for _, r := range a.rr {
+        // 255 bytes character strings
+        cs := make([][]byte, 0)
+        for t := []byte(r[1]); ; t = t[255:] {
+            if len(t) <= 255 {
+                cs = append(cs, t)
+                break
+            }
+
+            cs = append(cs, t[:255])
+        }
+
+        // name, type/class/ttl, length, strings, additional
+        if a.i + len(r[0])+2 + 10 + len(r[1])+len(cs) + 11 > len(a.body) {
+            return nil, fmt.Errorf("Answer too large")
+        }
+
+        // response
+        a.labelize(r[0])
+
+        a.body[a.i+1] = TXT
+        a.body[a.i+3] = IN
+        a.body[a.i+7] = TTL
+        a.i += 8
+
+        // total length
+        l := len(r[1]) + len(cs)
+        a.body[a.i] = byte(l >> 8)
+        a.body[a.i+1] = byte(l)
+        a.i += LEN_LEN
+
+        for _, c := range cs {
+            a.body[a.i] = byte(len(c))
+            copy(a.body[a.i+1:], c)
+            a.i += 1 + len(c)
+        }
+    }
+
+    a.additional()
+    return a, nil
+}
+
 func NewRefused(q string) *Answer {
     // only question rr[0][0]
     // is needed here
@@ -334,7 +406,8 @@ func NewRefused(q string) *Answer {
                  make([]byte, PACKET_SIZE-HEADER_LEN),
                  make(map[string]int),
                  0,
-                 A}
+                 A,
+                 nil}
 
     a.RefusedHeaders()
     a.Question()
@@ -350,7 +423,8 @@ func NewNxdomain(q string) *Answer {
                  make([]byte, PACKET_SIZE-HEADER_LEN),
                  make(map[string]int),
                  0,
-                 NXDOMAIN}
+                 NXDOMAIN,
+                 nil}
 
     a.NxdomainHeaders()
 
@@ -367,7 +441,7 @@ func NewNxdomain(q string) *Answer {
     default:    a.rr[0] = []string{q, COM}
     }
 
-    if debug {
+    if cDebg.On() {
         cDebg.Print("New NXDOMAIN: " + a.QandR())
     }
 
@@ -410,7 +484,7 @@ func NewNxdomain(q string) *Answer {
             j++
         }
 
-        if debug {
+        if cDebg.On() {
             cDebg.Printf("SOA timer: %d, %+v", timer, a.body[a.i:a.i+j])
         }
 
@@ -526,7 +600,7 @@ func (a *Answer) additional() {
 
 // copy request ID into local answer
 func (a *Answer) CopyRequestId(q []byte) {
-    if debug {
+    if cDebg.On() {
         cDebg.Printf("Query id: %d, copying query id to answer: %s", bytesToInt(q[:2]), a.QandR())
     }
 
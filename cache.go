@@ -7,45 +7,73 @@ import (
     "regexp"
     "strings"
     "sync"
+    "sort"
+    "sync/atomic"
+    "time"
     "errors"
+    "net/netip"
 )
 
 type Cache struct {
-    // cache
-    pool map[int]map[string]*Answer
-
-    // cache reload lock
-    mux *sync.RWMutex
+    // cache, swapped as a whole
+    // readers (Get) don't lock
+    pool atomic.Pointer[map[int]map[string]*Answer]
 
     // files with local RR
     file  []string
 
+    // hosts format files, after RR files
+    hosts []string
+
     // default domain
     domain string
+
+    // records of RR and hosts files, one set
+    // conflicts across files resolved
+    rr []*Record
+
+    // conflict policy (rr.conflict), priority of files and dirs (rr.priority)
+    conflict string
+    priority map[string]int
+
+    // records managed at runtime, on top of RR files
+    dynamic []*DynamicRecords
+
+    // one (re)build at a time
+    build *sync.Mutex
+
+    // earliest record expiry, zero = none
+    next time.Time
 }
 
-var rDot = regexp.MustCompile(`\.`)
 var rHost = regexp.MustCompile(`^[a-zA-Z0-9\-\.]+$`)
 
-func NewCache(domain string, rrFiles []string) *Cache {
+func NewCache(domain string, rrFiles, hostsFiles []string, conflict string, priority map[string]int) *Cache {
     c := &Cache{
-        make(map[int]map[string]*Answer),
-        &sync.RWMutex{},
-        rrFiles,
-        domain,
+        file:     rrFiles,
+        hosts:    hostsFiles,
+        domain:   domain,
+        rr:       make([]*Record, 0),
+        conflict: conflict,
+        priority: priority,
+        dynamic:  make([]*DynamicRecords, 0),
+        build:    &sync.Mutex{},
     }
+    c.pool.Store(&map[int]map[string]*Answer{})
 
     c.Init()
+    go c.expire()
+
     return c
 }
 
 func (c *Cache) Dump() {
 	// TODO log this nicer looking at you => %+v
     cInfo.Printf("=== CACHE DUMP ===\n")
-    for t, rrs := range c.pool {
+    for t, rrs := range *c.pool.Load() {
         cInfo.Printf("= TYPE: %s\n", RequestTypeString(t))
         for rr, answ := range rrs {
-            cInfo.Printf("= %s: %+v\n", rr, answ.rr)
+            cInfo.Printf("= %s: %+v %v\n", rr, answ.rr, answ.src)
         }
     }
 }
@@ -57,271 +85,697 @@ func (c *Cache) Init() {
     c.load(true)
 }
 
-func (c *Cache) Reload() {
-    c.load(false)
+func (c *Cache) Reload() error {
+    return c.load(false)
 }
 
-func (c *Cache) load(init bool) {
+func (c *Cache) load(init bool) error {
     if init {
         cInfo.Print("Initializing cache")
     } else {
         cInfo.Print("Reloading cache")
     }
 
-    start := regexp.MustCompile(`^\s+`)
-    mid   := regexp.MustCompile(`\s+`)
-    end   := regexp.MustCompile(`\s+$`)
-    rTTL  := regexp.MustCompile(`^ttl\:\d+$`)
-
-    //answers := make(map[int]map[string]*Answer)
-
-    // this is local cache
-    // populate answers to populate cache
-    answers := map[int]map[string]*Answer{
-        A: {},
-        AAAA: {},
-        CNAME: {},
-        SOA: {},
-        PTR: {},
-        MX: {},
-    }
+    // any early return is a failure
+    loaded := false
+    defer func() {
+        metrics.Reload(loaded)
+    }()
+
+    c.build.Lock()
+    defer c.build.Unlock()
+
+    files := append(append(make([]string, 0, len(c.file)+len(c.hosts)), c.file...), c.hosts...)
+
+    // all files parsed before anything
+    // is replaced, current records stay on any error
+    sets := make([][]*Record, 0, len(files))
+    names := make([]string, 0, len(files))
+    failed, bad, missing := make([]string, 0), 0, 0
+    for i, f := range files {
+        read := readRecords
+        if i >= len(c.file) {
+            read = readHosts
+        }
 
-    for _, f := range c.file {
-        fh, err := os.Open(f)
+        r, err := read(f, c.domain)
         if err != nil {
             // it is not strictly necessary to have local RRs defined, even though there's no real reason to dns-proxy then :)
             // and so if the RR file does not exist, notify the log about it but continue on.
             // Perhaps, the file will show up later and cache will be loaded then..
 
             if errors.Is(err, os.ErrNotExist) {
-                cCrit.Print("Could not load cache, file does not exist: " + f)
-                return
+                missing++
+                err = errors.New("file does not exist: " + f)
             }
 
-            if init {
-                panic(err)
+            // all bad lines of the file
+            for _, e := range errorList(err) {
+                cCrit.Print("Could not load: " + e.Error())
+                failed = append(failed, e.Error())
             }
 
-            cCrit.Print("Could not load cache: " + err.Error())
-            return
+            bad++
+            continue
+        }
 
+        cInfo.Printf("DNS entries from: %s (%d)", f, len(r))
+        sets = append(sets, r)
+        names = append(names, f)
+    }
+
+    if len(failed) > 0 {
+        err := fmt.Errorf("Could not load cache, %d of %d files failed (current records kept): %s", bad, len(files), strings.Join(failed, "; "))
+        if init && missing < bad {
+            panic(err)
         }
-        defer fh.Close()
 
-        // composites records
-        // CNAME, A, AAAA, MX
-        cn := make(map[string]string)
-        an := make(map[string][]string)
-        aaaan := make(map[string][]string)
-        mn := make(map[string]string)
+        cCrit.Print(err.Error())
+        return err
+    }
 
-        fail := false
-        scanner := bufio.NewScanner(fh)
-        for scanner.Scan() {
-            line := scanner.Text()
+    rr, conflicts := resolveConflicts(names, sets, c.conflict, c.priority)
+    for _, e := range conflicts {
+        cWarn.Print(e.Error())
+    }
 
-            if ok := comment.MatchString(line); ok {
-                continue
-            }
-            if ok := empty.MatchString(line); ok {
-                continue
-            }
+    if c.conflict == RR_CONFLICT_ERROR && len(conflicts) > 0 {
+        msg := make([]string, len(conflicts))
+        for i, e := range conflicts {
+            msg[i] = e.Error()
+        }
 
-            line = start.ReplaceAllString(line, "")
-            line = mid.ReplaceAllString(line, " ")
-            line = end.ReplaceAllString(line, "")
+        err := fmt.Errorf("Could not load cache, %d conflicts across files (current records kept): %s", len(conflicts), strings.Join(msg, "; "))
+        if init {
+            panic(err)
+        }
 
-            sl := strings.Split(line, " ")
+        cCrit.Print(err.Error())
+        return err
+    }
 
-            // require at least 2 columns
-            if len(sl) < 2 {
-                cCrit.Print("Invalid resource record line: " + line)
-                fail = true
-                break
-            }
+    answers, next, err := buildAnswers(c.sets(rr, nil, nil), time.Now())
+    if err != nil {
+        if init {
+            panic(err)
+        }
 
-            // TODO: no default domain, is yaml the answer?
-            // add default domain if needed
-            if ok := rDot.MatchString(sl[0]); !ok {
-                sl[0] += "."
-                sl[0] += c.domain
-            }
+        for _, e := range errorList(err) {
+            cCrit.Print("Could not load cache (current records kept): " + e.Error())
+        }
+        return err
+    }
 
-            // check hostname
-            if ok := rHost.MatchString(sl[0]); !ok {
-                cWarn.Print("Invalid hostname: " + sl[0])
-                fail = true
-                break
-            }
+    for k, _ := range answers {
+        cInfo.Printf("'%s' records loaded: %d", RequestTypeString(k), len(answers[k]))
+    }
 
-            if rIp4.MatchString(sl[0]) {
-                cCrit.Print("Invalid host (looks to be IP?): " + line)
-                fail = true
-                break
-            }
+    if !init {
+        logDiff([][]*Record{c.rr}, [][]*Record{rr})
+    }
+
+    c.rr = rr
+    c.publish(answers, next)
+
+    loaded = true
+    return nil
+}
+
+// records added, removed, changed (by host and type)
+func logDiff(old, new [][]*Record) {
+    o, n := recordValues(old), recordValues(new)
+
+    lines := make([]string, 0)
+    added, removed, changed := 0, 0, 0
+    for k, v := range n {
+        ov, ok := o[k]
+        switch {
+        case !ok:
+            added++
+            lines = append(lines, "+ " + k + " " + v)
+        case ov != v:
+            changed++
+            lines = append(lines, "~ " + k + " " + ov + " => " + v)
+        }
+    }
+
+    for k, v := range o {
+        if _, ok := n[k]; !ok {
+            removed++
+            lines = append(lines, "- " + k + " " + v)
+        }
+    }
+
+    cInfo.Printf("Records diff: %d added, %d removed, %d changed", added, removed, changed)
+
+    sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+    for i, l := range lines {
+        if i == RELOAD_DIFF_MAX {
+            cInfo.Printf("Records diff: ... %d more", len(lines)-i)
+            break
+        }
+
+        cInfo.Print("Records diff: " + l)
+    }
+}
+
+// "host TYPE" => "value [flags], ..."
+func recordValues(sets [][]*Record) map[string]string {
+    m := make(map[string][]string)
+    for _, set := range sets {
+        for _, r := range set {
+            k := r.host + " " + r.Type()
+            m[k] = append(m[k], strings.TrimPrefix(r.String(), r.host + " "))
+        }
+    }
+
+    v := make(map[string]string, len(m))
+    for k, vs := range m {
+        sort.Strings(vs)
+        v[k] = strings.Join(vs, ", ")
+    }
+
+    return v
+}
+
+// RR files changed (added, removed)
+// loaded on next Reload()
+func (c *Cache) SetFiles(rf []string) {
+    c.build.Lock()
+    defer c.build.Unlock()
+
+    old := make(map[string]bool)
+    for _, f := range c.file {
+        old[f] = true
+    }
+
+    for _, f := range rf {
+        if !old[f] {
+            cInfo.Printf("RR file added: %s", f)
+        }
+        delete(old, f)
+    }
+
+    for f := range old {
+        cInfo.Printf("RR file removed: %s", f)
+    }
+
+    c.file = rf
+}
+
+// RR files followed by dynamic records
+// d (when not nil) is replaced with drr
+func (c *Cache) sets(rr []*Record, d *DynamicRecords, drr []*Record) [][]*Record {
+    s := append(make([][]*Record, 0, 1+len(c.dynamic)), rr)
+    for _, dr := range c.dynamic {
+        if dr == d {
+            s = append(s, drr)
+            continue
+        }
+
+        s = append(s, dr.rr)
+    }
+
+    return s
+}
 
-            ptr := false 
-            cname := false
-            mx := false
+// must be called with build lock held
+func (c *Cache) publish(answers map[int]map[string]*Answer, next time.Time) {
+    // safe reload
+    if cDebg.On() {
+        cDebg.Print("Swapping cache")
+    }
+
+    c.pool.Store(&answers)
+
+    c.next = next
+}
+
+// add dynamic records source
+// its records are answered from now on
+func (c *Cache) AddDynamic(d *DynamicRecords) error {
+    c.build.Lock()
+    defer c.build.Unlock()
+
+    c.dynamic = append(c.dynamic, d)
+
+    answers, next, err := buildAnswers(c.sets(c.rr, nil, nil), time.Now())
+    if err != nil {
+        c.dynamic = c.dynamic[:len(c.dynamic)-1]
+        return err
+    }
 
-            if sl[1] == "nxdomain" {
-                if len(sl) > 2 {
-                    cCrit.Print("Flags do not make sense with NXDOMAIN: " +  line)
-                    fail = true
-                    break
+    c.publish(answers, next)
+    return nil
+}
+
+// change dynamic records
+// fn gets current records and returns the new ones,
+// these are saved and answered only if all records still build
+func (c *Cache) Change(d *DynamicRecords, fn func(rr []*Record) ([]*Record, error)) error {
+    c.build.Lock()
+    defer c.build.Unlock()
+
+    rr, err := fn(append(make([]*Record, 0, len(d.rr)), d.rr...))
+    if err != nil {
+        return err
+    }
+
+    answers, next, err := buildAnswers(c.sets(c.rr, d, rr), time.Now())
+    if err != nil {
+        return err
+    }
+
+    if err := d.save(rr); err != nil {
+        return err
+    }
+
+    d.rr = rr
+    c.publish(answers, next)
+
+    return nil
+}
+
+// all records, RR files and dynamic
+func (c *Cache) Records() []*Record {
+    c.build.Lock()
+    defer c.build.Unlock()
+
+    return c.records()
+}
+
+// build lock held (Change)
+func (c *Cache) records() []*Record {
+    rr := make([]*Record, 0)
+    for _, s := range c.sets(c.rr, nil, nil) {
+        rr = append(rr, s...)
+    }
+
+    return rr
+}
+
+// rebuild answers from loaded records, RR files are not re-read,
+// expired records are dropped (there is no cache of upstream answers)
+// name (when not empty) must be in cache, returns number of its answers
+// (all answers without name) built again
+func (c *Cache) Rebuild(name string) (int, error) {
+    c.build.Lock()
+    defer c.build.Unlock()
+
+    n := 0
+    for _, rrs := range *c.pool.Load() {
+        if name == "" {
+            n += len(rrs)
+            continue
+        }
+
+        if _, ok := rrs[name]; ok {
+            n++
+        }
+    }
+
+    if name != "" && n == 0 {
+        return 0, fmt.Errorf("Not in cache: %s", name)
+    }
+
+    answers, next, err := buildAnswers(c.sets(c.rr, nil, nil), time.Now())
+    if err != nil {
+        return 0, err
+    }
+
+    c.publish(answers, next)
+    cInfo.Printf("Answers rebuilt: %s (%d)", name, n)
+
+    return n, nil
+}
+
+// answers by type, name
+func (c *Cache) Answers() map[int]map[string]*Answer {
+    return *c.pool.Load()
+}
+
+// drop expired records
+func (c *Cache) expire() {
+    // logged once until it changes
+    failed := ""
+    for {
+        time.Sleep(RR_EXPIRE_CHECK * time.Second)
+
+        c.build.Lock()
+        now := time.Now()
+        if c.next.IsZero() || now.Before(c.next) {
+            c.build.Unlock()
+            continue
+        }
+
+        // dynamic records are removed for good
+        // RR file records are only not answered anymore
+        keep := make([][]*Record, len(c.dynamic))
+        gone := make([]*Record, 0)
+        for i, d := range c.dynamic {
+            keep[i] = make([]*Record, 0, len(d.rr))
+            for _, r := range d.rr {
+                if r.expired(now) {
+                    gone = append(gone, r)
+                    continue
                 }
 
-                answers[A][sl[0]] = NewNxdomain(sl[0])
-                continue
+                keep[i] = append(keep[i], r)
             }
+        }
 
-            // flags/options
-            for _, f := range sl[2:] {
-                switch f {
-                //case "auth":    auth = true
-                case "ptr":     ptr = true
-                case "cname":   cname = true
-                case "mx":      mx = true
-                default:
-                    // TODO
-                    // flags with values
-                    fmt.Println(f)
-                    if ok := rTTL.MatchString(f); ok {
-                        t := strings.Split(f, ":")
-                        fmt.Println(">>>*>>>>>>>>>>>>>> " + t[1])
-                        continue
-                    }
+        s := [][]*Record{c.rr}
+        s = append(s, keep...)
 
-                    fail = true
-                    break
-                }
+        answers, next, err := buildAnswers(s, now)
+        if err != nil {
+            // e.g. CNAME to expired A record
+            // keep answering as is, retried on next check
+            if err.Error() != failed {
+                cCrit.Print("Could not expire records, retrying: " + err.Error())
+                failed = err.Error()
             }
+            c.build.Unlock()
+            continue
+        }
+        failed = ""
+
+        for _, r := range gone {
+            cInfo.Printf("Record expired: %s (%s)", r.String(), r.src)
+        }
 
-            if fail {
-                cCrit.Print("Unknown flag(s): " + line)
-                break
+        for i, d := range c.dynamic {
+            if len(keep[i]) == len(d.rr) {
+                continue
             }
 
-            if ptr && cname {
-                cCrit.Print("Invalid definition: PTR+CNAME: " + line)
-                fail = true
-                break
+            if err := d.save(keep[i]); err != nil {
+                cCrit.Print("Could not save records: " + err.Error())
             }
+            d.rr = keep[i]
+        }
 
-            // A
-            if rIp4.MatchString(sl[1]) {
-                if cname {
-                    cCrit.Print("Invalid definition: A+CNAME: " + line)
-                    fail = true
-                    break
-                }
+        c.publish(answers, next)
+        c.build.Unlock()
+    }
+}
+
+// RR file
+func readRecords(f, domain string) ([]*Record, error) {
+    fh, err := os.Open(f)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
 
-				dup := false
-				// check for duplicated IPs
-				if ips, ok := an[sl[0]]; ok {
-					for _, ip := range ips {
-						if ip == sl[1] {
-							cWarn.Printf("IP duplication: %s A %s", sl[0], ip)
-							dup = true
-							break
-						}
-					}
-				}
-
-				// ignore duplicates but don't die
-				if dup {
-					continue
-				}
+    // all bad lines are reported
+    rr := make([]*Record, 0)
+    errs := make([]error, 0)
 
-                // use these later for CNAME definition
-				an[sl[0]] = append(an[sl[0]], sl[1])
-
-				if ptr {
-					iaa := InAddrArpa(sl[1])
-					answers[PTR][iaa] = NewPtr(iaa, sl[0])
-					//could also be mx
-					//continue
-				}
+    n := 0
+    scanner := bufio.NewScanner(fh)
+    for scanner.Scan() {
+        line := scanner.Text()
+        n++
+
+        if ok := comment.MatchString(line); ok {
+            continue
+        }
+        if ok := empty.MatchString(line); ok {
+            continue
+        }
+
+        r, err := parseRecord(line, domain)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s:%d: %s", f, n, err.Error()))
+            continue
+        }
+
+        r.src = fmt.Sprintf("%s:%d", f, n)
+        rr = append(rr, r)
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("Could not read RR file: %s: %s", f, err.Error())
+    }
+
+    // records of good lines too
+    return rr, errors.Join(errs...)
+}
+
+// hosts file
+// IP name [alias ...] [# comment]
+// the first name of IP gets PTR
+func readHosts(f, domain string) ([]*Record, error) {
+    fh, err := os.Open(f)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
+
+    rr := make([]*Record, 0)
+    errs := make([]error, 0)
+    ptr := make(map[string]bool)
+
+    n := 0
+    scanner := bufio.NewScanner(fh)
+    for scanner.Scan() {
+        line, _, _ := strings.Cut(scanner.Text(), "#")
+        n++
+
+        sl := strings.Fields(line)
+        if len(sl) == 0 {
+            continue
+        }
+
+        ip, err := netip.ParseAddr(sl[0])
+        if err != nil || ip.Zone() != "" || len(sl) < 2 {
+            errs = append(errs, fmt.Errorf("%s:%d: Invalid hosts line: %s", f, n, line))
+            continue
+        }
+        ip = ip.Unmap()
+
+        for _, h := range sl[1:] {
+            l := h + " " + ip.String()
+            if !ptr[ip.String()] {
+                ptr[ip.String()] = true
+                l += " ptr"
             }
 
-            // AAAA
-            if rIp6.MatchString(sl[1]) {
-                if cname {
-                    cCrit.Print("Invalid definition: AAAA+CNAME: " + line)
-                }
+            r, err := parseRecord(l, domain)
+            if err != nil {
+                errs = append(errs, fmt.Errorf("%s:%d: %s", f, n, err.Error()))
+                continue
+            }
 
-				// check for duplicated IPs
-				// maximize first!
-				ip6max := ipv6Maximize(sl[1])
-
-				dup := false
-				if ips6, ok := aaaan[sl[0]]; ok {
-					for _, ip6 := range ips6 {
-						if ip6 == ip6max {
-							cWarn.Printf("IP duplication: %s AAAA %s", sl[0], ipv6Minimize(ip6))
-							dup = true
-							break
-						}
-					}
-				}
-
-				if dup {
-					continue
-				}
+            r.src = fmt.Sprintf("%s:%d", f, n)
+            rr = append(rr, r)
+        }
+    }
 
-                // use these later for CNAME definition
-                aaaan[sl[0]] = append(aaaan[sl[0]], ip6max)
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("Could not read hosts file: %s: %s", f, err.Error())
+    }
 
-                if ptr {
-                    iaa := InAddrArpa6(sl[1])
-                    answers[PTR][iaa] = NewPtr(iaa, sl[0])
-                    //could also be mx
-                    //continue
-                }
+    // records of good lines too
+    return rr, errors.Join(errs...)
+}
+
+// records of all files as one set, the same name and type
+// from more than one file (conflict) resolved by policy:
+//   merge     all kept, A, AAAA, TXT merged (others the last file)
+//   first     of the first file (load order)
+//   priority  of the file with the highest priority, the last of equal
+//   error     as first, conflicts fail the load (caller)
+// conflicts are returned
+func resolveConflicts(files []string, sets [][]*Record, policy string, priority map[string]int) ([]*Record, []error) {
+    // file (set) answering the name and type
+    // and its first record, for logging
+    win := make(map[string]int)
+    first := make(map[string]*Record)
+    seen := make(map[string]bool)
+
+    conflicts := make([]error, 0)
+    for i, set := range sets {
+        for _, r := range set {
+            k := r.conflictKey()
+            w, ok := win[k]
+            if !ok {
+                win[k], first[k] = i, r
+                continue
             }
 
-            if mx {
-                if ptr {
-                    cCrit.Print("Invalid definition: MX+PTR: " + line)
-                    fail = true
-                    break
-                }
-                if cname {
-                    cCrit.Print("Invalid definition: MX+CNAME: " + line)
-                    fail = true
-                    break
-                }
+            // once per name, type and file
+            if w == i || seen[fmt.Sprintf("%s %d", k, i)] {
+                continue
+            }
+            seen[fmt.Sprintf("%s %d", k, i)] = true
+
+            switch policy {
+            case RR_CONFLICT_MERGE:
+                conflicts = append(conflicts, fmt.Errorf("%s: Conflict: %s %s merged with %s", r.src, r.host, r.Type(), first[k].src))
 
-                // check 2nd host
-                if ok := rHost.MatchString(sl[1]); !ok {
-                    cWarn.Print("Invalid hostname: " + sl[1])
-                    fail = true
-                    break
+            case RR_CONFLICT_PRIORITY:
+                if filePriority(files[i], priority) >= filePriority(files[w], priority) {
+                    conflicts = append(conflicts, fmt.Errorf("%s: Conflict: %s %s replaces %s", r.src, r.host, r.Type(), first[k].src))
+                    win[k], first[k] = i, r
+                    continue
                 }
+                fallthrough
 
-                // save for A name lookup later
-                mn[sl[0]] = sl[1]
+            default:
+                conflicts = append(conflicts, fmt.Errorf("%s: Conflict: %s %s ignored, answered from %s", r.src, r.host, r.Type(), first[k].src))
             }
         }
+    }
 
-        if err := scanner.Err(); err != nil {
-            if init {
-                panic(err)
+    rr := make([]*Record, 0)
+    for i, set := range sets {
+        for _, r := range set {
+            if policy == RR_CONFLICT_MERGE || win[r.conflictKey()] == i {
+                rr = append(rr, r)
             }
+        }
+    }
+
+    return rr, conflicts
+}
 
-            cCrit.Print("Could not read RR file: " + f + ": " + err.Error())
-            return
+// rr.priority of file, the longest matching path (file or dir)
+// 0 when none
+func filePriority(f string, priority map[string]int) int {
+    l, p := -1, 0
+    for path, n := range priority {
+        if (f == path || strings.HasPrefix(f, strings.TrimSuffix(path, "/") + "/")) && len(path) > l {
+            l, p = len(path), n
         }
+    }
+
+    return p
+}
+
+// answers from record sets
+// later sets overwrite earlier ones (by name)
+// also returns earliest expiry of the records
+// all records are built, errors joined (errors.Join)
+func buildAnswers(sets [][]*Record, now time.Time) (map[int]map[string]*Answer, time.Time, error) {
+    var next time.Time
+    errs := make([]error, 0)
+
+    // this is local cache
+    // populate answers to populate cache
+    answers := map[int]map[string]*Answer{
+        A: {},
+        AAAA: {},
+        CNAME: {},
+        SOA: {},
+        PTR: {},
+        MX: {},
+        TXT: {},
+    }
+
+    for _, set := range sets {
+        // composites records
+        // CNAME, A, AAAA, MX
+        cn := make(map[string]string)
+        an := make(map[string][]string)
+        aaaan := make(map[string][]string)
+        mn := make(map[string]string)
+        txt := make(map[string][]string)
+
+        // file:line of CNAME, MX for errors
+        src := make(map[string]string)
 
-        if fail {
-            err := "!!!!! ERROR: Won't load cache"
+        // file:line of records by answer
+        from := map[int]map[string][]string{A: {}, AAAA: {}, CNAME: {}, PTR: {}, MX: {}, TXT: {}}
 
-            if init {
-                panic(err)
+        for _, r := range set {
+            if r.expired(now) {
+                continue
+            }
+
+            if !r.expire.IsZero() && (next.IsZero() || r.expire.Before(next)) {
+                next = r.expire
             }
 
-            cCrit.Print(err)
-            return
+            switch r.Type() {
+            case "NXDOMAIN":
+                answers[A][r.host] = NewNxdomain(r.host)
+                from[A][r.host] = append(from[A][r.host], r.src)
+
+            case "CNAME":
+                cn[r.host] = r.value
+                src[r.host + " CNAME"] = r.src
+                from[CNAME][r.host] = append(from[CNAME][r.host], r.src)
+
+            case "MX":
+                // save for A name lookup later
+                mn[r.host] = r.value
+                src[r.host + " MX"] = r.src
+                from[MX][r.host] = append(from[MX][r.host], r.src)
+
+            case "PTR":
+                answers[PTR][r.host] = NewPtr(r.host, r.value)
+                from[PTR][r.host] = append(from[PTR][r.host], r.src)
+
+            case "TXT":
+                txt[r.host] = append(txt[r.host], r.value)
+                from[TXT][r.host] = append(from[TXT][r.host], r.src)
+
+            case "A":
+                dup := false
+                // check for duplicated IPs
+                for _, ip := range an[r.host] {
+                    if ip == r.value {
+                        cWarn.Printf("IP duplication: %s A %s (%s)", r.host, ip, r.src)
+                        dup = true
+                        break
+                    }
+                }
+
+                // ignore duplicates but don't die
+                if dup {
+                    continue
+                }
+
+                // use these later for CNAME definition
+                an[r.host] = append(an[r.host], r.value)
+                from[A][r.host] = append(from[A][r.host], r.src)
+
+                if r.ptr {
+                    iaa := InAddrArpa(r.value)
+                    answers[PTR][iaa] = NewPtr(iaa, r.host)
+                    from[PTR][iaa] = append(from[PTR][iaa], r.src)
+                }
+
+            case "AAAA":
+                // check for duplicated IPs
+                // maximize first!
+                ip6max := ipv6Maximize(r.value)
+
+                dup := false
+                for _, ip6 := range aaaan[r.host] {
+                    if ip6 == ip6max {
+                        cWarn.Printf("IP duplication: %s AAAA %s (%s)", r.host, ipv6Minimize(ip6), r.src)
+                        dup = true
+                        break
+                    }
+                }
+
+                if dup {
+                    continue
+                }
+
+                // use these later for CNAME definition
+                aaaan[r.host] = append(aaaan[r.host], ip6max)
+                from[AAAA][r.host] = append(from[AAAA][r.host], r.src)
+
+                if r.ptr {
+                    iaa := InAddrArpa6(r.value)
+                    answers[PTR][iaa] = NewPtr(iaa, r.host)
+                    from[PTR][iaa] = append(from[PTR][iaa], r.src)
+                }
+            }
         }
 
         // process A records
@@ -329,12 +783,8 @@ func (c *Cache) load(init bool) {
         for h, ips := range an {
             a, err := NewA(h, ips)
             if err != nil {
-                if init {
-                    panic(err)
-                }
-
-                cCrit.Print("Could not process A record: " + h + ", " + err.Error())
-                return
+                errs = append(errs, fmt.Errorf("Could not process A record: %s, %s", h, err.Error()))
+                continue
             }
 
             answers[A][a.QuestionString()] = a
@@ -343,28 +793,30 @@ func (c *Cache) load(init bool) {
         for h, ips := range aaaan {
             aaaa, err := NewAAAA(h, ips)
             if err != nil {
-                if init {
-                    panic(err)
-                }
-
-                cCrit.Print("Could not process AAAA record: " + h + ", " + err.Error())
-                return
+                errs = append(errs, fmt.Errorf("Could not process AAAA record: %s, %s", h, err.Error()))
+                continue
             }
 
             answers[AAAA][aaaa.QuestionString()] = aaaa
         }
 
+        for h, t := range txt {
+            a, err := NewTxt(h, t)
+            if err != nil {
+                errs = append(errs, fmt.Errorf("Could not process TXT record: %s, %s", h, err.Error()))
+                continue
+            }
+
+            answers[TXT][h] = a
+        }
+
         // process CNAMEs
         for h1, h2 := range cn {
             // chain on 2nd hostname
             n, err := cnameChain(h2, cn, answers)
             if err != nil {
-                if init {
-                    panic(err)
-                }
-
-                cCrit.Print(err.Error())
-                return
+                errs = append(errs, fmt.Errorf("%s: %s", src[h1 + " CNAME"], err.Error()))
+                continue
             }
 
             n = append(n, "")
@@ -373,12 +825,8 @@ func (c *Cache) load(init bool) {
 
             a, err := NewCname(h1, n, answers)
             if err != nil {
-                if init {
-                    panic(err)
-                }
-
-                cCrit.Print(err.Error())
-                return
+                errs = append(errs, fmt.Errorf("%s: %s", src[h1 + " CNAME"], err.Error()))
+                continue
             }
 
             answers[CNAME][a.QuestionString()] = a
@@ -387,53 +835,59 @@ func (c *Cache) load(init bool) {
         // process MX records
         for k, v := range mn {
             if _, ok := answers[A][v]; !ok {
-                err := errors.New("Cannot find A record: " + v)
-                if init {
-                    panic(err)
-                }
-
-                cCrit.Print(err.Error())
-                return
+                errs = append(errs, fmt.Errorf("%s: Cannot find A record: %s", src[k + " MX"], v))
+                continue
             }
 
             m, err := NewMx(k, v, answers)
             if err != nil {
-                if init {
-                    panic(err)
-                }
-
-                cCrit.Print(err.Error())
-                return
+                errs = append(errs, fmt.Errorf("%s: %s", src[k + " MX"], err.Error()))
+                continue
             }
 
             answers[MX][k] = m
         }
 
-        cInfo.Printf("DNS entries from: %s", f)
-        for k, _ := range answers {
-            cInfo.Printf("'%s' records loaded: %d", RequestTypeString(k), len(answers[k]))
+        for t, m := range from {
+            for n, s := range m {
+                if a, ok := answers[t][n]; ok {
+                    a.src = s
+                }
+            }
         }
     }
 
-    // safe reload
-    if debug {
-        cDebg.Print("Locking and reloading cache")
+    if len(errs) > 0 {
+        sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+        return nil, next, errors.Join(errs...)
     }
 
-    c.mux.RLock()
-    c.pool = answers
-    c.mux.RUnlock()
+    return answers, next, nil
+}
+
+// any record of the name
+func (c *Cache) Has(s string) bool {
+    for _, rrs := range *c.pool.Load() {
+        if _, ok := rrs[s]; ok {
+            return true
+        }
+    }
+
+    return false
+}
+
+// NXDOMAIN record of the name
+func (c *Cache) Blocked(s string) bool {
+    a, ok := (*c.pool.Load())[A][s]
+    return ok && a.t == NXDOMAIN
 }
 
 func (c *Cache) Get(t int, s string) *Answer {
-    // don't think this is needed
-    // safe read
-    //c.mux.RLock()
-    //defer c.mux.RUnlock()
+    pool := *c.pool.Load()
 
-    if a, ok := c.pool[t][s]; ok {
-        if debug {
-            cDebg.Printf("Found in cache: %s/%s", RequestTypeString(t), s)
+    if a, ok := pool[t][s]; ok {
+        if cDebg.On() {
+            cDebg.Printf("Found in cache: %s/%s %v", RequestTypeString(t), s, a.src)
         }
 
         return a
@@ -441,39 +895,46 @@ func (c *Cache) Get(t int, s string) *Answer {
 
     // look also in CNAME if A lookup
     if t == A {
-        if a, ok := c.pool[CNAME][s]; ok {
-            if debug {
-                cDebg.Printf("Found in cache: %s/%s", "CNAME", s)
+        if a, ok := pool[CNAME][s]; ok {
+            if cDebg.On() {
+                cDebg.Printf("Found in cache: %s/%s %v", "CNAME", s, a.src)
             }
 
             return a
         }
     }
 
-    if debug {
+    if cDebg.On() {
         cDebg.Print("Not found in cache: " + s)
     }
 
     return nil
 }
 
+// names s points to, up to the A record
+// a name seen twice is a loop
 func cnameChain(s string, cn map[string]string, answers map[int]map[string]*Answer) ([]string, error) {
     r := make([]string, 0)
+    first := s
+    seen := map[string]bool{s: true}
 
-    if _, ok := cn[s]; ok {
-        r = append(r, cn[s])
-
-        next, err := cnameChain(cn[s], cn, answers)
-        if err != nil {
-            return nil, err
+    for {
+        next, ok := cn[s]
+        if !ok {
+            break
         }
 
-        r = append(r, next...)
-    } else {
-        if _, ok := answers[A][s]; !ok {
-            fmt.Println("ERROR ERROR: " + s)
-            return nil, fmt.Errorf("Cannot find A record: " + s)
+        r = append(r, next)
+        if seen[next] {
+            return nil, fmt.Errorf("CNAME loop: %s -> %s", first, strings.Join(r, " -> "))
         }
+
+        seen[next] = true
+        s = next
+    }
+
+    if _, ok := answers[A][s]; !ok {
+        return nil, fmt.Errorf("Cannot find A record: " + s)
     }
 
     return r, nil
@@ -490,13 +951,9 @@ func InAddrArpa6(ip string) string {
     ips := strings.Split(ipv6Maximize(ip), "")
 
     ipr := make([]string, len(ips))
-    for i, j := 0, len(ips)-1; i<len(ips); i++ {
-        if i > j {
-            break;
-        }
-
+    for i, j := 0, len(ips)-1; i<=j; i, j = i+1, j-1 {
         ipr[i], ipr[j] = ips[j], ips[i]
     }
 
-    return strings.Join(ipr, ".")
+    return strings.Join(ipr, ".") + ".ip6.arpa"
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "sync"
+    "time"
+    "crypto/tls"
+)
+
+// Server certificate for TLS listeners.
+// Reloaded on file change and SIGHUP, handshakes always get the
+// latest good one, failed reload keeps the previous certificate.
+
+type CertStore struct {
+    // pem files
+    cert string
+    key string
+
+    mux sync.RWMutex
+    current *tls.Certificate
+
+    // change tracking
+    certStat *fstat
+    keyStat *fstat
+}
+
+func NewCertStore(cert, key string) (*CertStore, error) {
+    cs := &CertStore{cert: cert, key: key}
+    if err := cs.Reload(); err != nil {
+        return nil, err
+    }
+
+    return cs, nil
+}
+
+func (cs *CertStore) Reload() error {
+    // stat first, file may change while loading
+    // which will be picked up on next check
+    cst, kst := newFstat(cs.cert), newFstat(cs.key)
+
+    c, err := tls.LoadX509KeyPair(cs.cert, cs.key)
+    if err != nil {
+        sCrit.Printf("Could not load TLS certificate: %s, key: %s, error: %s", cs.cert, cs.key, err.Error())
+        return err
+    }
+
+    cs.mux.Lock()
+    cs.current = &c
+    cs.certStat, cs.keyStat = cst, kst
+    cs.mux.Unlock()
+
+    sInfo.Printf("Loaded TLS certificate: %s", cs.cert)
+    return nil
+}
+
+func (cs *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    cs.mux.RLock()
+    defer cs.mux.RUnlock()
+
+    return cs.current, nil
+}
+
+// cert/key file watcher
+// purely based on change time
+func (cs *CertStore) Watch() {
+    for {
+        time.Sleep(1 * time.Second)
+
+        cs.mux.RLock()
+        cst, kst := cs.certStat, cs.keyStat
+        cs.mux.RUnlock()
+
+        c, k := newFstat(cs.cert), newFstat(cs.key)
+        if !c.exists() || !k.exists() {
+            // in the middle of being replaced
+            continue
+        }
+
+        if c.ctime != cst.ctime || k.ctime != kst.ctime || c.inode != cst.inode || k.inode != kst.inode {
+            sInfo.Printf("TLS certificate changed, reloading")
+
+            // on failure keep the current one
+            // and don't try again until next change
+            if err := cs.Reload(); err != nil {
+                cs.mux.Lock()
+                cs.certStat, cs.keyStat = c, k
+                cs.mux.Unlock()
+            }
+        }
+    }
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "time"
+    "errors"
+    "strings"
+)
+
+//
+// dpx check [-config file]
+//
+// Config and all record sources parsed the same as on start up,
+// nothing is bound or created, no privileges dropped (missing log
+// dirs are warnings). Every problem is printed (file:line where
+// known), exit status is 1 on any.
+// Meant for pre-commit hooks of records and ExecReload.
+//
+// Conflicts across RR and hosts files are resolved by rr.conflict,
+// printed as warnings (problems with rr.conflict = error). Dynamic
+// records (admin, updates, leases) replacing the files is what they
+// are for, printed as info. CNAME with other records of its name
+// is a problem. View records are checked on their own.
+
+func Check(config string) int {
+    problems := 0
+    report := func(err error) {
+        for _, e := range errorList(err) {
+            fmt.Println(e.Error())
+            problems++
+        }
+    }
+
+    conf, warn, err := checkConfig(config)
+    for _, w := range warn {
+        fmt.Printf("%s: Warning: %s\n", config, w)
+    }
+
+    if err != nil {
+        report(err)
+        fmt.Printf("%s: %d problem(s) found\n", config, problems)
+        return 1
+    }
+
+    // created on start, not here
+    seen := make(map[string]bool)
+    for _, d := range conf.logDirs() {
+        if seen[d] {
+            continue
+        }
+        seen[d] = true
+
+        if _, err := os.Stat(d); errors.Is(err, os.ErrNotExist) {
+            fmt.Printf("%s: Warning: Log dir does not exist (created on start): %s\n", config, d)
+        }
+    }
+
+    // record sources, in load order
+    sets := make([][]*Record, 0)
+    names := make([]string, 0)
+    sources := 0
+    read := func(f string, fn func(string, string) ([]*Record, error), optional bool) {
+        // good lines are checked further
+        rr, err := fn(f, conf.defaultDomain)
+        if err != nil {
+            if optional && errors.Is(err, os.ErrNotExist) {
+                return
+            }
+
+            report(err)
+        }
+
+        if rr == nil {
+            return
+        }
+
+        sets = append(sets, rr)
+        names = append(names, f)
+        sources++
+    }
+
+    // files read so far as one set (rr.conflict)
+    resolve := func() []*Record {
+        rr, cf := resolveConflicts(names, sets, conf.rrConflict, conf.rrPriority)
+        for _, e := range cf {
+            if conf.rrConflict == RR_CONFLICT_ERROR {
+                report(e)
+                continue
+            }
+
+            fmt.Printf("%s (rr.conflict = %s)\n", e.Error(), conf.rrConflict)
+        }
+
+        return rr
+    }
+
+    rf, err := conf.rrFiles()
+    if err != nil {
+        report(err)
+    }
+
+    for _, f := range rf {
+        read(f, readRecords, false)
+    }
+
+    for _, f := range conf.hostsFiles {
+        fs := newFstat(f)
+        if fs.exists() && !fs.worldReadable() {
+            report(errors.New(f + ": Must be world readable"))
+            continue
+        }
+
+        read(f, readHosts, false)
+    }
+
+    sets = [][]*Record{resolve()}
+
+    // dynamic records, files created on first change
+    if conf.adminListen != "" && conf.adminRR != "" {
+        read(conf.adminRR, readRecords, true)
+    }
+
+    if len(conf.updateZones) > 0 && conf.updateJournal != "" {
+        read(conf.updateJournal, func(f, domain string) ([]*Record, error) {
+            return readJournal(f, UPDATE_SOURCE, domain)
+        }, true)
+    }
+
+    for path, format := range conf.dhcpLeases {
+        f := &leaseFile{format: format, path: path}
+        if _, err := f.read(); err != nil && !errors.Is(err, os.ErrNotExist) {
+            report(fmt.Errorf("%s: %s", path, err.Error()))
+        }
+    }
+
+    over, clash := conflicts(sets)
+    for _, o := range over {
+        fmt.Printf("%s (info)\n", o)
+    }
+
+    for _, err := range clash {
+        report(err)
+    }
+
+    // CNAME, MX targets, each one
+    if _, _, err := buildAnswers(sets, time.Now()); err != nil {
+        report(err)
+    }
+
+    n := 0
+    for _, s := range sets {
+        n += len(s)
+    }
+
+    // views, self-contained
+    for _, v := range mapKeys(conf.viewRR) {
+        vf, err := conf.rrFilesIn(conf.viewRR[v])
+        if err != nil {
+            report(err)
+        }
+
+        sets, names = make([][]*Record, 0), make([]string, 0)
+        for _, f := range vf {
+            read(f, readRecords, false)
+        }
+
+        rr := resolve()
+        _, clash := conflicts([][]*Record{rr})
+        for _, err := range clash {
+            report(err)
+        }
+
+        if _, _, err := buildAnswers([][]*Record{rr}, time.Now()); err != nil {
+            for _, e := range errorList(err) {
+                report(fmt.Errorf("view %s: %w", v, e))
+            }
+        }
+
+        n += len(rr)
+    }
+
+    if problems > 0 {
+        fmt.Printf("%s: %d problem(s) found\n", config, problems)
+        return 1
+    }
+
+    fmt.Printf("%s: OK, %d records from %d sources\n", config, n, sources)
+    return 0
+}
+
+// config parsing panics on some errors
+func checkConfig(config string) (conf *cfg, warn []string, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("%s: %v", config, r)
+        }
+    }()
+
+    conf, warn, err = newCfg(config)
+    if err != nil && !strings.HasPrefix(err.Error(), config + ":") {
+        err = fmt.Errorf("%s: %w", config, err)
+    }
+
+    return conf, warn, err
+}
+
+// same name and type in more than one record set (overrides)
+// CNAME with other records of the name (clashes)
+func conflicts(sets [][]*Record) ([]string, []error) {
+    type def struct {
+        src string
+        set int
+    }
+
+    over := make([]string, 0)
+    seen := make(map[string]def)
+    for i, set := range sets {
+        for _, r := range set {
+            k := r.host + " " + r.Type()
+            d, ok := seen[k]
+            if ok && d.set != i {
+                over = append(over, fmt.Sprintf("%s: %s %s replaces %s", r.src, r.host, r.Type(), d.src))
+            }
+
+            if !ok || d.set != i {
+                seen[k] = def{r.src, i}
+            }
+        }
+    }
+
+    cn := make([]error, 0)
+    for k, d := range seen {
+        host, t, _ := strings.Cut(k, " ")
+        if t != "CNAME" {
+            continue
+        }
+
+        for _, o := range []string{"A", "AAAA", "MX", "TXT", "NXDOMAIN"} {
+            if od, ok := seen[host + " " + o]; ok {
+                cn = append(cn, fmt.Errorf("%s: Conflict: %s CNAME and %s (%s)", d.src, host, o, od.src))
+            }
+        }
+    }
+
+    sort.Slice(cn, func(i, j int) bool { return cn[i].Error() < cn[j].Error() })
+    return over, cn
+}
+
+// errors joined (errors.Join) one by one
+func errorList(err error) []error {
+    if j, ok := err.(interface{ Unwrap() []error }); ok {
+        return j.Unwrap()
+    }
+
+    return []error{err}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "io"
+    "os"
+    "strings"
+    "testing"
+    "path/filepath"
+)
+
+// dpx check of config with rr.dir of files (name: lines)
+// exit status and output
+func testCheck(t *testing.T, files map[string][]string) (int, string) {
+    t.Helper()
+    testLogs()
+
+    dir := t.TempDir()
+    rr := filepath.Join(dir, "rr")
+    if err := os.Mkdir(rr, 0755); err != nil {
+        t.Fatal(err)
+    }
+
+    // o+r up the path, whatever the umask
+    for _, d := range []string{filepath.Dir(dir), dir, rr} {
+        if err := os.Chmod(d, 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    for name, lines := range files {
+        if err := os.WriteFile(filepath.Join(rr, name), []byte(strings.Join(lines, "\n") + "\n"), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // logs not created by check
+    config := testFile(t, "dpx.cfg",
+        "rr.dir = " + rr,
+        "server.log = " + filepath.Join(dir, "log", "server.log"),
+        "cache.log = " + filepath.Join(dir, "log", "cache.log"),
+        "control.socket = " + filepath.Join(dir, "run", "dpx.sock"),
+    )
+
+    r, w, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    stdout := os.Stdout
+    os.Stdout = w
+    rc := Check(config)
+    os.Stdout = stdout
+    w.Close()
+
+    out, _ := io.ReadAll(r)
+
+    for _, d := range []string{"log", "run"} {
+        if _, err := os.Stat(filepath.Join(dir, d)); err == nil {
+            t.Errorf("check created: %s", d)
+        }
+    }
+
+    return rc, string(out)
+}
+
+func TestCheckCnameLoop(t *testing.T) {
+    rc, out := testCheck(t, map[string][]string{
+        "loop.rr": {"x.example y.example cname", "y.example x.example cname"},
+    })
+
+    if rc != 1 {
+        t.Errorf("exit: %d, want 1\n%s", rc, out)
+    }
+
+    for _, l := range []string{"loop.rr:1: CNAME loop", "loop.rr:2: CNAME loop", "2 problem(s) found"} {
+        if !strings.Contains(out, l) {
+            t.Errorf("missing: %s\n%s", l, out)
+        }
+    }
+}
+
+func TestCheckTargets(t *testing.T) {
+    rc, out := testCheck(t, map[string][]string{
+        "a.rr": {
+            "host.example 192.0.2.1",
+            "c1.example nope1.example cname",
+            "c2.example nope2.example cname",
+            "m.example nope3.example mx",
+            "ok.example host.example cname",
+        },
+    })
+
+    if rc != 1 {
+        t.Errorf("exit: %d, want 1\n%s", rc, out)
+    }
+
+    // every one, with file:line
+    for _, l := range []string{
+        "a.rr:2: Cannot find A record: nope1.example",
+        "a.rr:3: Cannot find A record: nope2.example",
+        "a.rr:4: Cannot find A record: nope3.example",
+        "3 problem(s) found",
+    } {
+        if !strings.Contains(out, l) {
+            t.Errorf("missing: %s\n%s", l, out)
+        }
+    }
+
+    if !strings.Contains(out, "Warning: Log dir does not exist") {
+        t.Errorf("missing log dir warning\n%s", out)
+    }
+}
@@ -6,11 +6,15 @@ import (
     "strings"
     "regexp"
     "os"
+    "net"
     "errors"
     "strconv"
+    "sort"
     "path/filepath"
-    "math/rand"
-    "time"
+    "net/url"
+    "net/netip"
+    "crypto/sha256"
+    "encoding/base64"
 )
 
 var comment = regexp.MustCompile(`^\s*#`)
@@ -27,6 +31,15 @@ type host struct {
     name string
     port int
     proto string
+
+    // upstream transport (udp, tls, https)
+    scheme string
+
+    // tls server name (certificate verification)
+    tlsName string
+
+    // https url
+    url string
 }
 
 // Accepts ipv4 net definiton
@@ -114,7 +127,68 @@ func NewHost(ip string, port int, proto string) (host, error) {
         return host{}, fmt.Errorf("Invalid proto: %s", proto)
     }
 
-    return host{ip, port, proto}, nil
+    return host{name: ip, port: port, proto: proto, scheme: SCHEME_UDP}, nil
+}
+
+// Accepts upstream (dialer) definition
+// ip.ad.d.r:port, [ip]:port             plain udp
+// tls://ip.ad.d.r:port#server.name      DNS over TLS, port defaults to 853
+//                                       server.name defaults to the IP
+// https://host[:port]/path#ip.ad.d.r    DNS over HTTPS, optional bootstrap IP
+//                                       otherwise host is resolved by the system
+func NewDialerHost(s, proto string) (host, error) {
+    scheme := SCHEME_UDP
+    if i := strings.Index(s, "://"); i > 0 {
+        scheme = s[:i]
+        s = s[i+3:]
+    }
+
+    var tlsName string
+    if i := strings.Index(s, "#"); i >= 0 {
+        tlsName = s[i+1:]
+        s = s[:i]
+    }
+
+    if scheme == SCHEME_HTTPS {
+        return newHttpsHost(s, tlsName, proto)
+    }
+
+    var h host
+    var err error
+    switch proto {
+    case IPv4: h, err = NewHost4(s)
+    case IPv6: h, err = NewHost6(s)
+    default:
+        return host{}, fmt.Errorf("Invalid proto: %s", proto)
+    }
+    if err != nil {
+        return host{}, err
+    }
+
+    switch scheme {
+    case SCHEME_UDP:
+        if tlsName != "" {
+            return host{}, fmt.Errorf("Server name only applies to tls:// upstream: %s", s)
+        }
+
+    case SCHEME_TLS:
+        // port not defined
+        if !strings.Contains(s, "]:") && (proto == IPv6 || !strings.Contains(s, ":")) {
+            h.port = DOT_PORT
+        }
+
+        if tlsName == "" {
+            tlsName = h.name
+        }
+
+    default:
+        return host{}, fmt.Errorf("Unknown upstream scheme: %s", scheme)
+    }
+
+    h.scheme = scheme
+    h.tlsName = tlsName
+
+    return h, nil
 }
 
 func (h host) netConnString() string {
@@ -128,6 +202,111 @@ func (h host) netConnString() string {
     return s
 }
 
+// Accepts DNS over TLS listener definition
+// ip.ad.d.r:port, [ip]:port, port defaults to 853
+func NewListenerTLS(s string) (host, error) {
+    return newListener(s, DOT_PORT)
+}
+
+// DoH listener, plain http when not 'secure'
+// (behind a reverse proxy)
+func NewListenerHTTPS(s string, secure bool) (host, error) {
+    if secure {
+        return newListener(s, HTTPS_PORT)
+    }
+
+    return newListener(s, HTTP_PORT)
+}
+
+// ip[:port], port defaults to 'port'
+func newListener(s string, port int) (host, error) {
+    h, err := NewHost4(s)
+    if err == nil {
+        if !strings.Contains(s, ":") {
+            h.port = port
+        }
+
+        return h, nil
+    }
+
+    h, err = NewHost6(s)
+    if err != nil {
+        return host{}, fmt.Errorf("Invalid listener: %s", s)
+    }
+
+    if !strings.Contains(s, "]:") {
+        h.port = port
+    }
+
+    return h, nil
+}
+
+// DoH url and optional bootstrap IP
+func newHttpsHost(s, bootstrap, proto string) (host, error) {
+    u, err := url.Parse(SCHEME_HTTPS + "://" + s)
+    if err != nil {
+        return host{}, err
+    }
+    if u.Hostname() == "" {
+        return host{}, fmt.Errorf("Missing host in: %s", s)
+    }
+    if u.RawQuery != "" {
+        return host{}, fmt.Errorf("Query string not supported: %s", s)
+    }
+    if u.Path == "" {
+        u.Path = "/dns-query"
+    }
+
+    port := HTTPS_PORT
+    if u.Port() != "" {
+        port, err = strconv.Atoi(u.Port())
+        if err != nil {
+            return host{}, err
+        }
+    }
+
+    name := u.Hostname()
+    if bootstrap != "" {
+        h, err := NewHost(bootstrap, port, proto)
+        if err != nil {
+            return host{}, fmt.Errorf("Invalid bootstrap: %s", err.Error())
+        }
+
+        name = h.name
+    }
+
+    return host{
+        name:    name,
+        port:    port,
+        proto:   proto,
+        scheme:  SCHEME_HTTPS,
+        tlsName: u.Hostname(),
+        url:     u.String(),
+    }, nil
+}
+
+// upstream as defined in config
+func (h host) String() string {
+    if h.scheme == SCHEME_UDP {
+        return h.netConnString()
+    }
+
+    if h.scheme == SCHEME_HTTPS {
+        if h.name != h.tlsName {
+            return h.url + "#" + h.name
+        }
+
+        return h.url
+    }
+
+    s := h.scheme + "://" + h.netConnString()
+    if h.tlsName != "" && h.tlsName != h.name {
+        s += "#" + h.tlsName
+    }
+
+    return s
+}
+
 
 // Server config
 
@@ -169,6 +348,9 @@ type cfg struct {
 
     // Resource Records dir
     rrDir string
+    hostsFiles []string
+    rrConflict string
+    rrPriority map[string]int
 
     // cache update/reload
     cacheUpdate string
@@ -183,14 +365,125 @@ type cfg struct {
     // debug
     debug bool
 
+    // log level, default and per subsystem
+    logLevel int
+    logLevels map[string]int
+
+    // subsystem logs
+    upstreamLog string
+    workerLog string
+    blocklistLog string
+
     // proxy
     proxy bool
+
+    // upstream anti-spoofing
+    // DNS 0x20, out-of-bailiwick scrubbing
+    caseRand bool
+    bailiwick bool
+
+    // client query and response rate limits
+    rlQps int
+    rlBurst int
+    rlRrl int
+    rlSlip int
+    rlPrefix4 int
+    rlPrefix6 int
+    rlUdpSize int
+    rlExempt []netip.Prefix
+    rlLog int
+    workerInflight int
+
+    // upstream tls
+    // CA bundle (empty = system), pinned keys by server name, idle timeout
+    tlsCA string
+    tlsPin map[string][]string
+    tlsIdle int
+
+    // DNS over TLS listeners
+    listenerTLS []host
+    tlsCert string
+    tlsKey string
+    listenerHTTPS []host
+    listenerHTTP []host
+    httpsTrusted []netip.Prefix
+    httpsJSON bool
+    metricsListen string
+    controlSocket string
+    adminListen string
+    adminToken string
+    adminRR string
+    updateZones []string
+    updateKeys map[string][]byte
+    updateJournal string
+    dhcpLeases map[string]string
+    dhcpDomain string
+    dhcpConflict string
+    queryLog string
+    qlAnon bool
+    qlPrefix4 int
+    qlPrefix6 int
+    logRotateSize int64
+    logRotateAge int
+    logRotateKeep int
+    logRotateCompress bool
+
+    // upstream https
+    httpsGet bool
+    httpsTimeout int
+
+    // access control, empty = allow all
+    aclQuery []netip.Prefix
+    aclRecursion []netip.Prefix
+    aclAction string
+
+    // split horizon views by name
+    viewClients map[string][]netip.Prefix
+    viewRR map[string]string
+    viewDialer4 map[string][]host
+    viewDialer6 map[string][]host
+
+    // AAAA synthesis, invalid prefix = off
+    dns64Prefix netip.Prefix
+    dns64Exclude4 []netip.Prefix
+    dns64Exclude6 []netip.Prefix
+    dns64Clients []netip.Prefix
+
+    // rewrite rules, safe search profiles
+    rewriteRules []*RewriteRule
+    safeSearch []string
 }
 
 func newCfg(path string) (*cfg, []string, error) {
     // default config
     lh4, lh6, proxy, rh4, rh6, wUdp, wTcp, rrDir, cUpd, dDom, sLog, cLog, debug := defaultConfig()
-    c := &cfg{path, lh4, lh6, rh4, rh6, wUdp, wTcp, rrDir, cUpd, dDom, sLog, cLog, debug, proxy}
+    c := &cfg{
+        config:        path,
+        listener4:     lh4,
+        listener6:     lh6,
+        dialer4:       rh4,
+        dialer6:       rh6,
+        workerUDP:     wUdp,
+        workerTCP:     wTcp,
+        rrDir:         rrDir,
+        cacheUpdate:   cUpd,
+        defaultDomain: dDom,
+        serverLog:     sLog,
+        cacheLog:      cLog,
+        debug:         debug,
+        proxy:         proxy,
+        caseRand:      PROXY_0X20,
+        bailiwick:     PROXY_BAILIWICK,
+        rlSlip:        RATELIMIT_SLIP,
+        rlPrefix4:     RATELIMIT_PREFIX4,
+        rlPrefix6:     RATELIMIT_PREFIX6,
+        rlLog:         RATELIMIT_LOG,
+        workerInflight: WORKER_INFLIGHT,
+        aclAction:     ACL_REFUSE,
+        tlsPin:        make(map[string][]string),
+        tlsIdle:       TLS_IDLE,
+        httpsTimeout:  HTTPS_TIMEOUT,
+    }
 
     // disk config
     warn, err := c.fromDisk()
@@ -201,18 +494,22 @@ func newCfg(path string) (*cfg, []string, error) {
     return c, warn, err
 }
 
-func readFile(path string) ([]string, error) {
+// lines and their numbers
+func readFile(path string) ([]string, []int, error) {
     var lines []string
+    var nums []int
 
     fh, err := os.Open(path)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
     defer fh.Close()
 
+    n := 0
     scanner := bufio.NewScanner(fh)
     for scanner.Scan() {
         line := scanner.Text()
+        n++
 
         if ok := comment.MatchString(line); ok {
             continue
@@ -222,141 +519,736 @@ func readFile(path string) ([]string, error) {
         }
 
         lines = append(lines, line)
+        nums = append(nums, n)
     }
 
     if err := scanner.Err(); err != nil {
-        return nil, err
+        return nil, nil, err
     }
 
-    return lines, nil
+    return lines, nums, nil
 }
 
 func (c *cfg) fromDisk() (warning, error) {
     // defaults
     lh4, lh6, proxy, rh4, rh6, wUdp, wTcp, rrDir, cUpd, dDom, sLog, cLog, debug := defaultConfig()
-
-    lines, err := readFile(c.config)
+    caseRand, bailiwick := PROXY_0X20, PROXY_BAILIWICK
+    rlQps, rlBurst, rlRrl, rlSlip := RATELIMIT_QPS, 0, RATELIMIT_RRL, RATELIMIT_SLIP
+    rlPrefix4, rlPrefix6, rlUdpSize, rlLog := RATELIMIT_PREFIX4, RATELIMIT_PREFIX6, RATELIMIT_UDP_SIZE, RATELIMIT_LOG
+    rlExempt := make([]netip.Prefix, 0)
+    inflight := WORKER_INFLIGHT
+    aclQuery, aclRecursion, aclAction := make([]netip.Prefix, 0), make([]netip.Prefix, 0), ACL_REFUSE
+    viewClients, viewRR := make(map[string][]netip.Prefix), make(map[string]string)
+    viewDialer4, viewDialer6 := make(map[string][]host), make(map[string][]host)
+    dns64Prefix, dns64Exclude4, dns64Clients := netip.Prefix{}, make([]netip.Prefix, 0), make([]netip.Prefix, 0)
+    dns64Exclude6 := []netip.Prefix{netip.MustParsePrefix(DNS64_EXCLUDE6)}
+    rewriteRules, safeSearch := make([]*RewriteRule, 0), make([]string, 0)
+    tlsCA, tlsPin, tlsIdle := "", make(map[string][]string), TLS_IDLE
+    httpsGet, httpsTimeout := false, HTTPS_TIMEOUT
+    lTls, tlsCert, tlsKey := make([]host, 0), "", ""
+    lHttps, lHttp, httpsTrusted, httpsJSON := make([]host, 0), make([]host, 0), make([]netip.Prefix, 0), false
+    metricsListen := ""
+    adminListen, adminToken, adminRR := "", "", ""
+    updateZones, updateKeys, updateJournal := make([]string, 0), make(map[string][]byte), ""
+    dhcpLeases, dhcpDomain, dhcpConflict := make(map[string]string), "", DHCP_STATIC
+    hostsFiles := make([]string, 0)
+    rrConflict, rrPriority := RR_CONFLICT_PRIORITY, make(map[string]int)
+    ctlSocket := CONTROL_SOCKET
+    qLog, qlAnon, qlPrefix4, qlPrefix6 := "", false, QUERYLOG_PREFIX4, QUERYLOG_PREFIX6
+    logLevel, logLevels := -1, make(map[string]int)
+    uLog, wLog, bLog := "", "", ""
+    lrSize, lrAge, lrKeep, lrCompress := int64(0), 0, LOG_ROTATE_KEEP, false
+
+    lines, nums, err := readFile(c.config)
     if err != nil {
         panic(err)
     }
 
     warnings := make([]string, 0)
+    errs := make([]error, 0)
     pd := false
-    for _, line := range lines {
-        line = space.ReplaceAllString(line, "")
+    for i, line := range lines {
+        // all bad lines are reported
+        err := func() (err error) {
+            // some values panic when parsed
+            defer func() {
+                if r := recover(); r != nil {
+                    err = fmt.Errorf("%v", r)
+                }
+            }()
 
-        cs := strings.Split(line, "=")
-        if len(cs) != 2 {
-            return nil, errors.New("Invalid config: " + line)
-        }
+            line = space.ReplaceAllString(line, "")
+
+            cs := strings.SplitN(line, "=", 2)
+            if len(cs) != 2 {
+                return errors.New("Invalid config: " + line)
+            }
 
-        switch cs[0] {
-        case "listener.v4", "listener.v6", "proxy.dialer.v4", "proxy.dialer.v6":
-            // no want no spaces here
-            s := space.ReplaceAllString(cs[1], "")
+            switch cs[0] {
+            case "listener.v4", "listener.v6", "proxy.dialer.v4", "proxy.dialer.v6":
+                // no want no spaces here
+                s := space.ReplaceAllString(cs[1], "")
+
+                // v4, v6 hosts
+                var hosts []host
+                for _, h := range strings.Split(s, ",") {
+                    switch cs[0] {
+                    case "listener.v4":
+                        v4, err := NewHost4(h)
+                        if err != nil {
+                            panic(err)
+                        }
+
+                        hosts = append(hosts, v4)
+                    case "listener.v6":
+                        v6, err := NewHost6(h)
+                        if err != nil {
+                            panic(err)
+                        }
+
+                        hosts = append(hosts, v6)
+                    case "proxy.dialer.v4":
+                        v4, err := NewDialerHost(h, IPv4)
+                        if err != nil {
+                            return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                        }
+
+                        hosts = append(hosts, v4)
+                    case "proxy.dialer.v6":
+                        v6, err := NewDialerHost(h, IPv6)
+                        if err != nil {
+                            return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                        }
+
+                        hosts = append(hosts, v6)
+                    }
+                }
 
-            // v4, v6 hosts
-            var hosts []host
-            for _, h := range strings.Split(s, ",") {
+                // update config
                 switch cs[0] {
-                case "listener.v4", "proxy.dialer.v4":
-                    v4, err := NewHost4(h)
+                    case "listener.v4":     lh4 = hosts
+                    case "listener.v6":     lh6 = hosts
+                    case "proxy.dialer.v4": rh4 = hosts
+                    case "proxy.dialer.v6": rh6 = hosts
+                }
+
+            case "listener.tls":
+                for _, h := range strings.Split(cs[1], ",") {
+                    l, err := NewListenerTLS(h)
                     if err != nil {
-                        panic(err)
+                        return fmt.Errorf("'listener.tls' %s", err.Error())
                     }
 
-                    hosts = append(hosts, v4)
-                case "listener.v6", "proxy.dialer.v6":
-                    v6, err := NewHost6(h)
+                    lTls = append(lTls, l)
+                }
+
+            case "listener.https", "listener.http":
+                for _, h := range strings.Split(cs[1], ",") {
+                    l, err := NewListenerHTTPS(h, cs[0] == "listener.https")
                     if err != nil {
-                        panic(err)
+                        return fmt.Errorf("'%s' %s", cs[0], err.Error())
                     }
 
-                    hosts = append(hosts, v6)
+                    if cs[0] == "listener.https" {
+                        lHttps = append(lHttps, l)
+                    } else {
+                        lHttp = append(lHttp, l)
+                    }
                 }
-            }
 
-            // update config
-            switch cs[0] {
-                case "listener.v4":     lh4 = hosts
-                case "listener.v6":     lh6 = hosts
-                case "proxy.dialer.v4": rh4 = hosts
-                case "proxy.dialer.v6": rh6 = hosts
-            }
+            case "listener.https.trusted":
+                p, err := parsePrefixes(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'listener.https.trusted' %s", err.Error())
+                }
 
-        case "proxy":
-            if err := onOff(cs[1]); err != nil {
-                return nil, fmt.Errorf("'proxy' %s", err.Error())
-            }
-            if cs[1] == "off" {
-                proxy = false 
-            }
+                httpsTrusted = p
 
-        case "worker.udp":
-            i, err := strconv.Atoi(cs[1])
-            if err != nil {
-                return nil, err
-            }
+            case "listener.https.json":
+                if err := onOff(cs[1]); err != nil {
+                    return fmt.Errorf("'listener.https.json' %s", err.Error())
+                }
+                httpsJSON = cs[1] == "on"
 
-            if i > WORKER_MAX {
-                return nil, fmt.Errorf("'worker.udp' over limit: %d (max: %d)", i, WORKER_MAX)
-            }
+            case "metrics.listen":
+                if _, _, err := net.SplitHostPort(cs[1]); err != nil {
+                    return fmt.Errorf("'metrics.listen' %s", err.Error())
+                }
+                metricsListen = cs[1]
 
-            wUdp = i
+            case "control.socket":
+                if cs[1] != CONTROL_OFF && !filepath.IsAbs(cs[1]) {
+                    return fmt.Errorf("'control.socket' must be absolute path or %s: %s", CONTROL_OFF, cs[1])
+                }
+                ctlSocket = cs[1]
 
-        case "worker.tcp":
-            i, err := strconv.Atoi(cs[1])
-            if err != nil {
-                return nil, err
-            }
+            case "admin.listen":
+                if _, _, err := net.SplitHostPort(cs[1]); err != nil {
+                    return fmt.Errorf("'admin.listen' %s", err.Error())
+                }
+                adminListen = cs[1]
 
-            if i > WORKER_MAX {
-                return nil, fmt.Errorf("'worker.tcp' over limit: %d (max: %d)", i, WORKER_MAX)
-            }
+            case "admin.token":
+                adminToken = cs[1]
 
-            wTcp = i
+            case "admin.rr":
+                if !filepath.IsAbs(cs[1]) {
+                    return fmt.Errorf("'admin.rr' must be absolute path: %s", cs[1])
+                }
+                adminRR = cs[1]
 
-        case "rr.dir":
-            rrDir = cs[1]
+            case "update.zones":
+                for _, z := range strings.Split(cs[1], ",") {
+                    z = strings.ToLower(enddot.ReplaceAllString(z, ""))
+                    if z == "" {
+                        continue
+                    }
+                    if !rHost.MatchString(z) {
+                        return fmt.Errorf("'update.zones' invalid zone: %s", z)
+                    }
 
-        case "cache.update":
-            switch cs[1] {
-            case SERVER_RELOAD:
-            case FILE_CHANGE:
-            default:
-                return nil, fmt.Errorf("cache.update unknown value: " + cs[1])
-            }
-            cUpd = cs[1]
+                    updateZones = append(updateZones, z)
+                }
 
-        case "default.domain":
-            // default domain limited
-            // to 256 chars
-            if len(cs[1]) > 256 {
-                return nil, errors.New("default.domain definition too long")
-            }
-            dDom = cs[1]
+            case "update.key":
+                // name:base64secret, hmac-sha256
+                for _, k := range strings.Split(cs[1], ",") {
+                    if k == "" {
+                        continue
+                    }
 
-        // location check is bit further down
-        case "server.log":
-            sLog = cs[1]
+                    n, sec, ok := strings.Cut(k, ":")
+                    n = strings.ToLower(enddot.ReplaceAllString(n, ""))
+                    if !ok || n == "" {
+                        return fmt.Errorf("'update.key' must be name:secret: %s", k)
+                    }
 
-        case "cache.log":
-            cLog = cs[1]
+                    b, err := base64.StdEncoding.DecodeString(sec)
+                    if err != nil || len(b) == 0 {
+                        return fmt.Errorf("'update.key' invalid base64 secret: %s", n)
+                    }
 
-        case "debug":
-            if err := onOff(cs[1]); err != nil {
-                return nil, fmt.Errorf("'debug' %s", err.Error()) 
-            }
+                    updateKeys[n] = b
+                }
+
+            case "dhcp.leases":
+                // format:path
+                for _, lf := range strings.Split(cs[1], ",") {
+                    if lf == "" {
+                        continue
+                    }
 
-            if cs[1] == "on" {
-                debug = true
+                    f, p, _ := strings.Cut(lf, ":")
+                    switch f {
+                    case DHCP_ISC, DHCP_KEA, DHCP_DNSMASQ:
+                    default:
+                        return fmt.Errorf("'dhcp.leases' unknown format (%s, %s, %s): %s", DHCP_ISC, DHCP_KEA, DHCP_DNSMASQ, lf)
+                    }
+
+                    if !filepath.IsAbs(p) {
+                        return fmt.Errorf("'dhcp.leases' must be absolute path: %s", lf)
+                    }
+
+                    dhcpLeases[p] = f
+                }
+
+            case "dhcp.domain":
+                d := strings.ToLower(enddot.ReplaceAllString(cs[1], ""))
+                if !rHost.MatchString(d) {
+                    return fmt.Errorf("'dhcp.domain' invalid domain: %s", cs[1])
+                }
+                dhcpDomain = d
+
+            case "dhcp.conflict":
+                switch cs[1] {
+                case DHCP_STATIC, DHCP_LEASE:
+                    dhcpConflict = cs[1]
+                default:
+                    return fmt.Errorf("'dhcp.conflict' must be %s or %s: %s", DHCP_STATIC, DHCP_LEASE, cs[1])
+                }
+
+            case "update.journal":
+                if !filepath.IsAbs(cs[1]) {
+                    return fmt.Errorf("'update.journal' must be absolute path: %s", cs[1])
+                }
+                updateJournal = cs[1]
+
+            case "listener.tls.cert":
+                tlsCert = cs[1]
+
+            case "listener.tls.key":
+                tlsKey = cs[1]
+
+            case "proxy":
+                if err := onOff(cs[1]); err != nil {
+                    return fmt.Errorf("'proxy' %s", err.Error())
+                }
+                if cs[1] == "off" {
+                    proxy = false 
+                }
+
+            case "proxy.0x20":
+                if err := onOff(cs[1]); err != nil {
+                    return fmt.Errorf("'proxy.0x20' %s", err.Error())
+                }
+                caseRand = cs[1] == "on"
+
+            case "proxy.bailiwick":
+                if err := onOff(cs[1]); err != nil {
+                    return fmt.Errorf("'proxy.bailiwick' %s", err.Error())
+                }
+                bailiwick = cs[1] == "on"
+
+            case "worker.udp":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return err
+                }
+
+                if i > WORKER_MAX {
+                    return fmt.Errorf("'worker.udp' over limit: %d (max: %d)", i, WORKER_MAX)
+                }
+
+                wUdp = i
+
+            case "worker.tcp":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return err
+                }
+
+                if i > WORKER_MAX {
+                    return fmt.Errorf("'worker.tcp' over limit: %d (max: %d)", i, WORKER_MAX)
+                }
+
+                wTcp = i
+
+            case "worker.inflight":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return err
+                }
+                if i < 1 {
+                    return fmt.Errorf("'worker.inflight' must be positive: %d", i)
+                }
+
+                inflight = i
+
+            case "ratelimit.qps", "ratelimit.burst", "ratelimit.rrl", "ratelimit.slip", "ratelimit.udp.size", "ratelimit.log":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                }
+                if i < 0 {
+                    return fmt.Errorf("'%s' must not be negative: %d", cs[0], i)
+                }
+
+                switch cs[0] {
+                case "ratelimit.qps":       rlQps = i
+                case "ratelimit.burst":     rlBurst = i
+                case "ratelimit.rrl":       rlRrl = i
+                case "ratelimit.slip":      rlSlip = i
+                case "ratelimit.udp.size":  rlUdpSize = i
+                case "ratelimit.log":       rlLog = i
+                }
+
+            case "ratelimit.prefix.v4", "ratelimit.prefix.v6":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                }
+
+                bits := 32
+                if cs[0] == "ratelimit.prefix.v6" {
+                    bits = 128
+                }
+                if i < 0 || i > bits {
+                    return fmt.Errorf("'%s' out of range: %d (max: %d)", cs[0], i, bits)
+                }
+
+                if cs[0] == "ratelimit.prefix.v4" {
+                    rlPrefix4 = i
+                } else {
+                    rlPrefix6 = i
+                }
+
+            case "ratelimit.exempt":
+                p, err := parsePrefixes(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'ratelimit.exempt' %s", err.Error())
+                }
+
+                rlExempt = p
+
+            case "proxy.tls.ca":
+                if _, err := os.Stat(cs[1]); err != nil {
+                    return fmt.Errorf("'proxy.tls.ca' %s", err.Error())
+                }
+                tlsCA = cs[1]
+
+            case "proxy.tls.pin":
+                // server.name:base64(sha256(spki))[, ...]
+                for _, p := range strings.Split(cs[1], ",") {
+                    np := strings.SplitN(p, ":", 2)
+                    if len(np) != 2 || np[0] == "" || np[1] == "" {
+                        return fmt.Errorf("'proxy.tls.pin' invalid pin: %s", p)
+                    }
+
+                    if b, err := base64.StdEncoding.DecodeString(np[1]); err != nil || len(b) != sha256.Size {
+                        return fmt.Errorf("'proxy.tls.pin' invalid sha256 (base64): %s", np[1])
+                    }
+
+                    tlsPin[np[0]] = append(tlsPin[np[0]], np[1])
+                }
+
+            case "proxy.tls.idle":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'proxy.tls.idle' %s", err.Error())
+                }
+                if i < 1 {
+                    return fmt.Errorf("'proxy.tls.idle' must be positive: %d", i)
+                }
+                tlsIdle = i
+
+            case "proxy.https.method":
+                switch cs[1] {
+                case "post": httpsGet = false
+                case "get":  httpsGet = true
+                default:
+                    return fmt.Errorf("'proxy.https.method' unknown value: %s (accepts: post/get)", cs[1])
+                }
+
+            case "proxy.https.timeout":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'proxy.https.timeout' %s", err.Error())
+                }
+                if i < 1 {
+                    return fmt.Errorf("'proxy.https.timeout' must be positive: %d", i)
+                }
+                httpsTimeout = i
+
+            case "acl.query", "acl.recursion":
+                p, err := parsePrefixes(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                }
+
+                if cs[0] == "acl.query" {
+                    aclQuery = p
+                } else {
+                    aclRecursion = p
+                }
+
+            case "view.clients":
+                // name:cidr
+                for _, vc := range strings.Split(cs[1], ",") {
+                    if vc == "" {
+                        continue
+                    }
+
+                    n, c, _ := strings.Cut(vc, ":")
+                    if !rView.MatchString(n) {
+                        return fmt.Errorf("'view.clients' must be name:cidr: %s", vc)
+                    }
+
+                    p, err := parsePrefixes(c)
+                    if err != nil || len(p) == 0 {
+                        return fmt.Errorf("'view.clients' invalid cidr: %s", vc)
+                    }
+
+                    for v, pp := range viewClients {
+                        for _, o := range pp {
+                            if o == p[0] && v != n {
+                                return fmt.Errorf("'view.clients' %s in views %s and %s", o, v, n)
+                            }
+                        }
+                    }
+
+                    viewClients[n] = append(viewClients[n], p[0])
+                }
+
+            case "view.rr":
+                // name:dir
+                for _, vr := range strings.Split(cs[1], ",") {
+                    if vr == "" {
+                        continue
+                    }
+
+                    n, d, _ := strings.Cut(vr, ":")
+                    if !rView.MatchString(n) {
+                        return fmt.Errorf("'view.rr' must be name:dir: %s", vr)
+                    }
+                    if !filepath.IsAbs(d) {
+                        return fmt.Errorf("'view.rr' must be absolute path: %s", vr)
+                    }
+
+                    viewRR[n] = filepath.Clean(d)
+                }
+
+            case "view.dialer.v4", "view.dialer.v6":
+                // name:dialer
+                for _, vd := range strings.Split(cs[1], ",") {
+                    if vd == "" {
+                        continue
+                    }
+
+                    n, d, _ := strings.Cut(vd, ":")
+                    if !rView.MatchString(n) {
+                        return fmt.Errorf("'%s' must be name:dialer: %s", cs[0], vd)
+                    }
+
+                    if cs[0] == "view.dialer.v4" {
+                        h, err := NewDialerHost(d, IPv4)
+                        if err != nil {
+                            return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                        }
+                        viewDialer4[n] = append(viewDialer4[n], h)
+                    } else {
+                        h, err := NewDialerHost(d, IPv6)
+                        if err != nil {
+                            return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                        }
+                        viewDialer6[n] = append(viewDialer6[n], h)
+                    }
+                }
+
+            case "dns64.prefix":
+                // RFC 6052 2.2, u octet (bits 64-71) zero
+                p, err := netip.ParsePrefix(cs[1])
+                if err != nil || !p.Addr().Is6() || p.Addr().Is4In6() {
+                    return fmt.Errorf("'dns64.prefix' must be IPv6 prefix: %s", cs[1])
+                }
+
+                switch p.Bits() {
+                case 32, 40, 48, 56, 64, 96:
+                default:
+                    return fmt.Errorf("'dns64.prefix' length must be 32, 40, 48, 56, 64 or 96: %s", cs[1])
+                }
+
+                if p.Addr().As16()[8] != 0 {
+                    return fmt.Errorf("'dns64.prefix' bits 64-71 must be zero: %s", cs[1])
+                }
+                dns64Prefix = p.Masked()
+
+            case "dns64.exclude.v4", "dns64.exclude.v6", "dns64.clients":
+                p, err := parsePrefixes(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                }
+
+                switch cs[0] {
+                case "dns64.exclude.v4": dns64Exclude4 = p
+                case "dns64.exclude.v6": dns64Exclude6 = p
+                case "dns64.clients":    dns64Clients = p
+                }
+
+            case "rewrite":
+                // one rule per line
+                r, err := NewRewriteRule(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'rewrite' %s", err.Error())
+                }
+                rewriteRules = append(rewriteRules, r)
+
+            case "safesearch":
+                for _, p := range strings.Split(cs[1], ",") {
+                    if p == "" {
+                        continue
+                    }
+
+                    if _, err := SafeSearchRules(p); err != nil {
+                        return fmt.Errorf("'safesearch' %s", err.Error())
+                    }
+                    safeSearch = append(safeSearch, p)
+                }
+
+            case "acl.action":
+                switch cs[1] {
+                case ACL_REFUSE, ACL_DROP:
+                default:
+                    return fmt.Errorf("'acl.action' unknown value: %s (accepts: %s/%s)", cs[1], ACL_REFUSE, ACL_DROP)
+                }
+                aclAction = cs[1]
+
+            case "rr.dir":
+                rrDir = cs[1]
+
+            case "hosts.files":
+                for _, f := range strings.Split(cs[1], ",") {
+                    if f == "" {
+                        continue
+                    }
+                    if !filepath.IsAbs(f) {
+                        return fmt.Errorf("'hosts.files' must be absolute path: %s", f)
+                    }
+
+                    hostsFiles = append(hostsFiles, f)
+                }
+
+            case "rr.conflict":
+                switch cs[1] {
+                case RR_CONFLICT_MERGE, RR_CONFLICT_FIRST, RR_CONFLICT_PRIORITY, RR_CONFLICT_ERROR:
+                    rrConflict = cs[1]
+                default:
+                    return fmt.Errorf("'rr.conflict' must be %s, %s, %s or %s: %s", RR_CONFLICT_MERGE, RR_CONFLICT_FIRST, RR_CONFLICT_PRIORITY, RR_CONFLICT_ERROR, cs[1])
+                }
+
+            case "rr.priority":
+                // path:priority, path is file or dir
+                for _, fp := range strings.Split(cs[1], ",") {
+                    if fp == "" {
+                        continue
+                    }
+
+                    i := strings.LastIndex(fp, ":")
+                    if i < 0 {
+                        return fmt.Errorf("'rr.priority' must be path:priority: %s", fp)
+                    }
+
+                    f := filepath.Clean(fp[:i])
+                    if !filepath.IsAbs(f) {
+                        return fmt.Errorf("'rr.priority' must be absolute path: %s", fp)
+                    }
+
+                    n, err := strconv.Atoi(fp[i+1:])
+                    if err != nil {
+                        return fmt.Errorf("'rr.priority' invalid priority: %s", fp)
+                    }
+
+                    rrPriority[f] = n
+                }
+
+            case "cache.update":
+                switch cs[1] {
+                case SERVER_RELOAD:
+                case FILE_CHANGE:
+                default:
+                    return fmt.Errorf("cache.update unknown value: " + cs[1])
+                }
+                cUpd = cs[1]
+
+            case "default.domain":
+                // default domain limited
+                // to 256 chars
+                if len(cs[1]) > 256 {
+                    return errors.New("default.domain definition too long")
+                }
+                dDom = cs[1]
+
+            // location check is bit further down
+            case "server.log":
+                sLog = cs[1]
+
+            case "cache.log":
+                cLog = cs[1]
+
+            case "log.rotate.size":
+                i, err := parseSize(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'log.rotate.size' %s", err.Error())
+                }
+                lrSize = i
+
+            case "log.rotate.age", "log.rotate.keep":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                }
+                if i < 0 {
+                    return fmt.Errorf("'%s' must not be negative: %d", cs[0], i)
+                }
+
+                if cs[0] == "log.rotate.age" {
+                    lrAge = i
+                } else {
+                    lrKeep = i
+                }
+
+            case "log.rotate.compress":
+                if err := onOff(cs[1]); err != nil {
+                    return fmt.Errorf("'log.rotate.compress' %s", err.Error())
+                }
+                lrCompress = cs[1] == "on"
+
+            case "upstream.log":
+                uLog = cs[1]
+
+            case "worker.log":
+                wLog = cs[1]
+
+            case "blocklist.log":
+                bLog = cs[1]
+
+            case "log.level":
+                l, err := LogLevel(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'log.level' %s", err.Error())
+                }
+                logLevel = l
+
+            case "log.level.server", "log.level.cache", "log.level.upstream", "log.level.worker", "log.level.blocklist":
+                l, err := LogLevel(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                }
+                logLevels[strings.TrimPrefix(cs[0], "log.level.")] = l
+
+            case "query.log":
+                qLog = cs[1]
+
+            case "query.log.anonymize":
+                if err := onOff(cs[1]); err != nil {
+                    return fmt.Errorf("'query.log.anonymize' %s", err.Error())
+                }
+                qlAnon = cs[1] == "on"
+
+            case "query.log.anonymize.prefix.v4", "query.log.anonymize.prefix.v6":
+                i, err := strconv.Atoi(cs[1])
+                if err != nil {
+                    return fmt.Errorf("'%s' %s", cs[0], err.Error())
+                }
+
+                bits := 32
+                if cs[0] == "query.log.anonymize.prefix.v6" {
+                    bits = 128
+                }
+                if i < 0 || i > bits {
+                    return fmt.Errorf("'%s' out of range: %d (max: %d)", cs[0], i, bits)
+                }
+
+                if cs[0] == "query.log.anonymize.prefix.v4" {
+                    qlPrefix4 = i
+                } else {
+                    qlPrefix6 = i
+                }
+
+            case "debug":
+                if err := onOff(cs[1]); err != nil {
+                    return fmt.Errorf("'debug' %s", err.Error()) 
+                }
+
+                if cs[1] == "on" {
+                    debug = true
+                }
+
+            default:
+                return errors.New("Unknown config option: " + line)
             }
 
-        default:
-            return nil, errors.New("Unknown config option: " + line)
+            return nil
+        }()
+
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s:%d: %s", c.config, nums[i], err.Error()))
         }
     }
 
+    if len(errs) > 0 {
+        return warnings, errors.Join(errs...)
+    }
+
     // make sure rr.dir exists and world readable
     rrstat := newFstat(rrDir)
     if !rrstat.exists() {
@@ -366,28 +1258,88 @@ func (c *cfg) fromDisk() (warning, error) {
         panic("Permission denied, needs o+r: " + rrstat.path)
     }
 
-    // make sure we can log
-    for _, d := range []string{filepath.Dir(sLog), filepath.Dir(cLog)} {
-        _, err := os.Stat(d)
-        if err != nil {
-            if os.IsNotExist(err) {
-                // does not exist
-                // is fine
-                if e := os.MkdirAll(d, os.ModePerm); e != nil {
-                    // could not create destination dir
-                    // is not fine
-                    return nil, e
-                }
-
-                // success creating
-                // log destination dir
-                continue
+    // views are defined by their clients, records
+    // of view dir must not be loaded by rr.dir too
+    for _, v := range []struct{ opt string; names []string }{
+        {"view.rr", mapKeys(viewRR)},
+        {"view.dialer.v4", mapKeys(viewDialer4)},
+        {"view.dialer.v6", mapKeys(viewDialer6)},
+    } {
+        for _, n := range v.names {
+            if _, ok := viewClients[n]; !ok {
+                return warnings, fmt.Errorf("'%s' unknown view (no view.clients): %s", v.opt, n)
             }
+        }
+    }
 
-            // other err than not-exist
-            // is not fine
-            return nil, err
+    for n, d := range viewRR {
+        vstat := newFstat(d)
+        if !vstat.exists() {
+            return warnings, fmt.Errorf("'view.rr' %s: %s", n, vstat.err.Error())
         }
+        if !vstat.worldReadable() {
+            return warnings, fmt.Errorf("'view.rr' %s: Permission denied, needs o+r: %s", n, vstat.path)
+        }
+
+        rd := filepath.Clean(rrDir)
+        if d == rd || strings.HasPrefix(d, rd + "/") || strings.HasPrefix(rd, d + "/") {
+            return warnings, fmt.Errorf("'view.rr' %s: must not overlap rr.dir: %s", n, d)
+        }
+    }
+
+    // make sure we can log
+    // subsystem logs go to server log
+    // unless configured otherwise
+    for _, l := range []*string{&uLog, &wLog, &bLog} {
+        if *l == "" {
+            *l = sLog
+        }
+    }
+
+    // debug is the same as log.level = debug
+    // log.level wins when both configured
+    if logLevel == -1 {
+        logLevel = LOG_INFO
+        if debug {
+            logLevel = LOG_DEBUG
+        }
+    }
+
+    // log dirs are created on opening the logs
+    for _, l := range []string{sLog, cLog, uLog, wLog, bLog} {
+        if strings.HasPrefix(l, LOG_SYSLOG) {
+            if _, err := SyslogFacility(strings.TrimPrefix(l, LOG_SYSLOG)); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    if qLog != "" && isRecordSink(qLog) {
+        return nil, errors.New("'query.log' must be a file or stdout")
+    }
+
+    if len(lTls) > 0 && (tlsCert == "" || tlsKey == "") {
+        return nil, errors.New("'listener.tls' requires 'listener.tls.cert' and 'listener.tls.key'")
+    }
+
+    if len(lHttps) > 0 && (tlsCert == "" || tlsKey == "") {
+        return nil, errors.New("'listener.https' requires 'listener.tls.cert' and 'listener.tls.key'")
+    }
+
+    if adminListen != "" && len(adminToken) < ADMIN_TOKEN_MIN {
+        return nil, fmt.Errorf("'admin.listen' requires 'admin.token' (min %d chars)", ADMIN_TOKEN_MIN)
+    }
+
+    if len(updateZones) > 0 && len(updateKeys) == 0 {
+        return nil, errors.New("'update.zones' requires 'update.key'")
+    }
+
+    if len(updateZones) == 0 && (len(updateKeys) > 0 || updateJournal != "") {
+        warnings = append(warnings, "'update.zones' not defined and 'update.key'/'update.journal' defined (will be ignored)")
+    }
+
+    if adminListen == "" && adminRR != "" {
+        warnings = append(warnings, "'admin.listen' not defined and 'admin.rr' defined (will be ignored)")
     }
 
     if !proxy && pd {
@@ -402,12 +1354,76 @@ func (c *cfg) fromDisk() (warning, error) {
     c.workerUDP = wUdp
     c.workerTCP = wTcp
     c.rrDir = rrDir
+    c.hostsFiles = hostsFiles
+    c.rrConflict = rrConflict
+    c.rrPriority = rrPriority
     c.cacheUpdate = cUpd
     c.defaultDomain = dDom
     c.serverLog = sLog
     c.cacheLog = cLog
     c.debug = debug
+    c.logLevel = logLevel
+    c.logLevels = logLevels
+    c.upstreamLog = uLog
+    c.workerLog = wLog
+    c.blocklistLog = bLog
     c.proxy = proxy
+    c.caseRand = caseRand
+    c.bailiwick = bailiwick
+    c.rlQps = rlQps
+    c.rlBurst = rlBurst
+    c.rlRrl = rlRrl
+    c.rlSlip = rlSlip
+    c.rlPrefix4 = rlPrefix4
+    c.rlPrefix6 = rlPrefix6
+    c.rlUdpSize = rlUdpSize
+    c.rlExempt = rlExempt
+    c.rlLog = rlLog
+    c.workerInflight = inflight
+    c.aclQuery = aclQuery
+    c.viewClients = viewClients
+    c.viewRR = viewRR
+    c.viewDialer4 = viewDialer4
+    c.viewDialer6 = viewDialer6
+    c.dns64Prefix = dns64Prefix
+    c.dns64Exclude4 = dns64Exclude4
+    c.dns64Exclude6 = dns64Exclude6
+    c.dns64Clients = dns64Clients
+    c.rewriteRules = rewriteRules
+    c.safeSearch = safeSearch
+    c.aclRecursion = aclRecursion
+    c.aclAction = aclAction
+    c.tlsCA = tlsCA
+    c.tlsPin = tlsPin
+    c.tlsIdle = tlsIdle
+    c.listenerTLS = lTls
+    c.tlsCert = tlsCert
+    c.tlsKey = tlsKey
+    c.listenerHTTPS = lHttps
+    c.listenerHTTP = lHttp
+    c.httpsTrusted = httpsTrusted
+    c.httpsJSON = httpsJSON
+    c.metricsListen = metricsListen
+    c.controlSocket = ctlSocket
+    c.adminListen = adminListen
+    c.adminToken = adminToken
+    c.adminRR = adminRR
+    c.updateZones = updateZones
+    c.updateKeys = updateKeys
+    c.updateJournal = updateJournal
+    c.dhcpLeases = dhcpLeases
+    c.dhcpDomain = dhcpDomain
+    c.dhcpConflict = dhcpConflict
+    c.queryLog = qLog
+    c.qlAnon = qlAnon
+    c.qlPrefix4 = qlPrefix4
+    c.qlPrefix6 = qlPrefix6
+    c.logRotateSize = lrSize
+    c.logRotateAge = lrAge
+    c.logRotateKeep = lrKeep
+    c.logRotateCompress = lrCompress
+    c.httpsGet = httpsGet
+    c.httpsTimeout = httpsTimeout
 
     if len(warnings) > 0 {
         return warnings, nil
@@ -416,6 +1432,99 @@ func (c *cfg) fromDisk() (warning, error) {
     return nil, nil
 }
 
+// comma separated list of CIDRs
+// plain IPs are taken as single host prefixes
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+    p := make([]netip.Prefix, 0)
+
+    for _, c := range strings.Split(space.ReplaceAllString(s, ""), ",") {
+        if c == "" {
+            continue
+        }
+
+        if !strings.Contains(c, "/") {
+            ip, err := netip.ParseAddr(c)
+            if err != nil {
+                return nil, err
+            }
+
+            p = append(p, netip.PrefixFrom(ip, ip.BitLen()))
+            continue
+        }
+
+        n, err := netip.ParsePrefix(c)
+        if err != nil {
+            return nil, err
+        }
+
+        p = append(p, n.Masked())
+    }
+
+    return p, nil
+}
+
+func prefixString(p []netip.Prefix) string {
+    s := make([]string, len(p))
+    for i, n := range p {
+        s[i] = n.String()
+    }
+
+    return strings.Join(s, ", ")
+}
+
+// info (upstream: debug, worker: warn)
+func logLevelsString(level int, override map[string]int) string {
+    s := LogLevelString(level)
+    if len(override) == 0 {
+        return s
+    }
+
+    o := make([]string, 0, len(override))
+    for _, n := range []string{LOG_SERVER, LOG_CACHE, LOG_UPSTREAM, LOG_WORKER, LOG_BLOCKLIST} {
+        if l, ok := override[n]; ok {
+            o = append(o, n + ": " + LogLevelString(l))
+        }
+    }
+
+    return s + " (" + strings.Join(o, ", ") + ")"
+}
+
+// bytes with optional K, M, G suffix
+func parseSize(s string) (int64, error) {
+    if s == "" {
+        return 0, errors.New("missing value")
+    }
+
+    m := int64(1)
+    switch strings.ToUpper(s[len(s)-1:]) {
+    case "K": m = 1<<10
+    case "M": m = 1<<20
+    case "G": m = 1<<30
+    }
+    if m > 1 {
+        s = s[:len(s)-1]
+    }
+
+    i, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+        return 0, err
+    }
+    if i < 0 {
+        return 0, fmt.Errorf("must not be negative: %d", i)
+    }
+
+    return i*m, nil
+}
+
+func hostStrings(h []host) []string {
+    s := make([]string, len(h))
+    for i, n := range h {
+        s[i] = n.netConnString()
+    }
+
+    return s
+}
+
 func onOff(s string) error {
     var err error
     switch s {
@@ -458,8 +1567,7 @@ func (c *cfg) localNetConnString(net string) []string {
 }
 
 // remote host strings
-// provides random one host from the pool
-// used for connection to upstream (dialer)
+// used for logging upstream config
 func (c *cfg) remoteNetConnString4() []string {
     return c.remoteNetConnString(IPv4)
 }
@@ -474,11 +1582,11 @@ func (c *cfg) remoteNetConnString(net string) []string {
     switch net {
     case IPv4:
         for _, h := range c.dialer4 {
-            s = append(s, h.netConnString())
+            s = append(s, h.String())
         }
     case IPv6:
         for _, h := range c.dialer6 {
-            s = append(s, h.netConnString())
+            s = append(s, h.String())
         }
     default:
         // this should not happen
@@ -488,29 +1596,122 @@ func (c *cfg) remoteNetConnString(net string) []string {
     return s
 }
 
-// single net addr
-// used for dialer connection
-func (c *cfg) remoteNetConnDialer4() string {
-    return c.remoteNetConnDialer(IPv4)
+// AAAA synthesis, nil = off
+func (c *cfg) dns64() *DNS64 {
+    if !c.dns64Prefix.IsValid() {
+        return nil
+    }
+
+    return NewDNS64(c.dns64Prefix, c.dns64Exclude4, c.dns64Exclude6, c.dns64Clients)
+}
+
+// rewrite rules followed by safe search, nil = none
+func (c *cfg) rewrite() *Rewrite {
+    rules := append([]*RewriteRule{}, c.rewriteRules...)
+    for _, p := range c.safeSearch {
+        r, _ := SafeSearchRules(p)
+        rules = append(rules, r...)
+    }
+
+    if len(rules) == 0 {
+        return nil
+    }
+
+    return NewRewrite(rules)
+}
+
+// path:priority, by path
+func (c *cfg) rrPriorityString() []string {
+    s := make([]string, 0, len(c.rrPriority))
+    for p, n := range c.rrPriority {
+        s = append(s, fmt.Sprintf("%s:%d", p, n))
+    }
+
+    sort.Strings(s)
+    return s
+}
+
+// .rr files of rr.dir (and its subdirs)
+// must be world readable otherwise 'nobody' will not
+// be able to stat() the files for changes
+func (c *cfg) rrFiles() ([]string, error) {
+    return c.rrFilesIn(c.rrDir)
 }
 
-func (c *cfg) remoteNetConnDialer6() string {
-    return c.remoteNetConnDialer(IPv6)
+// .rr files of dir (and its subdirs), rr.dir or view.rr
+func (c *cfg) rrFilesIn(dir string) ([]string, error) {
+    rf := make([]string, 0)
+    err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+
+        // admin, update records are loaded separately
+        if fi.IsDir() || !c.rrFile(path) {
+            return nil
+        }
+
+        fs := newFstat(path)
+        if !fs.exists() {
+            // removed meanwhile
+            return nil
+        }
+        if !fs.worldReadable() {
+            return errors.New("Must be world readable: " + fs.path)
+        }
+
+        rf = append(rf, path)
+        return nil
+    })
+
+    return rf, err
 }
 
-func (c *cfg) remoteNetConnDialer(net string) string {
-    rand.Seed(time.Now().UnixMicro())
-    var s string
+// path is .rr file loaded from rr.dir
+func (c *cfg) rrFile(path string) bool {
+    if !rrx.MatchString(path) {
+        return false
+    }
+
+    if c.adminListen != "" && path == c.adminRR {
+        return false
+    }
+
+    return !(len(c.updateZones) > 0 && path == c.updateJournal)
+}
+
+// upstream pool
+// used for connection to upstream (dialer)
+func (c *cfg) upstreams4() ([]Upstream, error) {
+    return c.upstreams(IPv4)
+}
+
+func (c *cfg) upstreams6() ([]Upstream, error) {
+    return c.upstreams(IPv6)
+}
+
+func (c *cfg) upstreams(net string) ([]Upstream, error) {
+    var hosts []host
 
     switch net {
-    case IPv4: s = c.dialer4[rand.Intn(len(c.dialer4))].netConnString()
-    case IPv6: s = c.dialer6[rand.Intn(len(c.dialer6))].netConnString()
+    case IPv4: hosts = c.dialer4
+    case IPv6: hosts = c.dialer6
     default:
         // this should not happen
         panic("Baad net: " + net)
     }
 
-    return s
+    u := make([]Upstream, 0, len(hosts))
+    for _, h := range hosts {
+        up, err := NewUpstream(h, c)
+        if err != nil {
+            return nil, err
+        }
+
+        u = append(u, up)
+    }
+
+    return u, nil
 }
 
 func (c *cfg) isIpv4() bool {
@@ -565,3 +1766,42 @@ func (c *cfg) validNet(net string) bool {
 
     return false
 }
+
+// TLS and HTTPS listeners share the server certificate
+func (c *cfg) needsCerts() bool {
+    return len(c.listenerTLS) > 0 || len(c.listenerHTTPS) > 0
+}
+
+// all logs to f (CLI -stdout)
+func (c *cfg) logsTo(f string) {
+    c.serverLog = f
+    c.cacheLog = f
+    c.upstreamLog = f
+    c.workerLog = f
+    c.blocklistLog = f
+    if c.queryLog != "" {
+        c.queryLog = f
+    }
+}
+
+// log files and sinks in use
+func (c *cfg) logs() []string {
+    l := []string{c.serverLog, c.cacheLog, c.upstreamLog, c.workerLog, c.blocklistLog}
+    if c.queryLog != "" {
+        l = append(l, c.queryLog)
+    }
+
+    return l
+}
+
+// dirs of log files in use
+func (c *cfg) logDirs() []string {
+    d := make([]string, 0)
+    for _, l := range c.logs() {
+        if !isRecordSink(l) && l != STDOUT && l != STDERR {
+            d = append(d, filepath.Dir(l))
+        }
+    }
+
+    return d
+}
@@ -16,6 +16,51 @@ const (
     SERVER_LOG      = "/var/log/dpx/server.log"
     CACHE_LOG       = "/var/log/dpx/cache.log"
     DEBUG           = false
+    PROXY_0X20      = false
+    PROXY_BAILIWICK = false
+
+    // rate limits, 0 = off
+    RATELIMIT_QPS       = 0
+    RATELIMIT_RRL       = 0
+    RATELIMIT_SLIP      = 2
+    RATELIMIT_PREFIX4   = 24
+    RATELIMIT_PREFIX6   = 56
+    RATELIMIT_UDP_SIZE  = 0
+    RATELIMIT_LOG       = 60
+    WORKER_INFLIGHT     = 500
+
+    // upstream tls connection idle timeout (seconds)
+    TLS_IDLE            = 30
+
+    // upstream https request timeout (seconds)
+    HTTPS_TIMEOUT       = 5
+
+    // log subsystems
+    LOG_SERVER          = "server"
+    LOG_CACHE           = "cache"
+    LOG_UPSTREAM        = "upstream"
+    LOG_WORKER          = "worker"
+    LOG_BLOCKLIST       = "blocklist"
+
+    // log outputs other than files
+    LOG_SYSLOG          = "syslog://"
+    LOG_JOURNALD        = "journald"
+    JOURNALD_SOCKET     = "/run/systemd/journal/socket"
+    LOG_IDENT           = "dpx"
+
+    // rotated log files kept
+    LOG_ROTATE_KEEP     = 7
+
+    // failed log rotation retried after (seconds)
+    LOG_ROTATE_RETRY    = 60
+
+    // query log, client ip anonymized to prefix
+    QUERYLOG_PREFIX4    = 24
+    QUERYLOG_PREFIX6    = 48
+
+    // acl, denied clients are refused or dropped
+    ACL_REFUSE          = "refuse"
+    ACL_DROP            = "drop"
 
     SERVER_RELOAD   = "on-server-reload"
     FILE_CHANGE     = "on-rr-file-change"
@@ -32,6 +77,127 @@ const (
 
     // default port
     DNS_PORT = 53
+    DOT_PORT = 853
+
+    // listener (worker) kinds
+    LISTENER_UDP = "udp"
+    LISTENER_TCP = "tcp"
+    LISTENER_TLS = "tls"
+    LISTENER_HTTPS = "https"
+    LISTENER_HTTP = "http"
+
+    // upstream schemes
+    SCHEME_UDP = "udp"
+    SCHEME_TLS = "tls"
+    SCHEME_HTTPS = "https"
+    HTTPS_PORT = 443
+
+    // DoH content type
+    DNS_MESSAGE = "application/dns-message"
+    DNS_JSON = "application/dns-json"
+
+    // query log, answer source
+    QUERY_LOCAL = "local"
+    QUERY_BLOCKED = "blocked"
+    QUERY_UPSTREAM = "upstream"
+    QUERY_DENIED = "denied"
+    QUERY_REFUSED = "refused"
+    QUERY_UPDATE = "update"
+    QUERY_REWRITE = "rewrite"
+
+    // DoH listener
+    HTTP_PORT = 80
+    DOH_PATH = "/dns-query"
+    DOH_JSON_PATH = "/resolve"
+    DOH_MAX_BODY = 1<<16-1
+
+    // control socket (dpxctl), "off" disables
+    CONTROL_SOCKET = "/run/dpx/dpx.sock"
+    CONTROL_OFF = "off"
+    CONTROL_MAX_REQUEST = 1<<12
+
+    // upstream health (control socket)
+    // down after this many consecutive failures
+    UPSTREAM_UP = "up"
+    UPSTREAM_DOWN = "down"
+    UPSTREAM_UNKNOWN = "unknown"
+    UPSTREAM_DOWN_FAILS = 3
+
+    // admin API, records changed there are from
+    ADMIN_MAX_BODY = 1<<20
+    ADMIN_SOURCE = "admin"
+    ADMIN_TOKEN_MIN = 16
+
+    // dynamic update (RFC 2136), TSIG hmac-sha256 only
+    // journal compacted after this many changes
+    UPDATE_SOURCE = "update"
+    UPDATE_JOURNAL_COMPACT = 1000
+    TSIG_ALG = "hmac-sha256"
+    TSIG_BADSIG = 16
+    TSIG_BADKEY = 17
+    TSIG_BADTIME = 18
+
+    // DHCP lease files, formats
+    // lease hostname colliding with other record, static wins or lease
+    DHCP_SOURCE = "dhcp"
+    DHCP_ISC = "isc"
+    DHCP_KEA = "kea"
+    DHCP_DNSMASQ = "dnsmasq"
+    DHCP_STATIC = "static"
+    DHCP_LEASE = "lease"
+
+    // records diff lines logged on reload
+    RELOAD_DIFF_MAX = 100
+
+    // same name and type in more than one file (rr.conflict)
+    RR_CONFLICT_MERGE = "merge"
+    RR_CONFLICT_FIRST = "first"
+    RR_CONFLICT_PRIORITY = "priority"
+    RR_CONFLICT_ERROR = "error"
+
+    // dns64, ttl of synthesized PTR CNAME (max)
+    // excluded ::ffff:0:0/96 (RFC 6147 5.1.4)
+    DNS64_TTL = 600
+    DNS64_EXCLUDE6 = "::ffff:0:0/96"
+
+    // rewrite rules, kind:pattern->action[:value]
+    REWRITE_EXACT = "exact"
+    REWRITE_SUFFIX = "suffix"
+    REWRITE_REGEX = "regex"
+    REWRITE_CNAME = "cname"
+    REWRITE_A = "a"
+    REWRITE_AAAA = "aaaa"
+    REWRITE_NXDOMAIN = "nxdomain"
+    REWRITE_ARROW = "->"
+
+    // safe search profiles (safesearch)
+    SAFESEARCH_GOOGLE = "google"
+    SAFESEARCH_YOUTUBE = "youtube"
+    SAFESEARCH_BING = "bing"
+
+    // RR files watcher (inotify)
+    // milliseconds of no events before reload
+    RR_WATCH_DEBOUNCE = 500
+    RR_WATCH_QUEUE = 256
+    RR_WATCH_BUFFER = 1<<16
+
+    // local TXT record, bytes
+    TXT_MAX = 1024
+
+    // seconds
+    // expired records check interval
+    RR_EXPIRE_CHECK = 1
+
+    // idle connections kept per DoH upstream
+    HTTPS_IDLE_CONNS = 4
+
+    // seconds
+    // stream (tcp, tls) client connection idle timeout
+    STREAM_IDLE = 10
+
+    // seconds
+    // applies to TLS handshake and queries over TLS
+    TLS_TIMEOUT = 3
 
     // seconds
     // applies to dialing to upstream
@@ -44,6 +210,22 @@ const (
     // prep this many connection strings for upsream dialing
     DIALER_PREP_Q_SIZE = 50
 
+    // upstream response read buffer
+    UPSTREAM_PACKET_SIZE = 1<<16
+
+    // random source port range (lower bound) for upstream queries
+    // and attempts at binding to one before letting the OS choose
+    SOURCE_PORT_MIN = 1024
+    SOURCE_PORT_ATTEMPTS = 5
+
+    // rate limit state cleanup interval and idle time (seconds)
+    // max tracked client prefixes/response buckets
+    // clients (by queries) logged each interval
+    RATELIMIT_CLEAN = 10
+    RATELIMIT_IDLE = 60
+    RATELIMIT_MAX_CLIENTS = 100000
+    RATELIMIT_LOG_TOP = 20
+
     // drop user when running
     SERVICE_OWNER = "nobody"
 
@@ -76,21 +258,40 @@ const (
 
     // type
     A       = 1
+    NS      = 2
     CNAME   = 5
     SOA     = 6
     PTR     = 12
     MX      = 15
     TXT     = 16
     AAAA    = 28
+    SRV     = 33
+    OPT     = 41
+    TSIG    = 250
+    TYPE_ANY = 255
 
     // RCODE
+    NOERROR  = 0
     FMTERROR = 1
     SERVFAIL = 2
     NXDOMAIN = 3
+    NOTIMP   = 4
     REFUSED  = 5
+    // dynamic update
+    YXDOMAIN = 6
+    YXRRSET  = 7
+    NXRRSET  = 8
+    NOTAUTH  = 9
+    NOTZONE  = 10
+
+    // opcode
+    OPCODE_UPDATE = 5
 
     // class
     IN      = 1
+    // update, TSIG
+    CLASS_NONE = 254
+    CLASS_ANY  = 255
 
     // arbitrary numbers which should not matter as client would not be localy caching answers
     // if the client does cache then 10s TTL would be good time to be still responsive to changes
@@ -138,6 +339,24 @@ const (
     ARCOUNT = 1
 )
 
+// headers as 16 bit flags
+// used by Msg, see packet.go
+const (
+    FLAG_QR     = 1<<15
+    FLAG_AA     = 1<<10
+    FLAG_TC     = 1<<9
+    FLAG_RD     = 1<<8
+    FLAG_RA     = 1<<7
+    FLAG_AD     = 1<<5
+    FLAG_CD     = 1<<4
+    OPCODE_MASK = 0xf<<11
+    RCODE_MASK  = 0xf
+
+    // label pointers followed
+    // before giving up on the name
+    MAX_POINTERS = 32
+)
+
 // SOA
 const (
     // .com is default
@@ -0,0 +1,305 @@
+package main
+
+import (
+    "io"
+    "os"
+    "net"
+    "time"
+    "bufio"
+    "errors"
+    "sort"
+    "runtime"
+    "strings"
+    "path/filepath"
+    "encoding/json"
+)
+
+//
+// Control socket (dpxctl)
+//
+// Unix socket, one JSON request per connection:
+//   {"command": "flush-cache", "args": ["host.domain"]}
+// answered by one JSON response:
+//   {"data": ...} or {"error": "..."}
+//
+// Created before dropping privileges, owner only (root).
+
+type Control struct {
+    listener *net.UnixListener
+
+    srv *Server
+}
+
+type ctlRequest struct {
+    Command string   `json:"command"`
+    Args    []string `json:"args,omitempty"`
+}
+
+type ctlResponse struct {
+    Data  any    `json:"data,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+type ctlStatus struct {
+    Pid        int    `json:"pid"`
+    Config     string `json:"config"`
+    Start      string `json:"start"`
+    Uptime     int64  `json:"uptime_seconds"`
+    Proxy      bool   `json:"proxy"`
+    Workers    int    `json:"workers"`
+    Records    int    `json:"records"`
+    Answers    int    `json:"answers"`
+    ReloadOk   string `json:"last_reload,omitempty"`
+    ReloadFail string `json:"last_reload_failure,omitempty"`
+    LogLevel   string `json:"log_level"`
+    Goroutines int    `json:"goroutines"`
+}
+
+type ctlAnswer struct {
+    Type string   `json:"type"`
+    Name string   `json:"name"`
+    RR   []string `json:"rr"`
+    Src  []string `json:"src,omitempty"`
+}
+
+type ctlUpstream struct {
+    Name      string  `json:"name"`
+    Health    string  `json:"health"`
+    Requests  uint64  `json:"requests"`
+    Errors    uint64  `json:"errors"`
+    Fails     int     `json:"consecutive_failures"`
+    Latency   float64 `json:"avg_latency_ms"`
+    LastOk    string  `json:"last_success,omitempty"`
+    LastFail  string  `json:"last_failure,omitempty"`
+    LastError string  `json:"last_error,omitempty"`
+}
+
+type ctlWorker struct {
+    Id       int               `json:"id"`
+    Type     string            `json:"type"`
+    Listen   string            `json:"listen"`
+    Inflight int               `json:"inflight"`
+    Queries  uint64            `json:"queries"`
+    Rcodes   map[string]uint64 `json:"rcodes"`
+}
+
+func NewControl(path string, s *Server) (*Control, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return nil, err
+    }
+
+    // stale socket of previous run
+    if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return nil, err
+    }
+
+    l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+    if err != nil {
+        return nil, err
+    }
+
+    // removed on next start, not by 'nobody'
+    l.SetUnlinkOnClose(false)
+
+    if err := os.Chmod(path, 0600); err != nil {
+        l.Close()
+        return nil, err
+    }
+
+    return &Control{l, s}, nil
+}
+
+// blocking
+func (c *Control) Serve() {
+    sInfo.Printf("Control socket listening on: %s", c.listener.Addr().String())
+
+    for {
+        conn, err := c.listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+
+            sCrit.Printf("Control socket accept failed: %s", err.Error())
+            time.Sleep(100 * time.Millisecond)
+            continue
+        }
+
+        go c.serve(conn)
+    }
+}
+
+func (c *Control) Close() {
+    c.listener.Close()
+}
+
+func (c *Control) serve(conn net.Conn) {
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(STREAM_IDLE * time.Second))
+
+    var req ctlRequest
+    var resp ctlResponse
+
+    b, err := bufio.NewReader(io.LimitReader(conn, CONTROL_MAX_REQUEST)).ReadBytes('\n')
+    if err == nil || len(b) > 0 {
+        err = json.Unmarshal(b, &req)
+    }
+
+    if err != nil {
+        resp.Error = "Invalid request: " + err.Error()
+    } else {
+        sInfo.Printf("Control command: %s %s", req.Command, strings.Join(req.Args, " "))
+        resp.Data, err = c.command(req)
+        if err != nil {
+            resp.Error = err.Error()
+        }
+    }
+
+    if err := json.NewEncoder(conn).Encode(resp); err != nil {
+        sWarn.Printf("Control socket write failed: %s", err.Error())
+    }
+}
+
+func (c *Control) command(req ctlRequest) (any, error) {
+    args := func(max int) error {
+        if len(req.Args) > max {
+            return errors.New("Too many arguments for: " + req.Command)
+        }
+
+        return nil
+    }
+
+    switch req.Command {
+    case "status":
+        return c.status(), args(0)
+
+    case "reload-records":
+        if err := args(0); err != nil {
+            return nil, err
+        }
+
+        // not while config is reloaded
+        c.srv.mux.Lock()
+        err := c.srv.reloadRecords()
+        c.srv.mux.Unlock()
+
+        if err != nil {
+            return nil, err
+        }
+
+        return "records reloaded", nil
+
+    case "reload-config":
+        if err := args(0); err != nil {
+            return nil, err
+        }
+
+        if err := c.srv.reload(); err != nil {
+            return nil, err
+        }
+
+        return "config reloaded", nil
+
+    // no upstream answers to flush,
+    // local answers are built again
+    case "flush-cache":
+        if err := args(1); err != nil {
+            return nil, err
+        }
+
+        name := ""
+        if len(req.Args) == 1 {
+            name = strings.TrimSuffix(req.Args[0], ".")
+        }
+
+        n, err := c.srv.cache.Rebuild(name)
+        if err != nil {
+            return nil, err
+        }
+
+        return map[string]int{"rebuilt": n}, nil
+
+    case "dump-cache":
+        if err := args(0); err != nil {
+            return nil, err
+        }
+
+        return c.dump(), nil
+
+    case "upstreams":
+        if err := args(0); err != nil {
+            return nil, err
+        }
+
+        // swapped on config reload
+        c.srv.mux.Lock()
+        names := make([]string, len(c.srv.upstream))
+        for i, u := range c.srv.upstream {
+            names[i] = u.String()
+        }
+        c.srv.mux.Unlock()
+
+        return metrics.Upstreams(names), nil
+
+    case "workers":
+        if err := args(0); err != nil {
+            return nil, err
+        }
+
+        return metrics.Workers(), nil
+    }
+
+    return nil, errors.New("Unknown command: " + req.Command)
+}
+
+func (c *Control) status() ctlStatus {
+    answers := 0
+    for _, a := range c.srv.cache.Answers() {
+        answers += len(a)
+    }
+
+    ok, fail := metrics.LastReload()
+
+    // swapped on config reload
+    c.srv.mux.Lock()
+    defer c.srv.mux.Unlock()
+
+    return ctlStatus{
+        Pid:        os.Getpid(),
+        Config:     c.srv.cfg.config,
+        Start:      metrics.start.Format(time.RFC3339),
+        Uptime:     int64(time.Since(metrics.start).Seconds()),
+        Proxy:      c.srv.cfg.proxy,
+        Workers:    len(c.srv.worker),
+        Records:    len(c.srv.cache.Records()),
+        Answers:    answers,
+        ReloadOk:   timeOrEmpty(ok),
+        ReloadFail: timeOrEmpty(fail),
+        LogLevel:   LogLevelsString(),
+        Goroutines: runtime.NumGoroutine(),
+    }
+}
+
+func (c *Control) dump() []ctlAnswer {
+    ca := make([]ctlAnswer, 0)
+    for t, rrs := range c.srv.cache.Answers() {
+        for name, a := range rrs {
+            rr := make([]string, len(a.rr))
+            for i, r := range a.rr {
+                rr[i] = strings.Join(r, " ")
+            }
+
+            ca = append(ca, ctlAnswer{RequestTypeString(t), name, rr, a.src})
+        }
+    }
+
+    sort.Slice(ca, func(i, j int) bool {
+        if ca[i].Type != ca[j].Type {
+            return ca[i].Type < ca[j].Type
+        }
+
+        return ca[i].Name < ca[j].Name
+    })
+
+    return ca
+}
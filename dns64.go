@@ -0,0 +1,342 @@
+package main
+
+import (
+    "net"
+    "strings"
+    "net/netip"
+)
+
+//
+// DNS64 (RFC 6147), dns64.prefix
+//
+// AAAA query of a name without AAAA records (NOERROR) but with A
+// records gets AAAA of the IPv4 addresses embedded in the prefix
+// (RFC 6052). Names of local records are synthesized from the local
+// A records, the others from A records of the upstream. PTR query of
+// ip6.arpa name in the prefix is answered with CNAME to in-addr.arpa
+// name of the embedded IPv4 and its PTR records.
+//
+// dns64.exclude.v4: A records never synthesized
+// dns64.exclude.v6: AAAA records treated as not there
+// dns64.clients:    clients synthesized for, empty = all
+
+type DNS64 struct {
+    prefix netip.Prefix
+    exclude4 []netip.Prefix
+    exclude6 []netip.Prefix
+    clients []netip.Prefix
+}
+
+func NewDNS64(prefix netip.Prefix, ex4, ex6, clients []netip.Prefix) *DNS64 {
+    return &DNS64{prefix, ex4, ex6, clients}
+}
+
+// off when nil
+func (d *DNS64) On(client net.Addr) bool {
+    return d != nil && aclMatch(d.clients, client)
+}
+
+func (d *DNS64) String() string {
+    s := d.prefix.String()
+    if len(d.exclude4) > 0 {
+        s += ", exclude v4: " + prefixString(d.exclude4)
+    }
+    if len(d.exclude6) > 0 {
+        s += ", exclude v6: " + prefixString(d.exclude6)
+    }
+    if len(d.clients) > 0 {
+        s += ", clients: " + prefixString(d.clients)
+    }
+
+    return s
+}
+
+// IPv4 embedded in the prefix, RFC 6052 2.2
+// bits 64-71 (u octet) are skipped
+func (d *DNS64) embed(ip4 netip.Addr) netip.Addr {
+    b := d.prefix.Addr().As16()
+    v := ip4.As4()
+
+    i := d.prefix.Bits()/8
+    for _, o := range v {
+        if i == 8 {
+            i++
+        }
+
+        b[i] = o
+        i++
+    }
+
+    return netip.AddrFrom16(b)
+}
+
+// IPv4 embedded in address of the prefix
+func (d *DNS64) extract(ip6 netip.Addr) (netip.Addr, bool) {
+    if !d.prefix.Contains(ip6) {
+        return netip.Addr{}, false
+    }
+
+    b := ip6.As16()
+    var v [4]byte
+
+    i := d.prefix.Bits()/8
+    for j := range v {
+        if i == 8 {
+            i++
+        }
+
+        v[j] = b[i]
+        i++
+    }
+
+    return netip.AddrFrom4(v), true
+}
+
+func excluded(list []netip.Prefix, data []byte) bool {
+    ip, ok := netip.AddrFromSlice(data)
+    if !ok {
+        return true
+    }
+
+    for _, p := range list {
+        if p.Contains(ip.Unmap()) || p.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// AAAA response (query) out of A response, CNAMEs kept and
+// A records synthesized, nil when there is no A to synthesize from
+func (d *DNS64) synthesize(query, aresp []byte, local bool) []byte {
+    q, err := ParseMsg(query)
+    if err != nil {
+        return nil
+    }
+
+    m, err := ParseMsg(aresp)
+    if err != nil {
+        return nil
+    }
+
+    // local name without A, or blocked
+    if m.rcode() != NOERROR && !local {
+        return nil
+    }
+
+    s := &Msg{id: q.id, flags: m.flags, question: q.question}
+    n := 0
+    for _, r := range m.answer {
+        switch r.t {
+        case CNAME:
+            s.answer = append(s.answer, r)
+
+        case A:
+            if len(r.data) != 4 || excluded(d.exclude4, r.data) {
+                continue
+            }
+
+            ip6 := d.embed(netip.AddrFrom4([4]byte(r.data)))
+            b := ip6.As16()
+            s.answer = append(s.answer, MsgRR{r.name, AAAA, r.class, r.ttl, b[:]})
+            n++
+        }
+    }
+
+    if n == 0 && !local {
+        return nil
+    }
+
+    // negative answer (SOA)
+    if n == 0 {
+        s.authority = m.authority
+    }
+
+    // edns of the response
+    for _, r := range m.additional {
+        if r.t == OPT {
+            s.additional = append(s.additional, r)
+        }
+    }
+
+    b, err := s.Pack()
+    if err != nil {
+        return nil
+    }
+
+    return b
+}
+
+// AAAA records not excluded, nil when there are none (NOERROR)
+// response without the excluded otherwise
+func (d *DNS64) filter(resp []byte) ([]byte, bool) {
+    m, err := ParseMsg(resp)
+    if err != nil || m.rcode() != NOERROR || m.truncated() {
+        return resp, true
+    }
+
+    keep := make([]MsgRR, 0, len(m.answer))
+    found, drop := false, false
+    for _, r := range m.answer {
+        if r.t == AAAA {
+            if excluded(d.exclude6, r.data) {
+                drop = true
+                continue
+            }
+
+            found = true
+        }
+
+        keep = append(keep, r)
+    }
+
+    if !found {
+        return nil, false
+    }
+
+    if drop {
+        m.answer = keep
+        if b, err := m.Pack(); err == nil {
+            return b, true
+        }
+    }
+
+    return resp, true
+}
+
+// in-addr.arpa name of ip6.arpa name in the prefix
+func (d *DNS64) arpa(name string) (string, bool) {
+    name = strings.ToLower(enddot.ReplaceAllString(name, ""))
+    if !strings.HasSuffix(name, ".ip6.arpa") {
+        return "", false
+    }
+
+    n := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+    if len(n) != 32 {
+        return "", false
+    }
+
+    // reversed nibbles
+    var hex strings.Builder
+    for i := len(n)-1; i >= 0; i-- {
+        if len(n[i]) != 1 {
+            return "", false
+        }
+
+        hex.WriteString(n[i])
+        if i%4 == 0 && i > 0 {
+            hex.WriteString(":")
+        }
+    }
+
+    ip6, err := netip.ParseAddr(hex.String())
+    if err != nil {
+        return "", false
+    }
+
+    ip4, ok := d.extract(ip6)
+    if !ok {
+        return "", false
+    }
+
+    return InAddrArpa(ip4.String()), true
+}
+
+// AAAA of local name, nil when the name has no local A records
+func (r *Resolver) dns64Local(query []byte, cache *Cache, wid int) []byte {
+    q := requery(query, Question(query), A)
+    if q == nil {
+        return nil
+    }
+
+    a := localAnswer(q, cache)
+    if a == nil {
+        return nil
+    }
+
+    s := r.dns64.synthesize(query, a, true)
+    if s != nil {
+        wInfo.Worker(wid).Printf("#%d: DNS64 id: %d, synthesized from local A: %s", wid, bytesToInt(query[:2]), Question(query))
+    }
+
+    return s
+}
+
+// AAAA response of upstream, A asked when it has no AAAA
+func (r *Resolver) dns64Upstream(query, resp []byte, dialer Upstream, wid int) []byte {
+    if f, ok := r.dns64.filter(resp); ok {
+        return f
+    }
+
+    q := requery(query, Question(query), A)
+    if q == nil {
+        return resp
+    }
+
+    a := upstreamAnswer(q, dialer, wid)
+    if a == nil {
+        return resp
+    }
+
+    if s := r.dns64.synthesize(query, a, false); s != nil {
+        wInfo.Worker(wid).Printf("#%d: DNS64 id: %d, synthesized from upstream A: %s", wid, bytesToInt(query[:2]), Question(query))
+        return s
+    }
+
+    return resp
+}
+
+// PTR of ip6.arpa name in the prefix, nil when not one
+// CNAME to in-addr.arpa name and its PTR records
+func (r *Resolver) dns64Ptr(query []byte, view *View, dialer Upstream, upstream bool, wid int) []byte {
+    iaa, ok := r.dns64.arpa(Question(query))
+    if !ok {
+        return nil
+    }
+
+    q := requery(query, iaa, PTR)
+    if q == nil {
+        return nil
+    }
+
+    p := localAnswer(q, view.records(r.cache, iaa))
+    if p == nil && upstream {
+        p = upstreamAnswer(q, dialer, wid)
+    }
+    if p == nil {
+        return nil
+    }
+
+    qm, err := ParseMsg(query)
+    if err != nil {
+        return nil
+    }
+    m, err := ParseMsg(p)
+    if err != nil {
+        return nil
+    }
+
+    target, err := packName(iaa)
+    if err != nil {
+        return nil
+    }
+
+    ttl := uint32(DNS64_TTL)
+    for _, rr := range m.answer {
+        if rr.ttl < ttl {
+            ttl = rr.ttl
+        }
+    }
+
+    m.id, m.question = qm.id, qm.question
+    m.answer = append([]MsgRR{{qm.question[0].name, CNAME, IN, ttl, target}}, m.answer...)
+
+    b, err := m.Pack()
+    if err != nil {
+        return nil
+    }
+
+    wInfo.Worker(wid).Printf("#%d: DNS64 id: %d, PTR %s -> %s", wid, bytesToInt(query[:2]), Question(query), iaa)
+    return b
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "net"
+    "flag"
+    "sort"
+    "time"
+    "bufio"
+    "strings"
+    "encoding/json"
+    "text/tabwriter"
+)
+
+// dpxctl, control of running dpx over its control socket
+//
+// dpxctl [-socket path] [-json] <command> [args]
+
+const (
+    CONTROL_SOCKET = "/run/dpx/dpx.sock"
+    TIMEOUT = 30
+)
+
+var commands = map[string]string{
+    "status":         "server status",
+    "reload-records": "reload RR files",
+    "reload-config":  "reload config (same as SIGHUP)",
+    "flush-cache":    "[name] rebuild local answers from loaded records (all or of name), no upstream answers are cached to flush",
+    "dump-cache":     "local answers",
+    "upstreams":      "upstreams with health",
+    "workers":        "workers with query counts",
+}
+
+// same as dpx control.go
+type ctlRequest struct {
+    Command string   `json:"command"`
+    Args    []string `json:"args,omitempty"`
+}
+
+type ctlResponse struct {
+    Data  json.RawMessage `json:"data,omitempty"`
+    Error string          `json:"error,omitempty"`
+}
+
+type ctlStatus struct {
+    Pid        int    `json:"pid"`
+    Config     string `json:"config"`
+    Start      string `json:"start"`
+    Uptime     int64  `json:"uptime_seconds"`
+    Proxy      bool   `json:"proxy"`
+    Workers    int    `json:"workers"`
+    Records    int    `json:"records"`
+    Answers    int    `json:"answers"`
+    ReloadOk   string `json:"last_reload,omitempty"`
+    ReloadFail string `json:"last_reload_failure,omitempty"`
+    LogLevel   string `json:"log_level"`
+    Goroutines int    `json:"goroutines"`
+}
+
+type ctlAnswer struct {
+    Type string   `json:"type"`
+    Name string   `json:"name"`
+    RR   []string `json:"rr"`
+    Src  []string `json:"src,omitempty"`
+}
+
+type ctlUpstream struct {
+    Name      string  `json:"name"`
+    Health    string  `json:"health"`
+    Requests  uint64  `json:"requests"`
+    Errors    uint64  `json:"errors"`
+    Fails     int     `json:"consecutive_failures"`
+    Latency   float64 `json:"avg_latency_ms"`
+    LastOk    string  `json:"last_success,omitempty"`
+    LastFail  string  `json:"last_failure,omitempty"`
+    LastError string  `json:"last_error,omitempty"`
+}
+
+type ctlWorker struct {
+    Id       int               `json:"id"`
+    Type     string            `json:"type"`
+    Listen   string            `json:"listen"`
+    Inflight int               `json:"inflight"`
+    Queries  uint64            `json:"queries"`
+    Rcodes   map[string]uint64 `json:"rcodes"`
+}
+
+func main() {
+    socket := flag.String("socket", CONTROL_SOCKET, "dpx control socket")
+    js := flag.Bool("json", false, "JSON output")
+    flag.Usage = usage
+    flag.Parse()
+
+    if flag.NArg() < 1 {
+        usage()
+        os.Exit(2)
+    }
+
+    cmd := flag.Arg(0)
+    if _, ok := commands[cmd]; !ok {
+        fmt.Fprintf(os.Stderr, "Unknown command: %s\n", cmd)
+        usage()
+        os.Exit(2)
+    }
+
+    data, err := request(*socket, ctlRequest{cmd, flag.Args()[1:]})
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err.Error())
+        os.Exit(1)
+    }
+
+    if *js {
+        os.Stdout.Write(append(data, '\n'))
+        return
+    }
+
+    if err := human(os.Stdout, cmd, data); err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err.Error())
+        os.Exit(1)
+    }
+}
+
+func usage() {
+    fmt.Fprintf(os.Stderr, "Usage: %s [-socket path] [-json] <command> [args]\n\nCommands:\n", os.Args[0])
+
+    names := make([]string, 0, len(commands))
+    for n := range commands {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+
+    for _, n := range names {
+        fmt.Fprintf(os.Stderr, "  %-16s %s\n", n, commands[n])
+    }
+
+    fmt.Fprintf(os.Stderr, "\nOptions:\n")
+    flag.PrintDefaults()
+}
+
+func request(socket string, req ctlRequest) (json.RawMessage, error) {
+    conn, err := net.DialTimeout("unix", socket, TIMEOUT * time.Second)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(TIMEOUT * time.Second))
+
+    b, err := json.Marshal(req)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := conn.Write(append(b, '\n')); err != nil {
+        return nil, err
+    }
+
+    b, err = bufio.NewReader(conn).ReadBytes('\n')
+    if err != nil && (err != io.EOF || len(b) == 0) {
+        return nil, err
+    }
+
+    var resp ctlResponse
+    if err := json.Unmarshal(b, &resp); err != nil {
+        return nil, fmt.Errorf("Invalid response: %s", err.Error())
+    }
+
+    if resp.Error != "" {
+        return nil, fmt.Errorf("%s", resp.Error)
+    }
+
+    return resp.Data, nil
+}
+
+func human(out io.Writer, cmd string, data json.RawMessage) error {
+    tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+    defer tw.Flush()
+
+    switch cmd {
+    case "status":
+        var s ctlStatus
+        if err := json.Unmarshal(data, &s); err != nil {
+            return err
+        }
+
+        fmt.Fprintf(tw, "pid:\t%d\n", s.Pid)
+        fmt.Fprintf(tw, "config:\t%s\n", s.Config)
+        fmt.Fprintf(tw, "started:\t%s (up %s)\n", s.Start, time.Duration(s.Uptime) * time.Second)
+        fmt.Fprintf(tw, "proxy:\t%v\n", s.Proxy)
+        fmt.Fprintf(tw, "workers:\t%d\n", s.Workers)
+        fmt.Fprintf(tw, "records:\t%d (answers: %d)\n", s.Records, s.Answers)
+        fmt.Fprintf(tw, "last reload:\t%s\n", orNever(s.ReloadOk))
+        fmt.Fprintf(tw, "last failed reload:\t%s\n", orNever(s.ReloadFail))
+        fmt.Fprintf(tw, "log level:\t%s\n", s.LogLevel)
+        fmt.Fprintf(tw, "goroutines:\t%d\n", s.Goroutines)
+
+    case "dump-cache":
+        var ca []ctlAnswer
+        if err := json.Unmarshal(data, &ca); err != nil {
+            return err
+        }
+
+        fmt.Fprintf(tw, "TYPE\tNAME\tRR\tSOURCE\n")
+        for _, a := range ca {
+            fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Type, a.Name, strings.Join(a.RR, ", "), strings.Join(a.Src, ", "))
+        }
+
+    case "upstreams":
+        var cu []ctlUpstream
+        if err := json.Unmarshal(data, &cu); err != nil {
+            return err
+        }
+
+        fmt.Fprintf(tw, "UPSTREAM\tHEALTH\tREQUESTS\tERRORS\tFAILS\tAVG MS\tLAST ERROR\n")
+        for _, u := range cu {
+            le := u.LastError
+            if le != "" {
+                le = u.LastFail + " " + le
+            }
+            fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%.2f\t%s\n", u.Name, u.Health, u.Requests, u.Errors, u.Fails, u.Latency, le)
+        }
+
+    case "workers":
+        var cw []ctlWorker
+        if err := json.Unmarshal(data, &cw); err != nil {
+            return err
+        }
+
+        fmt.Fprintf(tw, "ID\tTYPE\tLISTEN\tINFLIGHT\tQUERIES\tRCODES\n")
+        for _, w := range cw {
+            rc := make([]string, 0, len(w.Rcodes))
+            for k, n := range w.Rcodes {
+                rc = append(rc, fmt.Sprintf("%s: %d", k, n))
+            }
+            sort.Strings(rc)
+
+            fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\n", w.Id, w.Type, w.Listen, w.Inflight, w.Queries, strings.Join(rc, ", "))
+        }
+
+    case "flush-cache":
+        var f map[string]int
+        if err := json.Unmarshal(data, &f); err != nil {
+            return err
+        }
+
+        fmt.Fprintf(tw, "answers rebuilt: %d\n", f["rebuilt"])
+
+    default:
+        // plain message
+        var m string
+        if err := json.Unmarshal(data, &m); err != nil {
+            return err
+        }
+
+        fmt.Fprintln(tw, m)
+    }
+
+    return nil
+}
+
+func orNever(s string) string {
+    if s == "" {
+        return "never"
+    }
+
+    return s
+}
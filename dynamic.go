@@ -0,0 +1,247 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "bufio"
+    "errors"
+    "strings"
+    "path/filepath"
+)
+
+// Records managed at runtime (admin API, dynamic updates) on top
+// of the RR files.
+//
+// Kept in memory and, when configured, written to a dedicated
+// RR file so they survive restarts. Changed only through
+// Cache.Change() which validates them together with the rest.
+//
+// Journal keeps changes instead, one per line:
+//   add <rr line>
+//   del <rr line>
+// replayed and compacted (rewritten as adds) on start and
+// every UPDATE_JOURNAL_COMPACT changes.
+
+type DynamicRecords struct {
+    // admin, update
+    name string
+
+    // persisted to, empty = memory only
+    file string
+
+    // file is journal, changes since compaction
+    journal bool
+    entries int
+
+    // guarded by cache build lock
+    rr []*Record
+}
+
+func NewDynamicRecords(name, file, domain string) (*DynamicRecords, error) {
+    d := &DynamicRecords{name: name, file: file, rr: make([]*Record, 0)}
+    if file == "" {
+        return d, nil
+    }
+
+    rr, err := readRecords(file, domain)
+    if err != nil {
+        // first change creates it
+        if errors.Is(err, os.ErrNotExist) {
+            return d, nil
+        }
+
+        return nil, err
+    }
+
+    d.rr = rr
+    return d, nil
+}
+
+func NewDynamicJournal(name, file, domain string) (*DynamicRecords, error) {
+    d := &DynamicRecords{name: name, file: file, journal: true, rr: make([]*Record, 0)}
+    if file == "" {
+        return d, nil
+    }
+
+    rr, err := readJournal(file, name, domain)
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) {
+            return d, nil
+        }
+
+        return nil, err
+    }
+
+    // compact
+    if err := d.write(rr); err != nil {
+        return nil, err
+    }
+
+    d.rr = rr
+    return d, nil
+}
+
+// journal replayed, all bad lines are reported
+func readJournal(file, name, domain string) ([]*Record, error) {
+    fh, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
+
+    rr := make([]*Record, 0)
+    errs := make([]error, 0)
+
+    n := 0
+    sc := bufio.NewScanner(fh)
+    for sc.Scan() {
+        n++
+
+        line := strings.TrimSpace(sc.Text())
+        if line == "" || line[0] == '#' {
+            continue
+        }
+
+        op, rl, _ := strings.Cut(line, " ")
+        r, err := parseRecord(rl, domain)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s:%d: %s", file, n, err.Error()))
+            continue
+        }
+        r.src = name
+
+        switch op {
+        case "add":
+            rr = append(rr, r)
+        case "del":
+            for i, o := range rr {
+                if o.same(r) {
+                    rr = append(rr[:i], rr[i+1:]...)
+                    break
+                }
+            }
+        default:
+            errs = append(errs, fmt.Errorf("%s:%d: Invalid journal entry: %s", file, n, line))
+        }
+    }
+
+    if err := sc.Err(); err != nil {
+        return nil, err
+    }
+
+    // records of good lines too
+    return rr, errors.Join(errs...)
+}
+
+var errRecordSave = errors.New("Could not save records")
+
+func (d *DynamicRecords) save(rr []*Record) error {
+    var err error
+    if d.journal && d.entries < UPDATE_JOURNAL_COMPACT {
+        err = d.append(rr)
+    } else {
+        err = d.write(rr)
+    }
+
+    if err != nil {
+        // compact on next save
+        d.entries = UPDATE_JOURNAL_COMPACT
+        return fmt.Errorf("%w: %s: %s", errRecordSave, d.file, err.Error())
+    }
+
+    return nil
+}
+
+// journal changes, records are compared
+// as pointers, unchanged ones are kept
+func (d *DynamicRecords) append(rr []*Record) error {
+    if d.file == "" {
+        return nil
+    }
+
+    keep := make(map[*Record]bool)
+    for _, r := range rr {
+        keep[r] = true
+    }
+
+    old := make(map[*Record]bool)
+    var b strings.Builder
+    for _, r := range d.rr {
+        old[r] = true
+        if !keep[r] {
+            b.WriteString("del " + r.String() + "\n")
+            d.entries++
+        }
+    }
+
+    for _, r := range rr {
+        if !old[r] {
+            b.WriteString("add " + r.String() + "\n")
+            d.entries++
+        }
+    }
+
+    fh, err := os.OpenFile(d.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+
+    if _, err := fh.WriteString(b.String()); err != nil {
+        fh.Close()
+        return err
+    }
+
+    if err := fh.Sync(); err != nil {
+        fh.Close()
+        return err
+    }
+
+    return fh.Close()
+}
+
+// write into temp file and move over
+// the file (dir) must be writable by the service user
+func (d *DynamicRecords) write(rr []*Record) error {
+    if d.file == "" {
+        return nil
+    }
+
+    fh, err := os.CreateTemp(filepath.Dir(d.file), "."+filepath.Base(d.file)+".*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(fh.Name())
+
+    prefix := ""
+    if d.journal {
+        prefix = "add "
+    }
+
+    w := bufio.NewWriter(fh)
+    w.WriteString("# managed by dpx (" + d.name + "), changes are overwritten\n")
+    for _, r := range rr {
+        w.WriteString(prefix + r.String() + "\n")
+    }
+
+    if err := w.Flush(); err != nil {
+        fh.Close()
+        return err
+    }
+
+    // world readable, same as RR files
+    if err := fh.Chmod(0644); err != nil {
+        fh.Close()
+        return err
+    }
+
+    if err := fh.Close(); err != nil {
+        return err
+    }
+
+    if err := os.Rename(fh.Name(), d.file); err != nil {
+        return err
+    }
+
+    d.entries = 0
+    return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "net"
+    "time"
+    "bufio"
+    "strconv"
+    "strings"
+    "encoding/csv"
+)
+
+//
+// DHCP leases
+//
+// Hostnames of active leases published as hostname.<dhcp.domain>
+// A/AAAA with PTR, expiring with the lease. Lease files are
+// watched (change time, size) and re-read on change.
+//
+//   isc      ISC dhcpd, dhcpd.leases (IPv4)
+//   kea      Kea memfile, kea-leases4.csv, kea-leases6.csv
+//   dnsmasq  dnsmasq.leases (IPv4, IPv6)
+//
+// Lease hostname colliding with other (static) record
+// is skipped, or replaces it with dhcp.conflict = lease.
+
+type Leases struct {
+    files []*leaseFile
+
+    // hostname.domain
+    domain string
+
+    // static, lease
+    conflict string
+
+    cache *Cache
+    rr *DynamicRecords
+}
+
+type leaseFile struct {
+    format string
+    path string
+    stat *fstat
+}
+
+type lease struct {
+    ip string
+    host string
+
+    // zero = does not expire
+    end time.Time
+
+    active bool
+}
+
+func NewLeases(c *Cache, rr *DynamicRecords, files map[string]string, domain, conflict string) *Leases {
+    l := &Leases{domain: domain, conflict: conflict, cache: c, rr: rr}
+    for path, format := range files {
+        l.files = append(l.files, &leaseFile{format, path, newFstat(path)})
+    }
+
+    return l
+}
+
+// blocking
+// also after RR files reload, static records may have changed
+func (l *Leases) Watch() {
+    reloaded, _ := metrics.LastReload()
+    for {
+        time.Sleep(1 * time.Second)
+
+        changed := false
+        if ok, _ := metrics.LastReload(); !ok.Equal(reloaded) {
+            reloaded = ok
+            changed = true
+        }
+
+        for _, f := range l.files {
+            s := newFstat(f.path)
+            if s.inode != f.stat.inode || s.ctime != f.stat.ctime || s.size != f.stat.size {
+                f.stat = s
+                changed = true
+            }
+        }
+
+        if changed {
+            cInfo.Print("DHCP leases or records changed, reloading leases")
+            if err := l.Load(); err != nil {
+                cCrit.Print("Could not load DHCP leases: " + err.Error())
+            }
+        }
+    }
+}
+
+// all lease files into cache
+// missing file has no leases (yet)
+func (l *Leases) Load() error {
+    now := time.Now()
+
+    // newest lease of hostname, per IP version
+    byHost := make(map[string]lease)
+    for _, f := range l.files {
+        ls, err := f.read()
+        if err != nil {
+            if os.IsNotExist(err) {
+                cWarn.Printf("DHCP lease file not found: %s", f.path)
+                continue
+            }
+
+            return fmt.Errorf("%s: %s", f.path, err.Error())
+        }
+
+        for _, ls := range ls {
+            ls.host = leaseHost(ls.host)
+            if !ls.active || ls.host == "" || (!ls.end.IsZero() && !now.Before(ls.end)) {
+                continue
+            }
+
+            k := ls.host
+            if strings.Contains(ls.ip, ":") {
+                k += "/6"
+            }
+
+            if o, ok := byHost[k]; ok && (o.end.IsZero() || (!ls.end.IsZero() && ls.end.Before(o.end))) {
+                continue
+            }
+
+            byHost[k] = ls
+        }
+    }
+
+    return l.cache.Change(l.rr, func(rr []*Record) ([]*Record, error) {
+        own := make(map[*Record]bool)
+        for _, r := range rr {
+            own[r] = true
+        }
+
+        static := make(map[string]string)
+        for _, r := range l.cache.records() {
+            if !own[r] {
+                static[r.host] = r.src
+            }
+        }
+
+        n := make([]*Record, 0, len(byHost))
+        for _, ls := range byHost {
+            r := &Record{host: ls.host + "." + l.domain, value: ls.ip, ptr: true, expire: ls.end}
+
+            if src, ok := static[r.host]; ok && l.conflict == DHCP_STATIC {
+                cWarn.Printf("DHCP lease: %s %s, conflicts with: %s (skipped)", r.host, r.value, src)
+                continue
+            }
+
+            p, err := parseRecord(r.String(), l.domain)
+            if err != nil {
+                cWarn.Printf("DHCP lease: %s", err.Error())
+                continue
+            }
+
+            p.src = DHCP_SOURCE
+            n = append(n, p)
+        }
+
+        cInfo.Printf("DHCP leases: %d records", len(n))
+        return n, nil
+    })
+}
+
+// single label as accepted by rHost
+// empty if nothing is left
+func leaseHost(h string) string {
+    h, _, _ = strings.Cut(strings.ToLower(h), ".")
+
+    var b strings.Builder
+    for _, c := range h {
+        if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+            b.WriteRune(c)
+        } else if !strings.HasSuffix(b.String(), "-") {
+            b.WriteByte('-')
+        }
+    }
+
+    s := strings.Trim(b.String(), "-")
+    if len(s) > 63 {
+        s = strings.TrimRight(s[:63], "-")
+    }
+
+    return s
+}
+
+func (f *leaseFile) read() ([]lease, error) {
+    fh, err := os.Open(f.path)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
+
+    switch f.format {
+    case DHCP_ISC:
+        return readISC(fh)
+    case DHCP_KEA:
+        return readKea(fh)
+    }
+
+    return readDnsmasq(fh)
+}
+
+// lease 192.168.1.100 {
+//   ends 4 2026/10/15 22:00:00;   (UTC, or 'epoch N;', 'never;')
+//   binding state active;
+//   client-hostname "laptop";
+// }
+// later lease of the same IP supersedes
+func readISC(fh *os.File) ([]lease, error) {
+    byIp := make(map[string]int)
+    ls := make([]lease, 0)
+
+    var cur *lease
+    sc := bufio.NewScanner(fh)
+    for sc.Scan() {
+        line := strings.TrimSpace(sc.Text())
+        if line == "" || line[0] == '#' {
+            continue
+        }
+
+        if cur == nil {
+            f := strings.Fields(line)
+            if len(f) == 3 && f[0] == "lease" && f[2] == "{" && net.ParseIP(f[1]) != nil {
+                cur = &lease{ip: net.ParseIP(f[1]).String()}
+            }
+
+            continue
+        }
+
+        if line == "}" {
+            if i, ok := byIp[cur.ip]; ok {
+                ls[i] = *cur
+            } else {
+                byIp[cur.ip] = len(ls)
+                ls = append(ls, *cur)
+            }
+
+            cur = nil
+            continue
+        }
+
+        // ends epoch 1760565600; # Wed Oct 15 22:00:00 2026
+        if i := strings.Index(line, "; #"); i >= 0 {
+            line = line[:i]
+        }
+
+        line = strings.TrimSuffix(line, ";")
+        f := strings.Fields(line)
+        switch {
+        case len(f) == 3 && f[0] == "binding" && f[1] == "state":
+            cur.active = f[2] == "active"
+
+        case len(f) >= 2 && f[0] == "client-hostname":
+            cur.host = strings.Trim(strings.TrimPrefix(line, "client-hostname "), `"`)
+
+        case len(f) >= 2 && f[0] == "ends":
+            switch {
+            case f[1] == "never":
+                cur.end = time.Time{}
+            case f[1] == "epoch" && len(f) >= 3:
+                e, err := strconv.ParseInt(f[2], 10, 64)
+                if err != nil {
+                    return nil, fmt.Errorf("Invalid lease end: %s", line)
+                }
+                cur.end = time.Unix(e, 0)
+            case len(f) == 4:
+                t, err := time.Parse("2006/01/02 15:04:05", f[2]+" "+f[3])
+                if err != nil {
+                    return nil, fmt.Errorf("Invalid lease end: %s", line)
+                }
+                cur.end = t
+            }
+        }
+    }
+
+    return ls, sc.Err()
+}
+
+// memfile CSV, v4 or v6 by header
+// address,...,expire,...,hostname,state,...
+// appended, later lease of the same IP supersedes
+func readKea(fh *os.File) ([]lease, error) {
+    r := csv.NewReader(fh)
+    r.FieldsPerRecord = -1
+
+    hdr, err := r.Read()
+    if err != nil {
+        if err == io.EOF {
+            return nil, nil
+        }
+
+        return nil, err
+    }
+
+    col := make(map[string]int)
+    for i, h := range hdr {
+        col[h] = i
+    }
+
+    for _, c := range []string{"address", "valid_lifetime", "expire", "hostname", "state"} {
+        if _, ok := col[c]; !ok {
+            return nil, fmt.Errorf("Missing column: %s", c)
+        }
+    }
+
+    byIp := make(map[string]int)
+    ls := make([]lease, 0)
+    for {
+        rec, err := r.Read()
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+
+            return nil, err
+        }
+
+        if len(rec) < len(hdr) {
+            continue
+        }
+
+        // v6 prefix delegation
+        if pl, ok := col["prefix_len"]; ok && rec[pl] != "128" {
+            continue
+        }
+
+        ip := net.ParseIP(rec[col["address"]])
+        if ip == nil {
+            continue
+        }
+
+        e, err := strconv.ParseInt(rec[col["expire"]], 10, 64)
+        if err != nil {
+            continue
+        }
+
+        l := lease{
+            ip:     ip.String(),
+            // commas escaped
+            host:   strings.ReplaceAll(rec[col["hostname"]], "&#x2c", ","),
+            end:    time.Unix(e, 0),
+            // 0 = assigned, valid lifetime 0 = released
+            active: rec[col["state"]] == "0" && rec[col["valid_lifetime"]] != "0",
+        }
+
+        if i, ok := byIp[l.ip]; ok {
+            ls[i] = l
+        } else {
+            byIp[l.ip] = len(ls)
+            ls = append(ls, l)
+        }
+    }
+
+    return ls, nil
+}
+
+// expiry mac ip hostname client-id (v4)
+// expiry iaid ip hostname client-id (v6, after 'duid' line)
+// expiry 0 = does not expire, hostname * = none
+func readDnsmasq(fh *os.File) ([]lease, error) {
+    ls := make([]lease, 0)
+
+    sc := bufio.NewScanner(fh)
+    for sc.Scan() {
+        f := strings.Fields(sc.Text())
+        if len(f) < 4 || f[0] == "duid" {
+            continue
+        }
+
+        ip := net.ParseIP(f[2])
+        if ip == nil {
+            continue
+        }
+
+        e, err := strconv.ParseInt(f[0], 10, 64)
+        if err != nil {
+            continue
+        }
+
+        l := lease{ip: ip.String(), active: true}
+        if f[3] != "*" {
+            l.host = f[3]
+        }
+        if e != 0 {
+            l.end = time.Unix(e, 0)
+        }
+
+        ls = append(ls, l)
+    }
+
+    return ls, sc.Err()
+}
@@ -4,6 +4,15 @@ import (
     "log"
     "os"
     "io"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "runtime"
+    "strings"
+    "sync/atomic"
+    "path/filepath"
+    "compress/gzip"
 )
 
 const (
@@ -11,34 +20,252 @@ const (
     STDERR = "stderr"
 )
 
+//
+// Levels and subsystems
+//
+// Each subsystem (server, cache, upstream, worker, blocklist) has
+// its own loggers, output and level. Levels can be changed at runtime,
+// messages above the subsystem level are discarded.
+
+const (
+    LOG_ERROR = iota
+    LOG_WARN
+    LOG_INFO
+    LOG_DEBUG
+    LOG_TRACE
+)
+
+var logLevelName = []string{"error", "warn", "info", "debug", "trace"}
+
+func LogLevel(s string) (int, error) {
+    for i, n := range logLevelName {
+        if n == s {
+            return i, nil
+        }
+    }
+
+    return 0, fmt.Errorf("not valid (accepts: %s)", strings.Join(logLevelName, "/"))
+}
+
+func LogLevelString(i int) string {
+    if i < 0 || i >= len(logLevelName) {
+        return fmt.Sprintf("level(%d)", i)
+    }
+
+    return logLevelName[i]
+}
+
+type LogSubsystem struct {
+    name string
+    level atomic.Int32
+}
+
+func (s *LogSubsystem) Level() int {
+    return int(s.level.Load())
+}
+
+func (s *LogSubsystem) SetLevel(i int) {
+    s.level.Store(int32(i))
+}
+
+// all subsystems, LOG_INFO until configured
+var logSubsystems = map[string]*LogSubsystem{}
+
+func newLogSubsystem(name string) *LogSubsystem {
+    s := &LogSubsystem{name: name}
+    s.SetLevel(LOG_INFO)
+    logSubsystems[name] = s
+
+    return s
+}
+
+var (
+    logServer    = newLogSubsystem(LOG_SERVER)
+    logCache     = newLogSubsystem(LOG_CACHE)
+    logUpstream  = newLogSubsystem(LOG_UPSTREAM)
+    logWorker    = newLogSubsystem(LOG_WORKER)
+    logBlocklist = newLogSubsystem(LOG_BLOCKLIST)
+)
+
+// default level for all, overrides per subsystem
+func SetLogLevels(level int, override map[string]int) {
+    for n, s := range logSubsystems {
+        if l, ok := override[n]; ok {
+            s.SetLevel(l)
+        } else {
+            s.SetLevel(level)
+        }
+    }
+}
+
+// current levels, one when all the same
+func LogLevelsString() string {
+    l := make([]string, 0, len(logSubsystems))
+    same := true
+    for _, n := range []string{LOG_SERVER, LOG_CACHE, LOG_UPSTREAM, LOG_WORKER, LOG_BLOCKLIST} {
+        s := logSubsystems[n]
+        if s.Level() != logServer.Level() {
+            same = false
+        }
+
+        l = append(l, n + ": " + LogLevelString(s.Level()))
+    }
+
+    if same {
+        return LogLevelString(logServer.Level())
+    }
+
+    return strings.Join(l, ", ")
+}
+
 type Logger struct {
     *log.Logger
+
+    // of this logger
+    level int
+
+    sub *LogSubsystem
+
+    // worker id field (syslog, journald), -1 = none
+    worker int
+}
+
+// message would be logged
+func (l Logger) On() bool {
+    return l.sub != nil && l.level <= l.sub.Level()
+}
+
+// logger with worker id field
+func (l Logger) Worker(id int) Logger {
+    l.worker = id
+    return l
+}
+
+func (l Logger) Print(v ...any) {
+    if l.On() {
+        l.output(fmt.Sprint(v...))
+    }
+}
+
+func (l Logger) Printf(format string, v ...any) {
+    if l.On() {
+        l.output(fmt.Sprintf(format, v...))
+    }
 }
 
-func NewHandles(f string) (i, w, c, d Logger) {
-    var fh *os.File
-    var err error
+func (l Logger) Println(v ...any) {
+    if l.On() {
+        l.output(fmt.Sprintln(v...))
+    }
+}
 
-    if f == STDOUT { fh = os.Stdout }
-    if f == STDERR { fh = os.Stderr }
+// records get fields, files text (of log flags)
+// called from Print*, caller is 3 frames up
+func (l Logger) output(msg string) {
+    rw, ok := l.Writer().(*recordWriter)
+    if !ok {
+        l.Output(3, msg)
+        return
+    }
 
-    if fh == nil {
-        fh, err = os.OpenFile(f, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    r := logRecord{level: l.level, sub: l.sub.name, worker: l.worker, msg: strings.TrimSuffix(msg, "\n")}
+    if _, file, line, ok := runtime.Caller(2); ok {
+        r.file, r.line = filepath.Base(file), line
+    }
+
+    rw.sink.Send(r)
+}
+
+// prefix of level, files only
+var logPrefix = []string{"CRITICAL: ", "WARN: ", "INFO: ", "DEBUG: ", "TRACE: "}
+
+// output, prefix and flags of level logger to f
+func logTarget(f string, level int, sub *LogSubsystem) (io.Writer, string, int, error) {
+    // syslog, journald
+    if isRecordSink(f) {
+        rs, err := openRecordSink(f)
         if err != nil {
-            panic(err)
+            return nil, "", 0, err
         }
+
+        // date, level and code are fields of the record
+        return &recordWriter{rs, level, sub.name}, "", 0, nil
+    }
+
+    lf, err := openLogFile(f)
+    if err != nil {
+        return nil, "", 0, err
     }
 
     // LstdFlags contain Ldate + Ltime
-    flags := log.LstdFlags|log.Lshortfile
+    return lf, logPrefix[level], log.LstdFlags|log.Lshortfile, nil
+}
+
+func NewHandles(f string, sub *LogSubsystem) (i, w, c, d, t Logger) {
+    nl := func(level int) Logger {
+        out, prefix, flags, err := logTarget(f, level, sub)
+        if err != nil {
+            panic(err)
+        }
+
+        return Logger{log.New(out, prefix, flags), level, sub, -1}
+    }
 
-    i = Logger{log.New(fh, "INFO: ", flags)}
-    w = Logger{log.New(fh, "WARN: ", flags)}
-    c = Logger{log.New(fh, "CRITICAL: ", flags)}
-    d = Logger{log.New(fh, "DEBUG: ", flags)}
+    i = nl(LOG_INFO)
+    w = nl(LOG_WARN)
+    c = nl(LOG_ERROR)
+    d = nl(LOG_DEBUG)
+    t = nl(LOG_TRACE)
     return
 }
 
+// moves existing loggers (handles) to f, config reload
+// all are left as they are on error
+func SetHandles(f string, handles ...Logger) error {
+    type target struct {
+        out io.Writer
+        prefix string
+        flags int
+    }
+
+    ts := make([]target, len(handles))
+    for i, l := range handles {
+        out, prefix, flags, err := logTarget(f, l.level, l.sub)
+        if err != nil {
+            return err
+        }
+
+        ts[i] = target{out, prefix, flags}
+    }
+
+    for i, l := range handles {
+        l.SetOutput(ts[i].out)
+        l.SetPrefix(ts[i].prefix)
+        l.SetFlags(ts[i].flags)
+    }
+
+    return nil
+}
+
+// close log files no longer logged to
+// (other than paths), config reload
+func CloseLogFiles(paths []string) {
+    logFilesMux.Lock()
+    defer logFilesMux.Unlock()
+
+    keep := make(map[string]bool)
+    for _, p := range paths {
+        keep[p] = true
+    }
+
+    for p, lf := range logFiles {
+        if !keep[p] {
+            lf.Close()
+            delete(logFiles, p)
+        }
+    }
+}
+
 func doNotClose(f *os.File) bool {
     if f.Name() == os.Stdout.Name() || f.Name() == os.Stderr.Name() {
         return true
@@ -50,17 +277,291 @@ func doNotClose(f *os.File) bool {
 // don't close os level file descriptors
 
 func (l Logger) Close() {
-    if doNotClose(l.Writer().(*os.File)) {
-        return
+    Close(l.Writer())
+}
+
+func Close(i io.Writer) {
+    switch f := i.(type) {
+    case *LogFile:
+        f.Close()
+    case *os.File:
+        if !doNotClose(f) {
+            f.Close()
+        }
     }
+}
+
+
+//
+// Log files
+//
+// Reopened on SIGUSR1 (after external logrotate moved them away)
+// and optionally rotated by size/age: current file is renamed
+// with a timestamp suffix, (compressed) and only 'keep' newest
+// of the rotated files are retained.
+
+type LogRotate struct {
+    // bytes, 0 = off
+    size int64
 
-    l.Writer().(*os.File).Close()
+    // 0 = off
+    age time.Duration
+
+    // rotated files kept
+    keep int
+
+    // gzip rotated files
+    compress bool
 }
 
-func Close(i io.Writer) {
-    if doNotClose(i.(*os.File)) {
+// rotation settings, changed on config reload
+var logRotate atomic.Pointer[LogRotate]
+
+func SetLogRotate(size int64, age time.Duration, keep int, compress bool) {
+    logRotate.Store(&LogRotate{size, age, keep, compress})
+}
+
+// off until set
+func currentLogRotate() LogRotate {
+    if r := logRotate.Load(); r != nil {
+        return *r
+    }
+
+    return LogRotate{}
+}
+
+type LogFile struct {
+    path string
+
+    mux sync.Mutex
+    fh *os.File
+
+    // current file
+    size int64
+    opened time.Time
+
+    // failed rotation, try again later
+    retry time.Time
+}
+
+// open log files by path
+// the same file is shared by all its loggers
+var logFiles = make(map[string]*LogFile)
+var logFilesMux sync.Mutex
+
+func openLogFile(path string) (*LogFile, error) {
+    logFilesMux.Lock()
+    defer logFilesMux.Unlock()
+
+    if lf, ok := logFiles[path]; ok {
+        return lf, nil
+    }
+
+    // log dir, does not exist is fine
+    if path != STDOUT && path != STDERR {
+        if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+            return nil, err
+        }
+    }
+
+    lf := &LogFile{path: path}
+    if err := lf.open(); err != nil {
+        return nil, err
+    }
+
+    logFiles[path] = lf
+    return lf, nil
+}
+
+// reopen all log files
+// errors are reported, old handles are kept on failure
+func ReopenLogs() {
+    logFilesMux.Lock()
+    defer logFilesMux.Unlock()
+
+    for _, lf := range logFiles {
+        if err := lf.Reopen(); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to reopen log file: %s: %s\n", lf.path, err.Error())
+        }
+    }
+}
+
+func (l *LogFile) std() bool {
+    return l.path == STDOUT || l.path == STDERR
+}
+
+// must be called with lock held (or before sharing)
+func (l *LogFile) open() error {
+    switch l.path {
+    case STDOUT:
+        l.fh = os.Stdout
+        return nil
+    case STDERR:
+        l.fh = os.Stderr
+        return nil
+    }
+
+    fh, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+
+    fi, err := fh.Stat()
+    if err != nil {
+        fh.Close()
+        return err
+    }
+
+    l.fh = fh
+    l.size = fi.Size()
+    l.opened = time.Now()
+    return nil
+}
+
+func (l *LogFile) Reopen() error {
+    l.mux.Lock()
+    defer l.mux.Unlock()
+
+    if l.std() {
+        return nil
+    }
+
+    old := l.fh
+    if err := l.open(); err != nil {
+        return err
+    }
+
+    old.Close()
+    return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+    l.mux.Lock()
+    defer l.mux.Unlock()
+
+    if l.rotateDue(len(p)) {
+        if err := l.rotate(); err != nil {
+            // keep on writing into the current file
+            l.retry = time.Now().Add(LOG_ROTATE_RETRY * time.Second)
+            fmt.Fprintf(os.Stderr, "Failed to rotate log file: %s: %s\n", l.path, err.Error())
+        }
+    }
+
+    n, err := l.fh.Write(p)
+    l.size += int64(n)
+
+    return n, err
+}
+
+func (l *LogFile) Close() {
+    l.mux.Lock()
+    defer l.mux.Unlock()
+
+    if !doNotClose(l.fh) {
+        l.fh.Close()
+    }
+}
+
+func (l *LogFile) rotateDue(n int) bool {
+    if l.std() || l.size == 0 || time.Now().Before(l.retry) {
+        return false
+    }
+
+    r := currentLogRotate()
+    if r.size > 0 && l.size+int64(n) > r.size {
+        return true
+    }
+
+    if r.age > 0 && time.Since(l.opened) >= r.age {
+        return true
+    }
+
+    return false
+}
+
+// must be called with lock held
+func (l *LogFile) rotate() error {
+    rotated := l.path + "." + time.Now().Format("2006-01-02T15-04-05.000")
+    if err := os.Rename(l.path, rotated); err != nil {
+        return err
+    }
+
+    old := l.fh
+    if err := l.open(); err != nil {
+        // should not happen, the dir is writable (rename)
+        // keep the old (renamed) handle
+        return err
+    }
+    old.Close()
+
+    go func(path, rotated string) {
+        if currentLogRotate().compress {
+            if err := gzipFile(rotated); err != nil {
+                fmt.Fprintf(os.Stderr, "Failed to compress log file: %s: %s\n", rotated, err.Error())
+            }
+        }
+
+        pruneLogs(path)
+    }(l.path, rotated)
+
+    return nil
+}
+
+func gzipFile(path string) error {
+    in, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+
+    gz := gzip.NewWriter(out)
+    if _, err := io.Copy(gz, in); err != nil {
+        out.Close()
+        os.Remove(path+".gz")
+        return err
+    }
+
+    if err := gz.Close(); err != nil {
+        out.Close()
+        os.Remove(path+".gz")
+        return err
+    }
+
+    if err := out.Close(); err != nil {
+        os.Remove(path+".gz")
+        return err
+    }
+
+    return os.Remove(path)
+}
+
+// keep 'keep' newest rotated files
+// names sort by the timestamp suffix
+func pruneLogs(path string) {
+    keep := currentLogRotate().keep
+    if keep <= 0 {
         return
     }
 
-    i.(*os.File).Close()
+    files, err := filepath.Glob(path + ".[0-9][0-9][0-9][0-9]-*")
+    if err != nil {
+        return
+    }
+
+    // compressed and not (yet) compressed
+    // are the same rotated file
+    sort.Slice(files, func(i, j int) bool {
+        return strings.TrimSuffix(files[i], ".gz") > strings.TrimSuffix(files[j], ".gz")
+    })
+
+    for i, f := range files {
+        if i >= keep {
+            os.Remove(f)
+        }
+    }
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "bytes"
+    "strconv"
+    "strings"
+    "log/syslog"
+    "encoding/binary"
+)
+
+// Syslog (syslog://<facility>) and systemd-journald (journald) log outputs.
+//
+// Log records are sent with priority mapped from the logger level
+// and the subsystem and worker id as separate fields rather than
+// text prefixes.
+
+type recordSink interface {
+    Send(r logRecord) error
+}
+
+type logRecord struct {
+    level int
+    sub string
+    file string
+    line int
+    worker int
+    msg string
+}
+
+// log.Logger output for one level of a subsystem
+// Logger sends records with fields itself (Logger.output),
+// this is for messages written through log.Logger only
+type recordWriter struct {
+    sink recordSink
+    level int
+    sub string
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+    r := logRecord{level: w.level, sub: w.sub, worker: -1, msg: strings.TrimSuffix(string(p), "\n")}
+    if err := w.sink.Send(r); err != nil {
+        return 0, err
+    }
+
+    return len(p), nil
+}
+
+func isRecordSink(target string) bool {
+    return strings.HasPrefix(target, LOG_SYSLOG) || target == LOG_JOURNALD
+}
+
+// shared by all subsystems logging there
+var recordSinks = make(map[string]recordSink)
+var recordSinksMux sync.Mutex
+
+func openRecordSink(target string) (recordSink, error) {
+    recordSinksMux.Lock()
+    defer recordSinksMux.Unlock()
+
+    if s, ok := recordSinks[target]; ok {
+        return s, nil
+    }
+
+    var s recordSink
+    var err error
+    if target == LOG_JOURNALD {
+        s, err = newJournald()
+    } else {
+        s, err = newSyslog(strings.TrimPrefix(target, LOG_SYSLOG))
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    recordSinks[target] = s
+    return s, nil
+}
+
+//
+// syslog
+
+var syslogFacility = map[string]syslog.Priority{
+    "kern":     syslog.LOG_KERN,
+    "user":     syslog.LOG_USER,
+    "mail":     syslog.LOG_MAIL,
+    "daemon":   syslog.LOG_DAEMON,
+    "auth":     syslog.LOG_AUTH,
+    "syslog":   syslog.LOG_SYSLOG,
+    "lpr":      syslog.LOG_LPR,
+    "news":     syslog.LOG_NEWS,
+    "uucp":     syslog.LOG_UUCP,
+    "cron":     syslog.LOG_CRON,
+    "authpriv": syslog.LOG_AUTHPRIV,
+    "ftp":      syslog.LOG_FTP,
+    "local0":   syslog.LOG_LOCAL0,
+    "local1":   syslog.LOG_LOCAL1,
+    "local2":   syslog.LOG_LOCAL2,
+    "local3":   syslog.LOG_LOCAL3,
+    "local4":   syslog.LOG_LOCAL4,
+    "local5":   syslog.LOG_LOCAL5,
+    "local6":   syslog.LOG_LOCAL6,
+    "local7":   syslog.LOG_LOCAL7,
+}
+
+type syslogSink struct {
+    w *syslog.Writer
+}
+
+func SyslogFacility(s string) (syslog.Priority, error) {
+    f, ok := syslogFacility[s]
+    if !ok {
+        return 0, fmt.Errorf("Unknown syslog facility: %s", s)
+    }
+
+    return f, nil
+}
+
+// local syslog daemon (/dev/log)
+func newSyslog(facility string) (*syslogSink, error) {
+    f, err := SyslogFacility(facility)
+    if err != nil {
+        return nil, err
+    }
+
+    w, err := syslog.New(f|syslog.LOG_INFO, LOG_IDENT)
+    if err != nil {
+        return nil, err
+    }
+
+    return &syslogSink{w}, nil
+}
+
+func (s *syslogSink) Send(r logRecord) error {
+    // key=value fields ahead of the message
+    m := "subsystem=" + r.sub
+    if r.worker >= 0 {
+        m += " worker=" + strconv.Itoa(r.worker)
+    }
+    if r.file != "" {
+        m += fmt.Sprintf(" code=%s:%d", r.file, r.line)
+    }
+    m += " " + r.msg
+
+    switch r.level {
+    case LOG_ERROR: return s.w.Err(m)
+    case LOG_WARN:  return s.w.Warning(m)
+    case LOG_INFO:  return s.w.Info(m)
+    }
+
+    return s.w.Debug(m)
+}
+
+//
+// journald, native protocol
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+
+type journaldSink struct {
+    mux sync.Mutex
+    conn *net.UnixConn
+}
+
+func newJournald() (*journaldSink, error) {
+    j := &journaldSink{}
+    if err := j.dial(); err != nil {
+        return nil, err
+    }
+
+    return j, nil
+}
+
+// must be called with lock held (or before sharing)
+func (j *journaldSink) dial() error {
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JOURNALD_SOCKET, Net: "unixgram"})
+    if err != nil {
+        return err
+    }
+
+    if j.conn != nil {
+        j.conn.Close()
+    }
+
+    j.conn = conn
+    return nil
+}
+
+// syslog(3) priorities
+var journalPriority = []int{3, 4, 6, 7, 7}
+
+func (j *journaldSink) Send(r logRecord) error {
+    b := journalFields(r)
+
+    j.mux.Lock()
+    defer j.mux.Unlock()
+
+    _, err := j.conn.Write(b)
+    if err == nil {
+        return nil
+    }
+
+    // journald restarted
+    // try once more with a new connection
+    if err := j.dial(); err != nil {
+        return err
+    }
+
+    _, err = j.conn.Write(b)
+    return err
+}
+
+func journalFields(r logRecord) []byte {
+    var b bytes.Buffer
+
+    journalField(&b, "MESSAGE", r.msg)
+    journalField(&b, "PRIORITY", strconv.Itoa(journalPriority[r.level]))
+    journalField(&b, "SYSLOG_IDENTIFIER", LOG_IDENT)
+    journalField(&b, "DPX_SUBSYSTEM", r.sub)
+    journalField(&b, "DPX_LEVEL", strings.ToUpper(LogLevelString(r.level)))
+    if r.worker >= 0 {
+        journalField(&b, "DPX_WORKER", strconv.Itoa(r.worker))
+    }
+    if r.file != "" {
+        journalField(&b, "CODE_FILE", r.file)
+        journalField(&b, "CODE_LINE", strconv.Itoa(r.line))
+    }
+
+    return b.Bytes()
+}
+
+// KEY=value or, when the value has new lines,
+// KEY, new line, 64bit LE length, value
+func journalField(b *bytes.Buffer, k, v string) {
+    if !strings.Contains(v, "\n") {
+        b.WriteString(k + "=" + v + "\n")
+        return
+    }
+
+    b.WriteString(k + "\n")
+    binary.Write(b, binary.LittleEndian, uint64(len(v)))
+    b.WriteString(v + "\n")
+}
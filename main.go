@@ -1,6 +1,7 @@
 package main
 
 import (
+    "os"
     "flag"
     "fmt"
 )
@@ -11,10 +12,25 @@ var stdout bool
 func init() {
     flag.StringVar(&config, "config", "/etc/dpx/dpx.cfg", "DNS proxy config file")
     flag.BoolVar(&stdout, "stdout", false, "Print to STDOUT")
-    flag.Parse()
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] [-stdout]\n       %s check [-config file]\n", os.Args[0], os.Args[0])
+        flag.PrintDefaults()
+    }
 }
 
 func main() {
+    // not in init, go test has flags of its own
+    flag.Parse()
+
+    // validate config and records, no server
+    if flag.Arg(0) == "check" {
+        cf := flag.NewFlagSet("check", flag.ExitOnError)
+        cf.StringVar(&config, "config", config, "DNS proxy config file")
+        cf.Parse(flag.Args()[1:])
+
+        os.Exit(Check(config))
+    }
+
     fmt.Println(config)
     fmt.Println(stdout)
     s := NewServer(config, stdout)
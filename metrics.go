@@ -0,0 +1,382 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "runtime"
+    "strings"
+    "net/http"
+)
+
+// Prometheus metrics (text exposition format)
+// served on /metrics when 'metrics.listen' is configured.
+//
+// Collected always, it's a few counters under a lock.
+
+// collected globally
+// same as the loggers
+var metrics = NewMetrics()
+
+// upstream latency histogram buckets (seconds)
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type Metrics struct {
+    mux sync.Mutex
+
+    // queries by type, rcode, transport, worker
+    query map[queryLabels]uint64
+
+    // local cache
+    cacheHit uint64
+    cacheMiss uint64
+
+    // per upstream
+    upstream map[string]*upstreamStat
+
+    // cache reloads
+    reloadOk uint64
+    reloadFail uint64
+    reloadOkTime time.Time
+    reloadFailTime time.Time
+
+    // workers, for in-flight queries
+    worker []Worker
+
+    start time.Time
+}
+
+type queryLabels struct {
+    qtype string
+    rcode string
+    transport string
+    worker int
+}
+
+type upstreamStat struct {
+    requests uint64
+    errors uint64
+
+    // latency histogram
+    bucket []uint64
+    sum float64
+
+    // health, consecutive failures
+    fails int
+    lastOk time.Time
+    lastFail time.Time
+    lastErr string
+}
+
+func NewMetrics() *Metrics {
+    return &Metrics{
+        query:    make(map[queryLabels]uint64),
+        upstream: make(map[string]*upstreamStat),
+        start:    time.Now(),
+    }
+}
+
+// answered (or dropped when answer is nil) query
+func (m *Metrics) Query(transport string, wid int, query, answer []byte) {
+    qt := RequestType(query)
+    qtype := RequestTypeString(qt)
+    if strings.HasPrefix(qtype, "not-yet") {
+        qtype = fmt.Sprintf("TYPE%d", qt)
+    }
+
+    rcode := "dropped"
+    if len(answer) >= HEADER_LEN {
+        rcode = RcodeString(int(answer[3]) & RCODE_MASK)
+    }
+
+    m.mux.Lock()
+    m.query[queryLabels{qtype, rcode, transport, wid}]++
+    m.mux.Unlock()
+}
+
+func (m *Metrics) Cache(hit bool) {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    if hit {
+        m.cacheHit++
+    } else {
+        m.cacheMiss++
+    }
+}
+
+func (m *Metrics) Upstream(name string, d time.Duration, err error) {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    u, ok := m.upstream[name]
+    if !ok {
+        u = &upstreamStat{bucket: make([]uint64, len(latencyBuckets))}
+        m.upstream[name] = u
+    }
+
+    u.requests++
+    if err != nil {
+        u.errors++
+        u.fails++
+        u.lastFail = time.Now()
+        u.lastErr = err.Error()
+        return
+    }
+
+    u.fails = 0
+    u.lastOk = time.Now()
+
+    s := d.Seconds()
+    u.sum += s
+    for i, b := range latencyBuckets {
+        if s <= b {
+            u.bucket[i]++
+        }
+    }
+}
+
+func (m *Metrics) Reload(ok bool) {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    if ok {
+        m.reloadOk++
+        m.reloadOkTime = time.Now()
+    } else {
+        m.reloadFail++
+        m.reloadFailTime = time.Now()
+    }
+}
+
+func (m *Metrics) SetWorkers(w []Worker) {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    m.worker = w
+}
+
+// upstream health for control socket
+// names are of configured upstreams, not all may have been used yet
+func (m *Metrics) Upstreams(names []string) []ctlUpstream {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    cu := make([]ctlUpstream, len(names))
+    for i, n := range names {
+        cu[i] = ctlUpstream{Name: n, Health: UPSTREAM_UNKNOWN}
+
+        u, ok := m.upstream[n]
+        if !ok {
+            continue
+        }
+
+        cu[i].Requests = u.requests
+        cu[i].Errors = u.errors
+        cu[i].Fails = u.fails
+        cu[i].LastOk = timeOrEmpty(u.lastOk)
+        cu[i].LastFail = timeOrEmpty(u.lastFail)
+        cu[i].LastError = u.lastErr
+
+        if ok := u.requests - u.errors; ok > 0 {
+            cu[i].Latency = u.sum / float64(ok) * 1000
+        }
+
+        switch {
+        case u.fails >= UPSTREAM_DOWN_FAILS:
+            cu[i].Health = UPSTREAM_DOWN
+        case u.requests > 0:
+            cu[i].Health = UPSTREAM_UP
+        }
+    }
+
+    return cu
+}
+
+// per worker query counts for control socket
+func (m *Metrics) Workers() []ctlWorker {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    cw := make([]ctlWorker, len(m.worker))
+    for i, w := range m.worker {
+        cw[i] = ctlWorker{
+            Id:       w.Id(),
+            Type:     w.Type(),
+            Listen:   w.ListenAddr().String(),
+            Inflight: w.Inflight(),
+            Rcodes:   make(map[string]uint64),
+        }
+
+        for k, n := range m.query {
+            if k.worker != w.Id() {
+                continue
+            }
+
+            cw[i].Queries += n
+            cw[i].Rcodes[k.rcode] += n
+        }
+    }
+
+    return cw
+}
+
+func (m *Metrics) LastReload() (time.Time, time.Time) {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    return m.reloadOkTime, m.reloadFailTime
+}
+
+// serves /metrics, blocking
+func (m *Metrics) Serve(l net.Listener) {
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", m)
+
+    srv := &http.Server{
+        Handler:           mux,
+        ReadHeaderTimeout: STREAM_IDLE * time.Second,
+        ErrorLog:          sWarn.Logger,
+    }
+
+    sInfo.Printf("Metrics listening on: %s", l.Addr().String())
+    if err := srv.Serve(l); err != nil {
+        sCrit.Printf("Metrics listener failed: %s", err.Error())
+    }
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    m.Write(rw)
+}
+
+// counters copied, written unlocked (slow scrapers
+// do not hold up queries)
+func (m *Metrics) Write(w io.Writer) {
+    s := m.snapshot()
+
+    // queries
+    keys := make([]queryLabels, 0, len(s.query))
+    for k := range s.query {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        a, b := keys[i], keys[j]
+        if a.worker != b.worker {
+            return a.worker < b.worker
+        }
+        if a.qtype != b.qtype {
+            return a.qtype < b.qtype
+        }
+
+        return a.rcode < b.rcode
+    })
+
+    metricHead(w, "dpx_queries_total", "counter", "Queries by type, rcode, transport and worker.")
+    for _, k := range keys {
+        fmt.Fprintf(w, "dpx_queries_total{type=%q,rcode=%q,transport=%q,worker=\"%d\"} %d\n", k.qtype, k.rcode, k.transport, k.worker, s.query[k])
+    }
+
+    // cache
+    metricHead(w, "dpx_cache_hits_total", "counter", "Queries answered from local records.")
+    fmt.Fprintf(w, "dpx_cache_hits_total %d\n", s.cacheHit)
+    metricHead(w, "dpx_cache_misses_total", "counter", "Queries not found in local records.")
+    fmt.Fprintf(w, "dpx_cache_misses_total %d\n", s.cacheMiss)
+
+    metricHead(w, "dpx_cache_reloads_total", "counter", "Local records (re)loads by result.")
+    fmt.Fprintf(w, "dpx_cache_reloads_total{result=\"success\"} %d\n", s.reloadOk)
+    fmt.Fprintf(w, "dpx_cache_reloads_total{result=\"failure\"} %d\n", s.reloadFail)
+    metricHead(w, "dpx_cache_reload_timestamp_seconds", "gauge", "Last local records (re)load by result, 0 = never.")
+    fmt.Fprintf(w, "dpx_cache_reload_timestamp_seconds{result=\"success\"} %d\n", unixOrZero(s.reloadOkTime))
+    fmt.Fprintf(w, "dpx_cache_reload_timestamp_seconds{result=\"failure\"} %d\n", unixOrZero(s.reloadFailTime))
+
+    // upstreams
+    names := make([]string, 0, len(s.upstream))
+    for n := range s.upstream {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+
+    metricHead(w, "dpx_upstream_requests_total", "counter", "Queries forwarded upstream.")
+    for _, n := range names {
+        fmt.Fprintf(w, "dpx_upstream_requests_total{upstream=%q} %d\n", n, s.upstream[n].requests)
+    }
+    metricHead(w, "dpx_upstream_errors_total", "counter", "Failed upstream queries (timeouts, invalid responses etc).")
+    for _, n := range names {
+        fmt.Fprintf(w, "dpx_upstream_errors_total{upstream=%q} %d\n", n, s.upstream[n].errors)
+    }
+    metricHead(w, "dpx_upstream_latency_seconds", "histogram", "Latency of successful upstream queries.")
+    for _, n := range names {
+        u := s.upstream[n]
+        for i, b := range latencyBuckets {
+            fmt.Fprintf(w, "dpx_upstream_latency_seconds_bucket{upstream=%q,le=\"%g\"} %d\n", n, b, u.bucket[i])
+        }
+        fmt.Fprintf(w, "dpx_upstream_latency_seconds_bucket{upstream=%q,le=\"+Inf\"} %d\n", n, u.requests-u.errors)
+        fmt.Fprintf(w, "dpx_upstream_latency_seconds_sum{upstream=%q} %g\n", n, u.sum)
+        fmt.Fprintf(w, "dpx_upstream_latency_seconds_count{upstream=%q} %d\n", n, u.requests-u.errors)
+    }
+
+    // runtime
+    metricHead(w, "dpx_worker_inflight", "gauge", "Queries (connections for TLS workers) in processing.")
+    for _, wk := range s.worker {
+        fmt.Fprintf(w, "dpx_worker_inflight{transport=%q,worker=\"%d\"} %d\n", wk.Type(), wk.Id(), wk.Inflight())
+    }
+    metricHead(w, "dpx_goroutines", "gauge", "Goroutines currently running.")
+    fmt.Fprintf(w, "dpx_goroutines %d\n", runtime.NumGoroutine())
+    metricHead(w, "dpx_start_timestamp_seconds", "gauge", "Server start time.")
+    fmt.Fprintf(w, "dpx_start_timestamp_seconds %d\n", s.start.Unix())
+}
+
+// counters copy
+func (m *Metrics) snapshot() *Metrics {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+
+    s := &Metrics{
+        query:          make(map[queryLabels]uint64, len(m.query)),
+        cacheHit:       m.cacheHit,
+        cacheMiss:      m.cacheMiss,
+        upstream:       make(map[string]*upstreamStat, len(m.upstream)),
+        reloadOk:       m.reloadOk,
+        reloadFail:     m.reloadFail,
+        reloadOkTime:   m.reloadOkTime,
+        reloadFailTime: m.reloadFailTime,
+        worker:         m.worker,
+        start:          m.start,
+    }
+
+    for k, n := range m.query {
+        s.query[k] = n
+    }
+
+    for n, u := range m.upstream {
+        c := *u
+        c.bucket = append([]uint64{}, u.bucket...)
+        s.upstream[n] = &c
+    }
+
+    return s
+}
+
+func metricHead(w io.Writer, name, t, help string) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, t)
+}
+
+func timeOrEmpty(t time.Time) string {
+    if t.IsZero() {
+        return ""
+    }
+
+    return t.Format(time.RFC3339)
+}
+
+func unixOrZero(t time.Time) int64 {
+    if t.IsZero() {
+        return 0
+    }
+
+    return t.Unix()
+}
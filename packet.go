@@ -2,7 +2,11 @@ package main
 
 import (
     "fmt"
+    "net"
+    "strconv"
     "strings"
+    "errors"
+    "encoding/binary"
 )
 
 
@@ -69,6 +73,24 @@ func TypeString(i int) string {
     return RequestTypeString(i)
 }
 
+// type by name (A, AAAA, ...) or number
+// 0 when unknown
+func TypeFromString(s string) int {
+    s = strings.ToUpper(s)
+
+    for _, t := range []int{A, NS, CNAME, SOA, PTR, MX, TXT, AAAA, SRV} {
+        if RequestTypeString(t) == s {
+            return t
+        }
+    }
+
+    if i, err := strconv.Atoi(s); err == nil && i > 0 && i < 1<<16 {
+        return i
+    }
+
+    return 0
+}
+
 // deprecated, move to TypeString(i)
 func RequestTypeString(i int) string {
     var s string
@@ -80,12 +102,39 @@ func RequestTypeString(i int) string {
     case PTR:   s = "PTR"
     case MX:    s = "MX"
     case AAAA:  s = "AAAA"
+    case NS:    s = "NS"
+    case TXT:   s = "TXT"
+    case SRV:   s = "SRV"
+    case OPT:   s = "OPT"
+    case TSIG:  s = "TSIG"
+    case TYPE_ANY: s = "ANY"
     default:    s = fmt.Sprintf("not-yet-implemented(%d)", i)
     }
 
     return s
 }
 
+func RcodeString(i int) string {
+    var s string
+
+    switch i {
+    case NOERROR:  s = "NOERROR"
+    case FMTERROR: s = "FORMERR"
+    case SERVFAIL: s = "SERVFAIL"
+    case NXDOMAIN: s = "NXDOMAIN"
+    case NOTIMP:   s = "NOTIMP"
+    case REFUSED:  s = "REFUSED"
+    case YXDOMAIN: s = "YXDOMAIN"
+    case YXRRSET:  s = "YXRRSET"
+    case NXRRSET:  s = "NXRRSET"
+    case NOTAUTH:  s = "NOTAUTH"
+    case NOTZONE:  s = "NOTZONE"
+    default:       s = fmt.Sprintf("RCODE%d", i)
+    }
+
+    return s
+}
+
 
 //
 // Response
@@ -218,3 +267,464 @@ func readLabel(i int, b []byte) (int, string) {
 
     return j, lbl
 }
+
+
+//
+// Message
+// generic wire format parser/packer, used where
+// the pre-built cache answers are not enough
+// (validating upstream responses, rewriting etc)
+
+type MsgQuestion struct {
+    name string
+    t int
+    class int
+}
+
+type MsgRR struct {
+    name string
+    t int
+    class int
+    ttl uint32
+
+    // rdata with any names uncompressed
+    data []byte
+}
+
+type Msg struct {
+    id int
+    flags int
+
+    question []MsgQuestion
+    answer []MsgRR
+    authority []MsgRR
+    additional []MsgRR
+}
+
+var errMsgShort = errors.New("Message truncated")
+
+func ParseMsg(b []byte) (*Msg, error) {
+    if len(b) < HEADER_LEN {
+        return nil, errMsgShort
+    }
+
+    m := &Msg{
+        id:    int(binary.BigEndian.Uint16(b[0:])),
+        flags: int(binary.BigEndian.Uint16(b[2:])),
+    }
+
+    qd := int(binary.BigEndian.Uint16(b[4:]))
+    an := int(binary.BigEndian.Uint16(b[6:]))
+    ns := int(binary.BigEndian.Uint16(b[8:]))
+    ar := int(binary.BigEndian.Uint16(b[10:]))
+
+    i := HEADER_LEN
+    for j:=0; j<qd; j++ {
+        name, n, err := unpackName(b, i)
+        if err != nil {
+            return nil, err
+        }
+
+        i = n
+        if i+4 > len(b) {
+            return nil, errMsgShort
+        }
+
+        m.question = append(m.question, MsgQuestion{
+            name,
+            int(binary.BigEndian.Uint16(b[i:])),
+            int(binary.BigEndian.Uint16(b[i+2:])),
+        })
+        i += 4
+    }
+
+    var err error
+    for _, s := range []struct{ rr *[]MsgRR; n int }{{&m.answer, an}, {&m.authority, ns}, {&m.additional, ar}} {
+        for j:=0; j<s.n; j++ {
+            var r MsgRR
+            r, i, err = unpackRR(b, i)
+            if err != nil {
+                return nil, err
+            }
+
+            *s.rr = append(*s.rr, r)
+        }
+    }
+
+    return m, nil
+}
+
+func unpackRR(b []byte, i int) (MsgRR, int, error) {
+    name, i, err := unpackName(b, i)
+    if err != nil {
+        return MsgRR{}, 0, err
+    }
+
+    // type(2), class(2), ttl(4), length(2)
+    if i+10 > len(b) {
+        return MsgRR{}, 0, errMsgShort
+    }
+
+    r := MsgRR{
+        name:  name,
+        t:     int(binary.BigEndian.Uint16(b[i:])),
+        class: int(binary.BigEndian.Uint16(b[i+2:])),
+        ttl:   binary.BigEndian.Uint32(b[i+4:]),
+    }
+
+    l := int(binary.BigEndian.Uint16(b[i+8:]))
+    i += 10
+
+    if i+l > len(b) {
+        return MsgRR{}, 0, errMsgShort
+    }
+
+    r.data, err = unpackRdata(b, r.t, i, l)
+    if err != nil {
+        return MsgRR{}, 0, err
+    }
+
+    return r, i+l, nil
+}
+
+// rdata names may be compressed (pointing anywhere in the message)
+// expand them so that the record can be moved into another message
+func unpackRdata(b []byte, t, i, l int) ([]byte, error) {
+    // fixed length prefix before the name
+    var pre int
+
+    switch t {
+    case CNAME, PTR, NS:
+    case MX:
+        pre = 2
+    case SRV:
+        pre = 6
+    case SOA:
+        mname, j, err := unpackName(b, i)
+        if err != nil {
+            return nil, err
+        }
+        rname, j, err := unpackName(b, j)
+        if err != nil {
+            return nil, err
+        }
+        // serial, refresh, retry, expire, minimum
+        if j+20 > len(b) {
+            return nil, errMsgShort
+        }
+
+        d, err := packName(mname)
+        if err != nil {
+            return nil, err
+        }
+        r, err := packName(rname)
+        if err != nil {
+            return nil, err
+        }
+
+        d = append(d, r...)
+        return append(d, b[j:j+20]...), nil
+
+    default:
+        return append([]byte{}, b[i:i+l]...), nil
+    }
+
+    if pre > l {
+        return nil, errMsgShort
+    }
+
+    name, _, err := unpackName(b, i+pre)
+    if err != nil {
+        return nil, err
+    }
+
+    n, err := packName(name)
+    if err != nil {
+        return nil, err
+    }
+
+    return append(append([]byte{}, b[i:i+pre]...), n...), nil
+}
+
+// reads (possibly compressed) name at index i, returns
+// dotted name (no root dot) and index right after the name
+func unpackName(b []byte, i int) (string, int, error) {
+    lbl := make([]string, 0)
+    end := -1
+
+    // pointer loop protection
+    jumps := 0
+
+    for {
+        if i >= len(b) {
+            return "", 0, errMsgShort
+        }
+
+        l := int(b[i])
+        switch {
+        case l == 0:
+            if end < 0 {
+                end = i+1
+            }
+
+            return strings.Join(lbl, "."), end, nil
+
+        case l&LABEL_POINTER == LABEL_POINTER:
+            if i+1 >= len(b) {
+                return "", 0, errMsgShort
+            }
+            if end < 0 {
+                end = i+2
+            }
+
+            jumps++
+            if jumps > MAX_POINTERS {
+                return "", 0, errors.New("Message label pointer loop")
+            }
+
+            i = (l&^LABEL_POINTER)<<8 | int(b[i+1])
+
+        case l&LABEL_POINTER != 0:
+            return "", 0, fmt.Errorf("Unsupported label type: %d", l)
+
+        default:
+            if i+1+l > len(b) {
+                return "", 0, errMsgShort
+            }
+
+            lbl = append(lbl, string(b[i+1:i+1+l]))
+            i += 1+l
+        }
+    }
+}
+
+// uncompressed wire format of name
+func packName(name string) ([]byte, error) {
+    name = enddot.ReplaceAllString(name, "")
+    if name == "" {
+        return []byte{0}, nil
+    }
+
+    b := make([]byte, 0, len(name)+2)
+    for _, l := range strings.Split(name, ".") {
+        if len(l) == 0 || len(l) > 63 {
+            return nil, fmt.Errorf("Invalid label in: %s", name)
+        }
+
+        b = append(b, byte(len(l)))
+        b = append(b, l...)
+    }
+
+    if len(b) > 254 {
+        return nil, fmt.Errorf("Name too long: %s", name)
+    }
+
+    return append(b, 0), nil
+}
+
+// packs the message, owner names are compressed
+// rdata is written as is (uncompressed)
+func (m *Msg) Pack() ([]byte, error) {
+    b := make([]byte, HEADER_LEN, PACKET_SIZE)
+
+    binary.BigEndian.PutUint16(b[0:], uint16(m.id))
+    binary.BigEndian.PutUint16(b[2:], uint16(m.flags))
+    binary.BigEndian.PutUint16(b[4:], uint16(len(m.question)))
+    binary.BigEndian.PutUint16(b[6:], uint16(len(m.answer)))
+    binary.BigEndian.PutUint16(b[8:], uint16(len(m.authority)))
+    binary.BigEndian.PutUint16(b[10:], uint16(len(m.additional)))
+
+    comp := make(map[string]int)
+
+    var err error
+    for _, q := range m.question {
+        b, err = appendName(b, q.name, comp)
+        if err != nil {
+            return nil, err
+        }
+
+        b = binary.BigEndian.AppendUint16(b, uint16(q.t))
+        b = binary.BigEndian.AppendUint16(b, uint16(q.class))
+    }
+
+    for _, s := range [][]MsgRR{m.answer, m.authority, m.additional} {
+        for _, r := range s {
+            b, err = appendName(b, r.name, comp)
+            if err != nil {
+                return nil, err
+            }
+
+            b = binary.BigEndian.AppendUint16(b, uint16(r.t))
+            b = binary.BigEndian.AppendUint16(b, uint16(r.class))
+            b = binary.BigEndian.AppendUint32(b, r.ttl)
+            b = binary.BigEndian.AppendUint16(b, uint16(len(r.data)))
+            b = append(b, r.data...)
+        }
+    }
+
+    return b, nil
+}
+
+func appendName(b []byte, name string, comp map[string]int) ([]byte, error) {
+    // validate first
+    if _, err := packName(name); err != nil {
+        return nil, err
+    }
+
+    name = enddot.ReplaceAllString(name, "")
+    if name == "" {
+        return append(b, 0), nil
+    }
+
+    lbl := strings.Split(name, ".")
+    for j := range lbl {
+        l := strings.Join(lbl[j:], ".")
+
+        if x, ok := comp[l]; ok {
+            return binary.BigEndian.AppendUint16(b, uint16(LABEL_POINTER<<8|x)), nil
+        }
+
+        // pointers are 14 bits
+        if len(b) < 1<<14 {
+            comp[l] = len(b)
+        }
+
+        b = append(b, byte(len(lbl[j])))
+        b = append(b, lbl[j]...)
+    }
+
+    return append(b, 0), nil
+}
+
+func (m *Msg) rcode() int       { return m.flags & RCODE_MASK }
+func (m *Msg) opcode() int      { return (m.flags >> 11) & 0xf }
+func (m *Msg) response() bool   { return m.flags&FLAG_QR != 0 }
+func (m *Msg) truncated() bool  { return m.flags&FLAG_TC != 0 }
+func (m *Msg) setRcode(i int)   { m.flags = m.flags&^RCODE_MASK | i }
+
+// target name of a record pointing to another name
+// empty if record does not have one
+func (r MsgRR) target() string {
+    var i int
+
+    switch r.t {
+    case CNAME, PTR, NS:
+    case MX:
+        i = 2
+    case SRV:
+        i = 6
+    default:
+        return ""
+    }
+
+    if i >= len(r.data) {
+        return ""
+    }
+
+    n, _, err := unpackName(r.data, i)
+    if err != nil {
+        return ""
+    }
+
+    return n
+}
+
+// is name equal to or below zone
+func inZone(name, zone string) bool {
+    name = strings.ToLower(enddot.ReplaceAllString(name, ""))
+    zone = strings.ToLower(enddot.ReplaceAllString(zone, ""))
+
+    if zone == "" || name == zone {
+        return true
+    }
+
+    return strings.HasSuffix(name, "."+zone)
+}
+
+// response to query carrying only rcode, question as per query
+func RcodeResponse(query []byte, rcode int) ([]byte, error) {
+    q, err := ParseMsg(query)
+    if err != nil {
+        return nil, err
+    }
+
+    m := &Msg{
+        id:       q.id,
+        flags:    FLAG_QR | q.flags&(FLAG_RD|OPCODE_MASK) | FLAG_RA | rcode,
+        question: q.question,
+    }
+
+    return m.Pack()
+}
+
+// header + question only with TC set
+// client is expected to retry over TCP
+func Truncate(b []byte) ([]byte, error) {
+    m, err := ParseMsg(b)
+    if err != nil {
+        return nil, err
+    }
+
+    m.flags |= FLAG_TC
+    m.answer, m.authority, m.additional = nil, nil, nil
+
+    return m.Pack()
+}
+
+// presentation format of rdata
+func (r MsgRR) DataString() string {
+    d := r.data
+
+    switch r.t {
+    case A, AAAA:
+        if (r.t == A && len(d) == 4) || (r.t == AAAA && len(d) == 16) {
+            return net.IP(d).String()
+        }
+
+    case CNAME, PTR, NS:
+        if n := r.target(); n != "" {
+            return n + "."
+        }
+
+    case MX:
+        if n := r.target(); n != "" {
+            return fmt.Sprintf("%d %s.", binary.BigEndian.Uint16(d), n)
+        }
+
+    case SRV:
+        if n := r.target(); n != "" {
+            return fmt.Sprintf("%d %d %d %s.", binary.BigEndian.Uint16(d), binary.BigEndian.Uint16(d[2:]), binary.BigEndian.Uint16(d[4:]), n)
+        }
+
+    case TXT:
+        txt := make([]string, 0)
+        for i:=0; i<len(d); {
+            l := int(d[i])
+            if i+1+l > len(d) {
+                break
+            }
+
+            txt = append(txt, strconv.Quote(string(d[i+1:i+1+l])))
+            i += 1+l
+        }
+
+        return strings.Join(txt, " ")
+
+    case SOA:
+        mname, i, err := unpackName(d, 0)
+        if err != nil {
+            break
+        }
+        rname, i, err := unpackName(d, i)
+        if err != nil || i+20 > len(d) {
+            break
+        }
+
+        return fmt.Sprintf("%s. %s. %d %d %d %d %d", mname, rname,
+            binary.BigEndian.Uint32(d[i:]), binary.BigEndian.Uint32(d[i+4:]), binary.BigEndian.Uint32(d[i+8:]),
+            binary.BigEndian.Uint32(d[i+12:]), binary.BigEndian.Uint32(d[i+16:]))
+    }
+
+    // unknown (RFC 3597)
+    return fmt.Sprintf("\\# %d %x", len(d), d)
+}
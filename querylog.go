@@ -0,0 +1,128 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "net/netip"
+    "encoding/json"
+)
+
+// Query log, one JSON object per query.
+// Separate from the (operational) server log.
+//
+// Client IP can be anonymized by keeping only the network
+// part (prefix) of the address, port is then dropped too.
+
+type QueryLog struct {
+    // file or stdout
+    out *LogFile
+
+    // anonymize client ip
+    anon bool
+    prefix4 int
+    prefix6 int
+}
+
+type queryLogEntry struct {
+    Time      string   `json:"time"`
+    Client    string   `json:"client"`
+    Port      int      `json:"port,omitempty"`
+    Transport string   `json:"transport"`
+    Id        int      `json:"id"`
+    Qname     string   `json:"qname"`
+    Qtype     string   `json:"qtype"`
+    Source    string   `json:"source"`
+    Upstream  string   `json:"upstream,omitempty"`
+    Rcode     string   `json:"rcode"`
+    Answers   []string `json:"answers,omitempty"`
+    Duration  float64  `json:"duration_ms"`
+    Error     string   `json:"error,omitempty"`
+}
+
+func NewQueryLog(path string, anon bool, p4, p6 int) (*QueryLog, error) {
+    lf, err := openLogFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    return &QueryLog{out: lf, anon: anon, prefix4: p4, prefix6: p6}, nil
+}
+
+// nil query log is off
+func (q *QueryLog) Log(query, answer []byte, client net.Addr, transport, source, upstream string, err error, d time.Duration) {
+    if q == nil {
+        return
+    }
+
+    e := queryLogEntry{
+        Time:      time.Now().Format(time.RFC3339Nano),
+        Transport: transport,
+        Id:        bytesToInt(query[:2]),
+        Qname:     Question(query),
+        Qtype:     RequestTypeString(RequestType(query)),
+        Source:    source,
+        Upstream:  upstream,
+        Rcode:     "dropped",
+        Duration:  float64(d.Microseconds()) / 1000,
+    }
+
+    if ip, ok := clientIP(client); ok {
+        e.Client, e.Port = q.clientString(ip, client)
+    } else {
+        e.Client = client.String()
+    }
+
+    if err != nil {
+        e.Error = err.Error()
+    }
+
+    if answer != nil {
+        if m, err := ParseMsg(answer); err == nil {
+            e.Rcode = RcodeString(m.rcode())
+            for _, r := range m.answer {
+                e.Answers = append(e.Answers, fmt.Sprintf("%s. %d %s %s", r.name, r.ttl, RequestTypeString(r.t), r.DataString()))
+            }
+        }
+    }
+
+    b, err := json.Marshal(e)
+    if err != nil {
+        sCrit.Printf("Query log failed: %s", err.Error())
+        return
+    }
+
+    if _, err := q.out.Write(append(b, '\n')); err != nil {
+        sCrit.Printf("Query log write failed: %s", err.Error())
+    }
+}
+
+// ip (or network when anonymized) and port
+func (q *QueryLog) clientString(ip netip.Addr, client net.Addr) (string, int) {
+    if q.anon {
+        bits := q.prefix6
+        if ip.Is4() {
+            bits = q.prefix4
+        }
+
+        if p, err := ip.Prefix(bits); err == nil {
+            return p.Addr().String(), 0
+        }
+    }
+
+    port := 0
+    switch a := client.(type) {
+    case *net.UDPAddr: port = a.Port
+    case *net.TCPAddr: port = a.Port
+    }
+
+    return ip.String(), port
+}
+
+func (q *QueryLog) Close() {
+    if q == nil {
+        return
+    }
+
+    q.out.Close()
+}
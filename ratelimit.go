@@ -0,0 +1,388 @@
+package main
+
+import (
+    "net"
+    "net/netip"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Per client (source prefix) query limits and Response Rate Limiting (RRL).
+//
+// Queries over the per prefix rate are dropped before any processing.
+// Responses are limited per prefix + question + response kind, which is what
+// gets (ab)used in reflection attacks from spoofed sources. Limited responses
+// are dropped except every 'slip'th which is sent back truncated (TC=1)
+// so that a real client can still retry over TCP.
+// Sources over RATELIMIT_MAX_CLIENTS (tracked prefixes or response buckets)
+// share one bucket until idle ones are dropped, limited all together.
+
+type RateLimit struct {
+    // queries per second per prefix, 0 = off
+    qps int
+    burst int
+
+    // responses per second, 0 = off
+    rrl int
+    slip int
+
+    // client prefix length
+    prefix4 int
+    prefix6 int
+
+    // max response size over UDP, 0 = off
+    udpSize int
+
+    // not limited
+    exempt []netip.Prefix
+
+    // max queries being processed per worker
+    inflight int
+
+    mux sync.Mutex
+
+    // query buckets and counters per client prefix
+    client map[netip.Prefix]*rlClient
+
+    // response buckets
+    resp map[string]*rlBucket
+
+    // shared by sources over RATELIMIT_MAX_CLIENTS
+    overflow rlClient
+    overflowResp rlBucket
+
+    // stops Run, replaced on config reload
+    done chan bool
+}
+
+type rlBucket struct {
+    tokens float64
+    last time.Time
+
+    // limited responses, used for slip
+    limited int
+}
+
+type rlClient struct {
+    rlBucket
+
+    // last query
+    seen time.Time
+
+    // counters (since last log)
+    queries int
+    dropped int
+    busy int
+    rrlDropped int
+    rrlSlipped int
+    truncated int
+}
+
+func NewRateLimit(qps, burst, rrl, slip, p4, p6, udpSize, inflight int, exempt []netip.Prefix) *RateLimit {
+    if burst < qps {
+        burst = qps
+    }
+
+    return &RateLimit{
+        qps:      qps,
+        burst:    burst,
+        rrl:      rrl,
+        slip:     slip,
+        prefix4:  p4,
+        prefix6:  p6,
+        udpSize:  udpSize,
+        exempt:   exempt,
+        inflight: inflight,
+        client:   make(map[netip.Prefix]*rlClient),
+        resp:     make(map[string]*rlBucket),
+        done:     make(chan bool),
+    }
+}
+
+// take a token, refill by rate per second up to burst
+func (b *rlBucket) take(rate, burst int, now time.Time) bool {
+    if b.last.IsZero() {
+        b.tokens = float64(burst)
+    } else {
+        b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+        if b.tokens > float64(burst) {
+            b.tokens = float64(burst)
+        }
+    }
+    b.last = now
+
+    if b.tokens < 1 {
+        return false
+    }
+
+    b.tokens--
+    return true
+}
+
+func (r *RateLimit) isExempt(ip netip.Addr) bool {
+    for _, p := range r.exempt {
+        if p.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (r *RateLimit) clientPrefix(ip netip.Addr) netip.Prefix {
+    bits := r.prefix6
+    if ip.Is4() {
+        bits = r.prefix4
+    }
+
+    p, err := ip.Prefix(bits)
+    if err != nil {
+        // should not happen, prefix lengths are validated in config
+        return netip.PrefixFrom(ip, ip.BitLen())
+    }
+
+    return p
+}
+
+// must be called with lock held
+func (r *RateLimit) getClient(p netip.Prefix) *rlClient {
+    c, ok := r.client[p]
+    if !ok {
+        if len(r.client) >= RATELIMIT_MAX_CLIENTS {
+            // under heavy (likely spoofed) load
+            // new sources are limited together
+            return &r.overflow
+        }
+
+        c = &rlClient{}
+        r.client[p] = c
+    }
+
+    return c
+}
+
+// per client query limit
+// false = drop the query
+func (r *RateLimit) AllowQuery(addr net.Addr) bool {
+    ip, ok := clientIP(addr)
+    if !ok {
+        return true
+    }
+
+    r.mux.Lock()
+    defer r.mux.Unlock()
+
+    c := r.getClient(r.clientPrefix(ip))
+    c.queries++
+    c.seen = time.Now()
+    if r.qps == 0 || r.isExempt(ip) {
+        return true
+    }
+
+    if !c.take(r.qps, r.burst, time.Now()) {
+        c.dropped++
+        return false
+    }
+
+    return true
+}
+
+// record query dropped because the worker is too busy
+func (r *RateLimit) Busy(addr net.Addr) {
+    ip, ok := clientIP(addr)
+    if !ok {
+        return
+    }
+
+    r.mux.Lock()
+    defer r.mux.Unlock()
+
+    r.getClient(r.clientPrefix(ip)).busy++
+}
+
+// Response rate limit and UDP size limit.
+// Returns answer to send back (possibly truncated) or nil to drop.
+func (r *RateLimit) Response(addr net.Addr, answer []byte) []byte {
+    ip, ok := clientIP(addr)
+    if !ok || len(answer) < HEADER_LEN {
+        return answer
+    }
+
+    exempt := r.isExempt(ip)
+    p := r.clientPrefix(ip)
+
+    if r.rrl > 0 && !exempt {
+        key := p.String() + "/" + rrlKey(answer)
+
+        r.mux.Lock()
+        b, ok := r.resp[key]
+        if !ok {
+            b = &r.overflowResp
+            if len(r.resp) < RATELIMIT_MAX_CLIENTS {
+                b = &rlBucket{}
+                r.resp[key] = b
+            }
+        }
+
+        limited := !b.take(r.rrl, r.rrl, time.Now())
+        slip := false
+        if limited {
+            b.limited++
+            slip = r.slip > 0 && b.limited%r.slip == 0
+
+            c := r.getClient(p)
+            if slip {
+                c.rrlSlipped++
+            } else {
+                c.rrlDropped++
+            }
+        }
+        r.mux.Unlock()
+
+        if limited {
+            if !slip {
+                return nil
+            }
+
+            tc, err := Truncate(answer)
+            if err != nil {
+                return nil
+            }
+
+            return tc
+        }
+    }
+
+    if r.udpSize > 0 && len(answer) > r.udpSize && !exempt {
+        tc, err := Truncate(answer)
+        if err != nil {
+            return answer
+        }
+
+        r.mux.Lock()
+        r.getClient(p).truncated++
+        r.mux.Unlock()
+
+        return tc
+    }
+
+    return answer
+}
+
+// question + kind of response
+// (positive, nxdomain/nodata, error)
+func rrlKey(answer []byte) string {
+    kind := "ok"
+    switch int(answer[3]) & RCODE_MASK {
+    case NOERROR:
+        if bytesToInt(answer[6:8]) == 0 {
+            kind = "nodata"
+        }
+    case NXDOMAIN:
+        kind = "nx"
+    default:
+        kind = "err"
+    }
+
+    return strings.ToLower(Question(answer)) + "/" + kind
+}
+
+// Drops idle buckets and logs client counters
+// every 'interval' seconds (0 = no logging).
+func (r *RateLimit) Run(interval int) {
+    clean := time.NewTicker(RATELIMIT_CLEAN * time.Second)
+    defer clean.Stop()
+
+    lastLog := time.Now()
+    for {
+        var now time.Time
+        select {
+        case <-r.done:
+            return
+        case now = <-clean.C:
+        }
+
+        r.mux.Lock()
+        for k, b := range r.resp {
+            if now.Sub(b.last) > RATELIMIT_IDLE*time.Second {
+                delete(r.resp, k)
+            }
+        }
+
+        if interval > 0 && now.Sub(lastLog) >= time.Duration(interval)*time.Second {
+            r.logClients()
+            lastLog = now
+        }
+
+        // keep counters until logged
+        for k, c := range r.client {
+            if now.Sub(c.seen) > RATELIMIT_IDLE*time.Second && (interval == 0 || c.queries == 0) {
+                delete(r.client, k)
+            }
+        }
+        r.mux.Unlock()
+    }
+}
+
+func (r *RateLimit) Stop() {
+    close(r.done)
+}
+
+// must be called with lock held
+// resets the counters
+func (r *RateLimit) logClients() {
+    active := make([]netip.Prefix, 0)
+    for p, c := range r.client {
+        if c.queries > 0 {
+            active = append(active, p)
+        }
+    }
+
+    if o := &r.overflow; o.queries > 0 {
+        sWarn.Printf("Clients over %d tracked: queries: %d, dropped: %d, busy: %d, rrl dropped: %d, rrl slipped: %d, truncated: %d",
+            RATELIMIT_MAX_CLIENTS, o.queries, o.dropped, o.busy, o.rrlDropped, o.rrlSlipped, o.truncated)
+        o.queries, o.dropped, o.busy, o.rrlDropped, o.rrlSlipped, o.truncated = 0, 0, 0, 0, 0, 0
+    }
+
+    if len(active) == 0 {
+        return
+    }
+
+    sort.Slice(active, func(i, j int) bool {
+        return r.client[active[i]].queries > r.client[active[j]].queries
+    })
+
+    sInfo.Printf("== Client query counters (%d active) ==", len(active))
+    for i, p := range active {
+        c := r.client[p]
+        if i < RATELIMIT_LOG_TOP || c.dropped+c.busy+c.rrlDropped+c.rrlSlipped+c.truncated > 0 {
+            sInfo.Printf("Client %s: queries: %d, dropped: %d, busy: %d, rrl dropped: %d, rrl slipped: %d, truncated: %d",
+                p.String(), c.queries, c.dropped, c.busy, c.rrlDropped, c.rrlSlipped, c.truncated)
+        }
+
+        c.queries, c.dropped, c.busy, c.rrlDropped, c.rrlSlipped, c.truncated = 0, 0, 0, 0, 0, 0
+    }
+}
+
+// ip of client connection
+func clientIP(a net.Addr) (netip.Addr, bool) {
+    var ip net.IP
+
+    switch v := a.(type) {
+    case *net.UDPAddr:
+        ip = v.IP
+    case *net.TCPAddr:
+        ip = v.IP
+    default:
+        return netip.Addr{}, false
+    }
+
+    ap, ok := netip.AddrFromSlice(ip)
+    if !ok {
+        return netip.Addr{}, false
+    }
+
+    return ap.Unmap(), true
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Local resource record, one line of an .rr file
+//
+// host value [flags]
+//
+//   host.domain   10.0.0.1         [ptr] [ttl:N] [expire:<RFC3339>]
+//   host.domain   fd00::1          [ptr]
+//   alias.domain  host.domain      cname
+//   host.domain   mail.domain      mx
+//   host.domain   "some text"      txt
+//   1.0.0.10.in-addr.arpa  host.domain  ptr
+//   host.domain   nxdomain
+//
+// host without '.' gets the default domain appended.
+
+const RR_NXDOMAIN = "nxdomain"
+
+type Record struct {
+    host string
+
+    // ip, hostname (cname, mx, ptr), text or nxdomain
+    value string
+
+    // flags
+    ptr bool
+    cname bool
+    mx bool
+    txt bool
+
+    // zero = does not expire
+    expire time.Time
+
+    // file:line or admin
+    src string
+}
+
+var rTTL = regexp.MustCompile(`^ttl\:\d+$`)
+
+func parseRecord(line, domain string) (*Record, error) {
+    sl, err := recordColumns(line)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", err.Error(), line)
+    }
+
+    // require at least 2 columns
+    if len(sl) < 2 {
+        return nil, fmt.Errorf("Invalid resource record line: %s", line)
+    }
+
+    r := &Record{host: defaultDomain(sl[0], domain), value: sl[1]}
+
+    // check hostname
+    if !rHost.MatchString(r.host) {
+        return nil, fmt.Errorf("Invalid hostname: %s", r.host)
+    }
+
+    if rIp4.MatchString(r.host) {
+        return nil, fmt.Errorf("Invalid host (looks to be IP?): %s", line)
+    }
+
+    if r.value == RR_NXDOMAIN {
+        if len(sl) > 2 {
+            return nil, fmt.Errorf("Flags do not make sense with NXDOMAIN: %s", line)
+        }
+
+        return r, nil
+    }
+
+    // flags/options
+    for _, f := range sl[2:] {
+        switch {
+        case f == "ptr":    r.ptr = true
+        case f == "cname":  r.cname = true
+        case f == "mx":     r.mx = true
+        case f == "txt":    r.txt = true
+        case rTTL.MatchString(f):
+            // TODO ttl, accepted but not used
+        case strings.HasPrefix(f, "expire:"):
+            t, err := time.Parse(time.RFC3339, strings.TrimPrefix(f, "expire:"))
+            if err != nil {
+                return nil, fmt.Errorf("Invalid expire: %s", line)
+            }
+            r.expire = t
+        default:
+            return nil, fmt.Errorf("Unknown flag(s): %s", line)
+        }
+    }
+
+    if r.txt {
+        if r.ptr || r.cname || r.mx {
+            return nil, fmt.Errorf("Invalid definition: TXT with other flags: %s", line)
+        }
+
+        if len(r.value) > TXT_MAX {
+            return nil, fmt.Errorf("TXT too long (max %d): %s", TXT_MAX, line)
+        }
+
+        return r, nil
+    }
+
+    if r.ptr && r.cname {
+        return nil, fmt.Errorf("Invalid definition: PTR+CNAME: %s", line)
+    }
+
+    if r.mx && r.ptr {
+        return nil, fmt.Errorf("Invalid definition: MX+PTR: %s", line)
+    }
+
+    if r.mx && r.cname {
+        return nil, fmt.Errorf("Invalid definition: MX+CNAME: %s", line)
+    }
+
+    ip := rIp4.MatchString(r.value) || rIp6.MatchString(r.value)
+    switch {
+    case ip && r.cname:
+        return nil, fmt.Errorf("Invalid definition: %s+CNAME: %s", r.Type(), line)
+    case ip && r.mx:
+        return nil, fmt.Errorf("Invalid definition: MX needs hostname: %s", line)
+    case !ip && r.ptr && !isArpa(r.host):
+        return nil, fmt.Errorf("Invalid definition: PTR needs in-addr.arpa/ip6.arpa host: %s", line)
+    case !ip && !r.cname && !r.mx && !r.ptr:
+        return nil, fmt.Errorf("Invalid value (not an IP, no cname/mx/ptr flag): %s", line)
+    }
+
+    // cname, mx, ptr target
+    if !ip {
+        r.value = defaultDomain(r.value, domain)
+        if !rHost.MatchString(r.value) {
+            return nil, fmt.Errorf("Invalid hostname: %s", r.value)
+        }
+    }
+
+    return r, nil
+}
+
+// host value [flags], value may be "quoted"
+func recordColumns(line string) ([]string, error) {
+    line = strings.TrimSpace(line)
+
+    sl := make([]string, 0, 3)
+    for line != "" {
+        c := line
+        if line[0] == '"' && len(sl) == 1 {
+            q, err := strconv.QuotedPrefix(line)
+            if err != nil {
+                return nil, errors.New("Invalid quoted value")
+            }
+
+            c = q
+            line = line[len(q):]
+            if c, err = strconv.Unquote(c); err != nil {
+                return nil, errors.New("Invalid quoted value")
+            }
+        } else {
+            if i := strings.IndexAny(line, " \t"); i >= 0 {
+                c, line = line[:i], line[i:]
+            } else {
+                line = ""
+            }
+        }
+
+        sl = append(sl, c)
+        line = strings.TrimLeft(line, " \t")
+    }
+
+    return sl, nil
+}
+
+func isArpa(h string) bool {
+    return strings.HasSuffix(h, ".in-addr.arpa") || strings.HasSuffix(h, ".ip6.arpa")
+}
+
+// add default domain if needed
+func defaultDomain(h, domain string) string {
+    if strings.Contains(h, ".") {
+        return h
+    }
+
+    return h + "." + domain
+}
+
+func (r *Record) Type() string {
+    switch {
+    case r.txt:                      return "TXT"
+    case r.value == RR_NXDOMAIN:     return "NXDOMAIN"
+    case r.cname:                    return "CNAME"
+    case r.mx:                       return "MX"
+    case rIp4.MatchString(r.value):  return "A"
+    case rIp6.MatchString(r.value):  return "AAAA"
+    case r.ptr:                      return "PTR"
+    }
+
+    return "AAAA"
+}
+
+func (r *Record) expired(now time.Time) bool {
+    return !r.expire.IsZero() && !now.Before(r.expire)
+}
+
+// name and type answered by the record
+// nxdomain is answered as A
+func (r *Record) conflictKey() string {
+    if r.value == RR_NXDOMAIN {
+        return r.host + " A"
+    }
+
+    return r.host + " " + r.Type()
+}
+
+// the same host and value
+func (r *Record) same(o *Record) bool {
+    if r.host != o.host || r.Type() != o.Type() {
+        return false
+    }
+
+    if r.Type() == "AAAA" {
+        return ipv6Maximize(r.value) == ipv6Maximize(o.value)
+    }
+
+    return r.value == o.value
+}
+
+// .rr file line
+func (r *Record) String() string {
+    s := r.host + " " + r.value
+    if r.txt {
+        s = r.host + " " + strconv.Quote(r.value) + " txt"
+    }
+    if r.ptr {
+        s += " ptr"
+    }
+    if r.cname {
+        s += " cname"
+    }
+    if r.mx {
+        s += " mx"
+    }
+    if !r.expire.IsZero() {
+        s += " expire:" + r.expire.UTC().Format(time.RFC3339)
+    }
+
+    return s
+}
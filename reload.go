@@ -0,0 +1,366 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "time"
+    "errors"
+    "io/fs"
+    "strconv"
+    "reflect"
+    "strings"
+)
+
+//
+// Config reload (SIGHUP, dpxctl reload-config)
+//
+// Config file is read again and the differences applied live:
+// listeners (workers) started and stopped, upstreams, access
+// control, rate limits, query log, proxy mode, dns64, rewrites and
+// logs swapped.
+// Unchanged workers keep serving, new ones are bound (SO_REUSEPORT)
+// before the old ones are closed, so no queries are dropped.
+//
+// Invalid config, listener that cannot be bound or log file that
+// cannot be opened leaves everything as it was.
+// New listeners are bound as the service user: listener changes
+// with port below ip_unprivileged_port_start or another TCP socket
+// on address listened on (SO_REUSEPORT of the same user only) are
+// not applied (needs restart), the rest of config is.
+//
+// Record sources (rr.dir, admin, updates, leases), views, control
+// socket and metrics are set up once, changing them needs restart.
+
+func (s *Server) reloadConfig() (err error) {
+    // config parsing panics on some errors
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("%v", r)
+        }
+    }()
+
+    if !s.serving {
+        return fmt.Errorf("Server is starting")
+    }
+
+    n, warn, err := newCfg(s.cfg.config)
+    if err != nil {
+        return err
+    }
+
+    if s.stdout {
+        n.logsTo(STDOUT)
+    }
+
+    for _, w := range warn {
+        sWarn.Print(w)
+    }
+
+    for _, o := range s.restartNeeded(n) {
+        sWarn.Printf("Config changed, needs restart: %s", o)
+    }
+
+    o := s.cfg
+    cur := s.res.Load()
+
+    // log files opened up front, shared with
+    // the current ones when the same
+    for _, f := range n.logs() {
+        if f == n.queryLog {
+            continue
+        }
+
+        if _, _, _, err := logTarget(f, LOG_INFO, logServer); err != nil {
+            CloseLogFiles(o.logs())
+            return logOpenError(f, err)
+        }
+    }
+
+    // upstreams, recreated only when changed
+    // (tls connections are kept open)
+    var up4, up6 []Upstream
+    if upstreamConfig(o) != upstreamConfig(n) {
+        if up4, err = n.upstreams4(); err == nil {
+            up6, err = n.upstreams6()
+        }
+
+        if err != nil {
+            CloseLogFiles(o.logs())
+            return err
+        }
+    }
+
+    // client counters are kept when unchanged
+    rl := cur.limit
+    if rateLimitConfig(o) != rateLimitConfig(n) {
+        rl = NewRateLimit(n.rlQps, n.rlBurst, n.rlRrl, n.rlSlip, n.rlPrefix4, n.rlPrefix6, n.rlUdpSize, n.workerInflight, n.rlExempt)
+    }
+
+    qlog := cur.qlog
+    if queryLogConfig(o) != queryLogConfig(n) {
+        qlog = nil
+        if n.queryLog != "" {
+            if qlog, err = NewQueryLog(n.queryLog, n.qlAnon, n.qlPrefix4, n.qlPrefix6); err != nil {
+                CloseLogFiles(o.logs())
+                return logOpenError(n.queryLog, err)
+            }
+        }
+    }
+
+    // first TLS or HTTPS listener
+    certs := s.certs
+    if certs == nil && n.needsCerts() {
+        if certs, err = NewCertStore(n.tlsCert, n.tlsKey); err != nil {
+            CloseLogFiles(o.logs())
+            return err
+        }
+    }
+
+    // workers of unchanged listeners are kept
+    specs := workerSpecs(n)
+    kept := make([]bool, len(s.spec))
+    add := make([]workerSpec, 0)
+    for _, sp := range specs {
+        found := false
+        for i, old := range s.spec {
+            if !kept[i] && old == sp {
+                kept[i] = true
+                found = true
+                break
+            }
+        }
+
+        if !found {
+            add = append(add, sp)
+        }
+    }
+
+    // listeners left as they are
+    if l := unbindable(add, s.spec); len(l) > 0 {
+        sWarn.Printf("Config changed, needs restart: listeners (%s), running kept", strings.Join(l, ", "))
+        add = add[:0]
+        for i := range kept {
+            kept[i] = true
+        }
+    }
+
+    // new workers get their inflight limit from the resolver
+    // (old ones keep theirs), swapped back should any of them fail
+    res := NewResolver(s.cache, n.proxy, NewACL(n.aclQuery, n.aclRecursion, n.aclAction == ACL_DROP), rl, qlog, s.update, s.views, n.dns64(), n.rewrite())
+    s.res.Store(res)
+
+    started := make([]Worker, 0, len(add))
+    for _, sp := range add {
+        w, err := s.startWorker(sp, n, certs)
+        if err != nil {
+            s.res.Store(cur)
+            for _, w := range started {
+                w.Close()
+            }
+
+            CloseLogFiles(o.logs())
+            return err
+        }
+
+        go w.ServeDNS()
+        sInfo.Worker(w.Id()).Printf("Listener #%d accepting %s connections on %s", w.Id()+1, w.Type(), w.ListenAddr().String())
+        started = append(started, w)
+    }
+
+    //
+    // commit, nothing fails from here on
+
+    if up4 != nil {
+        s.pool4.Set(up4)
+        s.pool6.Set(up6)
+        s.upstream = append(append([]Upstream{}, up4...), up6...)
+        sInfo.Printf("Proxy dialer v4: %s", strings.Join(n.remoteNetConnString4(), ", "))
+        sInfo.Printf("Proxy dialer v6: %s", strings.Join(n.remoteNetConnString6(), ", "))
+    }
+
+    if rl != cur.limit {
+        cur.limit.Stop()
+        go rl.Run(n.rlLog)
+    }
+
+    // replaced query log, unless its file stays in use (shared
+    // by path), queries in processing writing to it get an error
+    if qlog != cur.qlog && cur.qlog != nil {
+        shared := false
+        for _, f := range n.logs() {
+            if f == cur.qlog.out.path {
+                shared = true
+            }
+        }
+
+        if !shared {
+            cur.qlog.Close()
+        }
+    }
+
+    if certs != s.certs {
+        go certs.Watch()
+        s.certs = certs
+    }
+
+    // graceful, queries in processing are answered
+    workers := make([]Worker, 0, len(specs))
+    spec := make([]workerSpec, 0, len(specs))
+    for i, w := range s.worker {
+        if kept[i] {
+            workers = append(workers, w)
+            spec = append(spec, s.spec[i])
+            continue
+        }
+
+        sInfo.Worker(w.Id()).Printf("Listener #%d closing %s on %s", w.Id()+1, w.Type(), w.ListenAddr().String())
+        w.Close()
+    }
+
+    s.worker = append(workers, started...)
+    s.spec = append(spec, add...)
+    metrics.SetWorkers(s.worker)
+
+    // logs
+    SetLogRotate(n.logRotateSize, time.Duration(n.logRotateAge) * time.Hour, n.logRotateKeep, n.logRotateCompress)
+    for _, l := range []struct{ o, n string; h []Logger }{
+        {o.serverLog, n.serverLog, []Logger{sInfo, sWarn, sCrit, sDebg, sTrce}},
+        {o.cacheLog, n.cacheLog, []Logger{cInfo, cWarn, cCrit, cDebg, cTrce}},
+        {o.upstreamLog, n.upstreamLog, []Logger{uInfo, uWarn, uCrit, uDebg, uTrce}},
+        {o.workerLog, n.workerLog, []Logger{wInfo, wWarn, wCrit, wDebg, wTrce}},
+        {o.blocklistLog, n.blocklistLog, []Logger{bInfo, bWarn, bCrit, bDebg, bTrce}},
+    } {
+        if l.o != l.n {
+            // opened above
+            SetHandles(l.n, l.h...)
+        }
+    }
+
+    SetLogLevels(n.logLevel, n.logLevels)
+    CloseLogFiles(n.logs())
+
+    s.cfg = n
+
+    sInfo.Printf("Config reloaded: %s", n.config)
+    sInfo.Printf("Proxy: %v", n.proxy)
+    if d := n.dns64(); d != nil {
+        sInfo.Printf("DNS64: %s", d.String())
+    }
+    if len(n.rewriteRules) > 0 || len(n.safeSearch) > 0 {
+        sInfo.Printf("Rewrite rules: %d, safe search: %s", len(n.rewriteRules), strings.Join(n.safeSearch, ", "))
+    }
+    sInfo.Printf("Listeners: %d started, %d stopped, %d total", len(started), len(kept)-len(spec), len(s.worker))
+    sInfo.Printf("Log level: %s", logLevelsString(n.logLevel, n.logLevels))
+    return nil
+}
+
+// config changes not applied on reload
+func (s *Server) restartNeeded(n *cfg) []string {
+    type opt struct {
+        name string
+        o, n any
+    }
+
+    o := s.cfg
+    opts := []opt{
+        {"rr.dir", o.rrDir, n.rrDir},
+        {"hosts.files", o.hostsFiles, n.hostsFiles},
+        {"rr.conflict", o.rrConflict, n.rrConflict},
+        {"rr.priority", o.rrPriority, n.rrPriority},
+        {"cache.update", o.cacheUpdate, n.cacheUpdate},
+        {"default.domain", o.defaultDomain, n.defaultDomain},
+        // of running workers
+        {"worker.inflight", o.workerInflight, n.workerInflight},
+        {"control.socket", o.controlSocket, n.controlSocket},
+        {"metrics.listen", o.metricsListen, n.metricsListen},
+        {"admin.listen", o.adminListen, n.adminListen},
+        {"admin.token", o.adminToken, n.adminToken},
+        {"admin.rr", o.adminRR, n.adminRR},
+        {"update.zones", o.updateZones, n.updateZones},
+        {"update.key", o.updateKeys, n.updateKeys},
+        {"update.journal", o.updateJournal, n.updateJournal},
+        {"dhcp.leases", o.dhcpLeases, n.dhcpLeases},
+        {"dhcp.domain", o.dhcpDomain, n.dhcpDomain},
+        {"dhcp.conflict", o.dhcpConflict, n.dhcpConflict},
+        {"view.clients", o.viewClients, n.viewClients},
+        {"view.rr", o.viewRR, n.viewRR},
+        {"view.dialer.v4", o.viewDialer4, n.viewDialer4},
+        {"view.dialer.v6", o.viewDialer6, n.viewDialer6},
+    }
+
+    // certificate files are watched once loaded
+    if s.certs != nil {
+        opts = append(opts, opt{"listener.tls.cert", o.tlsCert, n.tlsCert}, opt{"listener.tls.key", o.tlsKey, n.tlsKey})
+    }
+
+    changed := make([]string, 0)
+    for _, c := range opts {
+        if !reflect.DeepEqual(c.o, c.n) {
+            changed = append(changed, c.name)
+        }
+    }
+
+    return changed
+}
+
+// listeners the service user cannot bind
+func unbindable(add, running []workerSpec) []string {
+    if os.Geteuid() == 0 {
+        return nil
+    }
+
+    start := 1024
+    if b, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+        if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+            start = n
+        }
+    }
+
+    l := make([]string, 0)
+    for _, sp := range add {
+        _, p, err := net.SplitHostPort(sp.addr)
+        if err != nil {
+            continue
+        }
+
+        if port, _ := strconv.Atoi(p); port < start {
+            l = append(l, sp.kind + " " + sp.addr + " privileged port")
+            continue
+        }
+
+        if sp.kind == LISTENER_UDP {
+            continue
+        }
+
+        for _, r := range running {
+            if r.kind != LISTENER_UDP && r.addr == sp.addr {
+                l = append(l, sp.kind + " " + sp.addr + " listened on")
+                break
+            }
+        }
+    }
+
+    return l
+}
+
+// files of root only cannot be opened once privileges are dropped
+func logOpenError(f string, err error) error {
+    if errors.Is(err, fs.ErrPermission) {
+        return fmt.Errorf("Log %s: %s (service user %s), needs restart", f, err.Error(), SERVICE_OWNER)
+    }
+
+    return fmt.Errorf("Log %s: %s", f, err.Error())
+}
+
+func upstreamConfig(c *cfg) string {
+    return fmt.Sprint(c.dialer4, c.dialer6, c.caseRand, c.bailiwick, c.tlsCA, c.tlsPin, c.tlsIdle, c.httpsGet, c.httpsTimeout)
+}
+
+func rateLimitConfig(c *cfg) string {
+    return fmt.Sprint(c.rlQps, c.rlBurst, c.rlRrl, c.rlSlip, c.rlPrefix4, c.rlPrefix6, c.rlUdpSize, c.rlExempt, c.rlLog, c.workerInflight)
+}
+
+func queryLogConfig(c *cfg) string {
+    return fmt.Sprint(c.queryLog, c.qlAnon, c.qlPrefix4, c.qlPrefix6)
+}
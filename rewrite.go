@@ -0,0 +1,260 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "regexp"
+    "net/netip"
+)
+
+//
+// Name rewrite (rewrite, safesearch)
+//
+// Query name matching a rule (exact, suffix or regex, first rule
+// in config order wins) is answered by the rule:
+//   cname:name      CNAME to name, followed through local records
+//                   or upstream (proxy on) for the query type
+//   a:ip,...        A records (other types get no records)
+//   aaaa:ip,...     AAAA records
+//   nxdomain        NXDOMAIN
+// Rewrites go before local records, except NXDOMAIN ones (names
+// blocked locally are not unblocked by a rule), targets are not
+// rewritten again.
+// Safe search profiles are rules of the restricted endpoints,
+// after the configured ones.
+
+type RewriteRule struct {
+    kind string
+    pattern string
+    rx *regexp.Regexp
+
+    action string
+    target string
+    ips [][]byte
+
+    // as configured
+    rule string
+}
+
+type Rewrite struct {
+    rules []*RewriteRule
+}
+
+// google ccTLDs, youtube restricted mode (strict), bing strict
+var safeSearch = map[string][]string{
+    SAFESEARCH_GOOGLE: {
+        `regex:^(www\.)?google\.(com|[a-z]{2}|co\.[a-z]{2}|com\.[a-z]{2})$->cname:forcesafesearch.google.com`,
+    },
+    SAFESEARCH_YOUTUBE: {
+        "exact:www.youtube.com->cname:restrict.youtube.com",
+        "exact:m.youtube.com->cname:restrict.youtube.com",
+        "exact:youtubei.googleapis.com->cname:restrict.youtube.com",
+        "exact:youtube.googleapis.com->cname:restrict.youtube.com",
+        "exact:www.youtube-nocookie.com->cname:restrict.youtube.com",
+    },
+    SAFESEARCH_BING: {
+        "exact:www.bing.com->cname:strict.bing.com",
+        "exact:bing.com->cname:strict.bing.com",
+    },
+}
+
+func NewRewrite(rules []*RewriteRule) *Rewrite {
+    return &Rewrite{rules}
+}
+
+// kind:pattern->action[:value]
+func NewRewriteRule(s string) (*RewriteRule, error) {
+    i := strings.LastIndex(s, REWRITE_ARROW)
+    if i < 0 {
+        return nil, fmt.Errorf("must be kind:pattern%saction[:value]: %s", REWRITE_ARROW, s)
+    }
+
+    m, a := s[:i], s[i+len(REWRITE_ARROW):]
+    r := &RewriteRule{rule: s}
+
+    var ok bool
+    r.kind, r.pattern, ok = strings.Cut(m, ":")
+    if !ok || r.pattern == "" {
+        return nil, fmt.Errorf("must be kind:pattern%saction[:value]: %s", REWRITE_ARROW, s)
+    }
+
+    switch r.kind {
+    case REWRITE_EXACT, REWRITE_SUFFIX:
+        r.pattern = strings.ToLower(enddot.ReplaceAllString(r.pattern, ""))
+        if !rHost.MatchString(r.pattern) {
+            return nil, fmt.Errorf("invalid name: %s", r.pattern)
+        }
+
+    case REWRITE_REGEX:
+        rx, err := regexp.Compile(r.pattern)
+        if err != nil {
+            return nil, fmt.Errorf("invalid regex: %s", err.Error())
+        }
+        r.rx = rx
+
+    default:
+        return nil, fmt.Errorf("unknown kind (%s, %s, %s): %s", REWRITE_EXACT, REWRITE_SUFFIX, REWRITE_REGEX, r.kind)
+    }
+
+    r.action, r.target, _ = strings.Cut(a, ":")
+    switch r.action {
+    case REWRITE_CNAME:
+        r.target = strings.ToLower(enddot.ReplaceAllString(r.target, ""))
+        if r.target == "" || !rHost.MatchString(r.target) {
+            return nil, fmt.Errorf("invalid cname target: %s", r.target)
+        }
+
+    case REWRITE_A, REWRITE_AAAA:
+        for _, v := range strings.Split(r.target, ",") {
+            ip, err := netip.ParseAddr(v)
+            if err != nil || ip.Is4() != (r.action == REWRITE_A) {
+                return nil, fmt.Errorf("invalid %s: %s", strings.ToUpper(r.action), v)
+            }
+
+            r.ips = append(r.ips, ip.AsSlice())
+        }
+
+    case REWRITE_NXDOMAIN:
+        if r.target != "" {
+            return nil, fmt.Errorf("nxdomain takes no value: %s", r.target)
+        }
+
+    default:
+        return nil, fmt.Errorf("unknown action (%s, %s, %s, %s): %s", REWRITE_CNAME, REWRITE_A, REWRITE_AAAA, REWRITE_NXDOMAIN, r.action)
+    }
+
+    return r, nil
+}
+
+// rules of safe search profile
+func SafeSearchRules(profile string) ([]*RewriteRule, error) {
+    rs, ok := safeSearch[profile]
+    if !ok {
+        return nil, fmt.Errorf("unknown profile (%s, %s, %s): %s", SAFESEARCH_GOOGLE, SAFESEARCH_YOUTUBE, SAFESEARCH_BING, profile)
+    }
+
+    rules := make([]*RewriteRule, 0, len(rs))
+    for _, s := range rs {
+        r, err := NewRewriteRule(s)
+        if err != nil {
+            // this should not happen
+            panic(err)
+        }
+
+        rules = append(rules, r)
+    }
+
+    return rules, nil
+}
+
+// first matching rule, nil = none
+func (w *Rewrite) Match(name string) *RewriteRule {
+    if w == nil {
+        return nil
+    }
+
+    name = strings.ToLower(enddot.ReplaceAllString(name, ""))
+    for _, r := range w.rules {
+        if r.match(name) {
+            return r
+        }
+    }
+
+    return nil
+}
+
+func (r *RewriteRule) match(name string) bool {
+    switch r.kind {
+    case REWRITE_EXACT:
+        return name == r.pattern
+    case REWRITE_SUFFIX:
+        return inZone(name, r.pattern)
+    case REWRITE_REGEX:
+        return r.rx.MatchString(name)
+    }
+
+    return false
+}
+
+func (r *RewriteRule) String() string {
+    return r.rule
+}
+
+//
+// Query processing
+
+// answer of the rule, CNAME target asked locally
+// then upstream when allowed
+func (r *Resolver) rewrite(query []byte, rule *RewriteRule, view *View, dialer Upstream, upstream bool, wid int) []byte {
+    qm, err := ParseMsg(query)
+    if err != nil || len(qm.question) != 1 {
+        return nil
+    }
+
+    q := qm.question[0]
+    m := &Msg{
+        id:       qm.id,
+        flags:    FLAG_QR | qm.flags&(FLAG_RD|OPCODE_MASK) | FLAG_RA,
+        question: qm.question,
+    }
+
+    switch rule.action {
+    case REWRITE_NXDOMAIN:
+        m.setRcode(NXDOMAIN)
+
+    case REWRITE_A, REWRITE_AAAA:
+        t := A
+        if rule.action == REWRITE_AAAA {
+            t = AAAA
+        }
+
+        if q.t == t {
+            for _, ip := range rule.ips {
+                m.answer = append(m.answer, MsgRR{q.name, t, IN, TTL, ip})
+            }
+        }
+
+    case REWRITE_CNAME:
+        target, err := packName(rule.target)
+        if err != nil {
+            return nil
+        }
+        m.answer = append(m.answer, MsgRR{q.name, CNAME, IN, TTL, target})
+
+        if q.t == CNAME {
+            break
+        }
+
+        tq := requery(query, rule.target, q.t)
+        if tq == nil {
+            break
+        }
+
+        t := localAnswer(tq, view.records(r.cache, rule.target))
+        if t == nil && upstream {
+            t = upstreamAnswer(tq, dialer, wid)
+        }
+
+        // client follows the CNAME itself
+        if t == nil {
+            break
+        }
+
+        tm, err := ParseMsg(t)
+        if err != nil {
+            break
+        }
+
+        m.answer = append(m.answer, tm.answer...)
+        m.authority = tm.authority
+        m.setRcode(tm.rcode())
+    }
+
+    b, err := m.Pack()
+    if err != nil {
+        wCrit.Worker(wid).Printf("#%d: Failed to create rewrite answer: %s", wid, err.Error())
+        return nil
+    }
+
+    return b
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+    "time"
+    "strings"
+    "io/fs"
+    "path/filepath"
+    "encoding/binary"
+    "golang.org/x/sys/unix"
+)
+
+//
+// RR files watcher (cache.update = on-rr-file-change)
+//
+// inotify on rr.dir, view dirs, their subdirs and dirs of hosts files.
+// Editors save in several steps (temp file, rename, chmod) so
+// events are debounced, then rr.dir is scanned again for .rr
+// files (added, removed, renamed) and cache reloaded.
+
+type RRWatcher struct {
+    fd int
+
+    // watched dirs by watch descriptor
+    dirs map[int32]string
+
+    conf *cfg
+    cache *Cache
+    views []*View
+}
+
+const RR_WATCH_EVENTS = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_CREATE |
+                        unix.IN_DELETE | unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+func NewRRWatcher(conf *cfg, c *Cache, views []*View) (*RRWatcher, error) {
+    fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+    if err != nil {
+        return nil, err
+    }
+
+    w := &RRWatcher{fd, make(map[int32]string), conf, c, views}
+    for _, d := range w.roots() {
+        if err := w.addTree(d); err != nil {
+            unix.Close(fd)
+            return nil, err
+        }
+    }
+
+    for _, f := range conf.hostsFiles {
+        if err := w.add(filepath.Dir(f)); err != nil {
+            unix.Close(fd)
+            return nil, err
+        }
+    }
+
+    return w, nil
+}
+
+func (w *RRWatcher) add(dir string) error {
+    for _, d := range w.dirs {
+        if d == dir {
+            return nil
+        }
+    }
+
+    wd, err := unix.InotifyAddWatch(w.fd, dir, RR_WATCH_EVENTS | unix.IN_ONLYDIR)
+    if err != nil {
+        return &fs.PathError{Op: "inotify", Path: dir, Err: err}
+    }
+
+    w.dirs[int32(wd)] = dir
+    return nil
+}
+
+// dir and its subdirs
+func (w *RRWatcher) addTree(dir string) error {
+    return filepath.WalkDir(filepath.Clean(dir), func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+
+        if d.IsDir() {
+            return w.add(path)
+        }
+
+        return nil
+    })
+}
+
+// blocking
+func (w *RRWatcher) Watch() {
+    sInfo.Printf("Watching RR files: %s", strings.Join(w.watched(), ", "))
+
+    ev := make(chan string, RR_WATCH_QUEUE)
+    go w.read(ev)
+
+    var debounce <-chan time.Time
+    for {
+        select {
+        case path := <-ev:
+            if sDebg.On() {
+                sDebg.Printf("RR files event: %s", path)
+            }
+
+            // wait for quiet
+            debounce = time.After(RR_WATCH_DEBOUNCE * time.Millisecond)
+
+        case <-debounce:
+            debounce = nil
+            w.reload()
+        }
+    }
+}
+
+func (w *RRWatcher) watched() []string {
+    d := make([]string, 0, len(w.dirs))
+    for _, dir := range w.dirs {
+        d = append(d, dir)
+    }
+
+    return d
+}
+
+func (w *RRWatcher) reload() {
+    rf, err := w.conf.rrFiles()
+    if err != nil {
+        // keep answering as is
+        sCrit.Printf("Could not read RR files: %s", err.Error())
+    } else {
+        w.cache.SetFiles(rf)
+        w.cache.Reload()
+    }
+
+    for _, v := range w.views {
+        if err := v.reload(w.conf); err != nil {
+            sCrit.Printf("Could not reload view %s: %s", v.name, err.Error())
+        }
+    }
+}
+
+// rr.dir and view dirs
+func (w *RRWatcher) roots() []string {
+    d := []string{filepath.Clean(w.conf.rrDir)}
+    for _, v := range w.views {
+        if v.dir != "" {
+            d = append(d, v.dir)
+        }
+    }
+
+    return d
+}
+
+// inotify events of relevant files
+func (w *RRWatcher) read(ev chan<- string) {
+    buf := make([]byte, RR_WATCH_BUFFER)
+    for {
+        n, err := unix.Read(w.fd, buf)
+        if err != nil {
+            if err == unix.EINTR {
+                continue
+            }
+
+            sCrit.Printf("RR files watcher stopped: %s", err.Error())
+            return
+        }
+
+        for i := 0; i+unix.SizeofInotifyEvent <= n; {
+            wd := int32(binary.NativeEndian.Uint32(buf[i:]))
+            mask := binary.NativeEndian.Uint32(buf[i+4:])
+            l := int(binary.NativeEndian.Uint32(buf[i+12:]))
+
+            name := strings.TrimRight(string(buf[i+unix.SizeofInotifyEvent:i+unix.SizeofInotifyEvent+l]), "\x00")
+            i += unix.SizeofInotifyEvent + l
+
+            if mask&unix.IN_Q_OVERFLOW != 0 {
+                sWarn.Print("RR files watcher: events lost, reloading")
+                ev <- ""
+                continue
+            }
+
+            dir, ok := w.dirs[wd]
+            if !ok {
+                continue
+            }
+
+            // watched dir removed
+            if mask&unix.IN_IGNORED != 0 {
+                delete(w.dirs, wd)
+                for _, r := range w.roots() {
+                    if dir == r {
+                        sCrit.Printf("RR dir removed, no longer watched: %s", dir)
+                    }
+                }
+
+                ev <- dir
+                continue
+            }
+
+            if mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+                continue
+            }
+
+            path := filepath.Join(dir, name)
+            if w.relevant(path, mask) {
+                ev <- path
+            }
+        }
+    }
+}
+
+func (w *RRWatcher) relevant(path string, mask uint32) bool {
+    inRR := false
+    for _, r := range w.roots() {
+        if strings.HasPrefix(path, r + "/") {
+            inRR = true
+        }
+    }
+
+    if mask&unix.IN_ISDIR != 0 {
+        if !inRR {
+            return false
+        }
+
+        // new subdir, may already have files
+        if mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+            if err := w.addTree(path); err != nil {
+                sCrit.Printf("Could not watch: %s", err.Error())
+            }
+        }
+
+        return mask&(unix.IN_CREATE|unix.IN_MOVED_TO|unix.IN_DELETE|unix.IN_MOVED_FROM) != 0
+    }
+
+    for _, f := range w.conf.hostsFiles {
+        if path == filepath.Clean(f) {
+            return true
+        }
+    }
+
+    return inRR && w.conf.rrFile(path)
+}
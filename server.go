@@ -1,6 +1,7 @@
 package main
 
 import (
+    "fmt"
     "net"
     "time"
     "syscall"
@@ -8,19 +9,20 @@ import (
     // golang.org -> cmd/vendor/golang.org
     "golang.org/x/sys/unix"
     "strings"
-    "path/filepath"
     "os"
     "os/signal"
     "os/user"
     "strconv"
+    "sync"
+    "sync/atomic"
 )
 
-// debug
-var debug bool
-
-// server, cache log
-var sInfo, sWarn, sCrit, sDebg Logger
-var cInfo, cWarn, cCrit, cDebg Logger
+// server, cache, upstream, worker, blocklist log
+var sInfo, sWarn, sCrit, sDebg, sTrce Logger
+var cInfo, cWarn, cCrit, cDebg, cTrce Logger
+var uInfo, uWarn, uCrit, uDebg, uTrce Logger
+var wInfo, wWarn, wCrit, wDebg, wTrce Logger
+var bInfo, bWarn, bCrit, bDebg, bTrce Logger
 
 
 //
@@ -35,56 +37,99 @@ type Server struct {
 
     // socket config
     netcfg net.ListenConfig
+
+    // local records
+    cache *Cache
+
+    // server certificate, nil = no tls listeners
+    certs *CertStore
+
+    // all upstreams, v4 and v6
+    upstream []Upstream
+
+    // dpxctl, nil = off
+    control *Control
+
+    // query processing, shared by workers
+    // swapped on config reload
+    res atomic.Pointer[Resolver]
+
+    // predeclared empty packets
+    packeter chan []byte
+
+    // upstream dialers
+    pool4 *UpstreamPool
+    pool6 *UpstreamPool
+
+    // config of each worker (same order)
+    spec []workerSpec
+
+    // next worker id
+    nextId int
+
+    // CLI overwrites config file
+    stdout bool
+
+    // dynamic updates, nil = off
+    update *Updater
+
+    // split horizon views
+    views []*View
+
+    // workers accepting (privileges dropped)
+    serving bool
+
+    // config reload, shutdown
+    mux sync.Mutex
 }
 
-func NewServer(config string, stdout bool) Server {
+// listener config of a worker
+// workers are restarted on config reload when changed
+type workerSpec struct {
+    kind string
+    net string
+    addr string
+
+    // http(s)
+    trusted string
+    json bool
+}
+
+func NewServer(config string, stdout bool) *Server {
     conf, warn, err := newCfg(config)
     if err != nil {
         panic(err)
     }
 
-    // global debug
-    debug = conf.debug
-
     // CLI overwrites config file
     if stdout {
-        conf.serverLog = STDOUT
-        conf.cacheLog = STDOUT
+        conf.logsTo(STDOUT)
     }
 
-    cInfo, cWarn, cCrit, cDebg = NewHandles(conf.cacheLog)
-    sInfo, sWarn, sCrit, sDebg = NewHandles(conf.serverLog)
+    SetLogRotate(conf.logRotateSize, time.Duration(conf.logRotateAge) * time.Hour, conf.logRotateKeep, conf.logRotateCompress)
+    SetLogLevels(conf.logLevel, conf.logLevels)
+    cInfo, cWarn, cCrit, cDebg, cTrce = NewHandles(conf.cacheLog, logCache)
+    sInfo, sWarn, sCrit, sDebg, sTrce = NewHandles(conf.serverLog, logServer)
+    uInfo, uWarn, uCrit, uDebg, uTrce = NewHandles(conf.upstreamLog, logUpstream)
+    wInfo, wWarn, wCrit, wDebg, wTrce = NewHandles(conf.workerLog, logWorker)
+    bInfo, bWarn, bCrit, bDebg, bTrce = NewHandles(conf.blocklistLog, logBlocklist)
 
     // RR files
-    // must be world readable otherwise 'nobody' will not
-    // be able to stat() the files for changes
-
-    // don't capture (returned) err from filepath.Walk
-    // as we panic() on all errors
-
-    rf := make([]string, 0)
-    filepath.Walk(conf.rrDir, func(path string, fi os.FileInfo, err error) error {
-        // this can only happen when rr.dir
-        // does not exist
-        if fi == nil {
-            panic("Cannot find: " + path)
-        }
-
-        // check first then work with .rr files here
-        // for that reason panic() is not expected on newFstat()
-        if !fi.IsDir() {
-            if ok := rrx.MatchString(path); ok {
-                fs := newFstat(path)
-                if !fs.worldReadable() {
-                    panic("Must be world readable: " + fs.path)
-                }
+    rf, err := conf.rrFiles()
+    if err != nil {
+        panic(err)
+    }
 
-                rf = append(rf, path)
-            }
+    // hosts files, the same as RR files
+    for _, f := range conf.hostsFiles {
+        fs := newFstat(f)
+        if !fs.exists() {
+            panic("Cannot find: " + f)
         }
-
-        return nil
-    })
+        if !fs.worldReadable() {
+            panic("Must be world readable: " + f)
+        }
+    }
 
     if warn != nil {
         sWarn.Printf("== Server Configuration Warning ==")
@@ -105,6 +150,22 @@ func NewServer(config string, stdout bool) Server {
         sInfo.Printf("Listener v6: %s", strings.Join(conf.localNetConnString6(), ", "))
     }
 
+    if len(conf.listenerTLS) > 0 {
+        sInfo.Printf("Listener TLS: %s (cert: %s, key: %s)", strings.Join(hostStrings(conf.listenerTLS), ", "), conf.tlsCert, conf.tlsKey)
+    }
+
+    if len(conf.listenerHTTPS) > 0 {
+        sInfo.Printf("Listener HTTPS: %s (cert: %s, key: %s)", strings.Join(hostStrings(conf.listenerHTTPS), ", "), conf.tlsCert, conf.tlsKey)
+    }
+
+    if len(conf.listenerHTTP) > 0 {
+        sInfo.Printf("Listener HTTP: %s", strings.Join(hostStrings(conf.listenerHTTP), ", "))
+    }
+
+    if len(conf.listenerHTTPS) > 0 || len(conf.listenerHTTP) > 0 {
+        sInfo.Printf("Listener HTTP(S) JSON API: %v, trusted proxies: %s", conf.httpsJSON, prefixString(conf.httpsTrusted))
+    }
+
     sInfo.Printf("Proxy: %v", conf.proxy)
 
     if conf.proxy {
@@ -114,20 +175,84 @@ func NewServer(config string, stdout bool) Server {
         if conf.validNet6() {
             sInfo.Printf("Proxy dialer v6: %s", strings.Join(conf.remoteNetConnString6(), ", "))
         }
+        sInfo.Printf("Proxy 0x20: %v", conf.caseRand)
+        sInfo.Printf("Proxy bailiwick: %v", conf.bailiwick)
     }
     sInfo.Printf("UDP Workers: %d", conf.workerUDP)
     sInfo.Printf("TCP Workers: %d", conf.workerTCP)
+    sInfo.Printf("Worker inflight queries: %d", conf.workerInflight)
+    sInfo.Printf("Rate limit qps: %d (burst: %d), rrl: %d (slip: %d), prefix v4/v6: /%d, /%d", conf.rlQps, conf.rlBurst, conf.rlRrl, conf.rlSlip, conf.rlPrefix4, conf.rlPrefix6)
+    sInfo.Printf("Rate limit UDP response size: %d", conf.rlUdpSize)
+    if len(conf.rlExempt) > 0 {
+        sInfo.Printf("Rate limit exempt: %s", prefixString(conf.rlExempt))
+    }
+    if len(conf.aclQuery) > 0 {
+        sInfo.Printf("ACL query: %s", prefixString(conf.aclQuery))
+    }
+    if len(conf.aclRecursion) > 0 {
+        sInfo.Printf("ACL recursion: %s", prefixString(conf.aclRecursion))
+    }
+    sInfo.Printf("ACL action: %s", conf.aclAction)
     sInfo.Printf("Resource records (rr) files: %s", strings.Join(rf, ", "))
+    if len(conf.hostsFiles) > 0 {
+        sInfo.Printf("Hosts files: %s", strings.Join(conf.hostsFiles, ", "))
+    }
+    if d := conf.dns64(); d != nil {
+        sInfo.Printf("DNS64: %s", d.String())
+    }
+    for _, r := range conf.rewriteRules {
+        sInfo.Printf("Rewrite: %s", r.String())
+    }
+    if len(conf.safeSearch) > 0 {
+        sInfo.Printf("Safe search: %s", strings.Join(conf.safeSearch, ", "))
+    }
+    sInfo.Printf("RR conflict: %s", conf.rrConflict)
+    if len(conf.rrPriority) > 0 {
+        sInfo.Printf("RR priority: %s", strings.Join(conf.rrPriorityString(), ", "))
+    }
     sInfo.Printf("Cache update: %s", conf.cacheUpdate)
     sInfo.Printf("Default domain: %s", conf.defaultDomain)
     sInfo.Printf("Server log: %s", conf.serverLog)
     sInfo.Printf("Cache log: %s", conf.cacheLog)
-    sInfo.Printf("Debug: %v", conf.debug)
+    if conf.logRotateSize > 0 || conf.logRotateAge > 0 {
+        sInfo.Printf("Log rotate size: %d, age: %dh, keep: %d, compress: %v", conf.logRotateSize, conf.logRotateAge, conf.logRotateKeep, conf.logRotateCompress)
+    }
+    if conf.queryLog != "" {
+        sInfo.Printf("Query log: %s (anonymize: %v, prefix v4/v6: /%d, /%d)", conf.queryLog, conf.qlAnon, conf.qlPrefix4, conf.qlPrefix6)
+    }
+    if conf.metricsListen != "" {
+        sInfo.Printf("Metrics: http://%s/metrics", conf.metricsListen)
+    }
+    if conf.controlSocket != CONTROL_OFF {
+        sInfo.Printf("Control socket: %s", conf.controlSocket)
+    }
+    if conf.adminListen != "" {
+        ar := conf.adminRR
+        if ar == "" {
+            ar = "memory only"
+        }
+        sInfo.Printf("Admin API: http://%s/records (records: %s)", conf.adminListen, ar)
+    }
+    if len(conf.updateZones) > 0 {
+        uj := conf.updateJournal
+        if uj == "" {
+            uj = "memory only"
+        }
+        sInfo.Printf("Dynamic updates: %s (journal: %s)", strings.Join(conf.updateZones, ", "), uj)
+    }
+    for f, format := range conf.dhcpLeases {
+        sInfo.Printf("DHCP leases: %s (%s, conflict: %s)", f, format, conf.dhcpConflict)
+    }
+    sInfo.Printf("Upstream log: %s", conf.upstreamLog)
+    sInfo.Printf("Worker log: %s", conf.workerLog)
+    sInfo.Printf("Blocklist log: %s", conf.blocklistLog)
+    sInfo.Printf("Log level: %s", logLevelsString(conf.logLevel, conf.logLevels))
 
 	// listeners (local)
-    srv := Server{
+    srv := &Server{
         worker: make([]Worker, 0),
         cfg:    conf,
+        stdout: stdout,
         netcfg: net.ListenConfig{
             Control: func (net, addr string, c syscall.RawConn) error {
                 return c.Control(func(fd uintptr) {
@@ -147,107 +272,196 @@ func NewServer(config string, stdout bool) Server {
         },
     }
 
-    cache := NewCache(conf.defaultDomain, rf)
-    if debug {
+    cache := NewCache(conf.defaultDomain, rf, conf.hostsFiles, conf.rrConflict, conf.rrPriority)
+    srv.cache = cache
+
+    // records managed over admin API
+    var admin *Admin
+    if conf.adminListen != "" {
+        d, err := NewDynamicRecords(ADMIN_SOURCE, conf.adminRR, conf.defaultDomain)
+        if err != nil {
+            panic(err)
+        }
+
+        if err := cache.AddDynamic(d); err != nil {
+            panic(err)
+        }
+
+        admin = NewAdmin(cache, d, conf.adminToken, conf.defaultDomain)
+    }
+
+    // records changed by dynamic updates
+    if len(conf.updateZones) > 0 {
+        d, err := NewDynamicJournal(UPDATE_SOURCE, conf.updateJournal, conf.defaultDomain)
+        if err != nil {
+            panic(err)
+        }
+
+        if err := cache.AddDynamic(d); err != nil {
+            panic(err)
+        }
+
+        srv.update = NewUpdater(cache, d, conf.updateZones, conf.updateKeys, conf.defaultDomain)
+    }
+
+    // records of DHCP leases, memory only
+    if len(conf.dhcpLeases) > 0 {
+        d, err := NewDynamicRecords(DHCP_SOURCE, "", conf.defaultDomain)
+        if err != nil {
+            panic(err)
+        }
+
+        if err := cache.AddDynamic(d); err != nil {
+            panic(err)
+        }
+
+        dom := conf.dhcpDomain
+        if dom == "" {
+            dom = conf.defaultDomain
+        }
+
+        // bad lease file does not stop dns
+        l := NewLeases(cache, d, conf.dhcpLeases, dom, conf.dhcpConflict)
+        if err := l.Load(); err != nil {
+            sCrit.Print("Could not load DHCP leases: " + err.Error())
+        }
+        go l.Watch()
+    }
+
+    // views, records layered over the above
+    views, err := NewViews(conf)
+    if err != nil {
+        panic(err)
+    }
+    srv.views = views
+    for _, v := range views {
+        sInfo.Printf("View %s", v.String())
+    }
+
+    if cDebg.On() {
         cache.Dump()
     }
 
     // dialers (remote)
 	// these channels need to be started even if proxy is off
 	// as each request attempts to read from them, see ServeDNS()
-    d4 := make(chan string, DIALER_PREP_Q_SIZE)
-    d6 := make(chan string, DIALER_PREP_Q_SIZE)
-	go func(d chan string) {
-		for {
-			d <- srv.cfg.remoteNetConnDialer4()
-		}
-	}(d4)
-
-	go func(d chan string) {
-		for {
-			d <- srv.cfg.remoteNetConnDialer6()
-		}
-	}(d6)
+    // upstreams are long lived
+    // (tls keeps connection open)
+    up4, err := conf.upstreams4()
+    if err != nil {
+        panic(err)
+    }
+    up6, err := conf.upstreams6()
+    if err != nil {
+        panic(err)
+    }
+    srv.upstream = append(append(srv.upstream, up4...), up6...)
+    srv.pool4 = NewUpstreamPool(up4)
+    srv.pool6 = NewUpstreamPool(up6)
 
     // packeter
-    packeter := make(chan []byte, PACKET_PREP_Q_SIZE)
+    srv.packeter = make(chan []byte, PACKET_PREP_Q_SIZE)
     go func(c chan []byte) {
         for {
             c <- make([]byte, PACKET_SIZE)
         }
-    }(packeter)
-
-    // start worker on each
-    // configured net interface
+    }(srv.packeter)
+
+    // client rate limits
+    rl := NewRateLimit(conf.rlQps, conf.rlBurst, conf.rlRrl, conf.rlSlip, conf.rlPrefix4, conf.rlPrefix6, conf.rlUdpSize, conf.workerInflight, conf.rlExempt)
+    go rl.Run(conf.rlLog)
+
+    // query processing
+    // shared by workers
+    // query log
+    var qlog *QueryLog
+    if conf.queryLog != "" {
+        qlog, err = NewQueryLog(conf.queryLog, conf.qlAnon, conf.qlPrefix4, conf.qlPrefix6)
+        if err != nil {
+            panic(err)
+        }
+    }
 
-    j := 0
-    for i:=0; i<conf.workerUDP; i++ {
-        if conf.validNet4() {
-            for _, iface := range srv.cfg.localNetConnString4() {
-                w := NewWorkerUDP()
-                err := w.Start4(srv.netcfg, iface, srv.cfg.proxy, cache, packeter, d4, j)
-                if err != nil {
-                    panic(err)
-                }
+    srv.res.Store(NewResolver(cache, conf.proxy, NewACL(conf.aclQuery, conf.aclRecursion, conf.aclAction == ACL_DROP), rl, qlog, srv.update, srv.views, conf.dns64(), conf.rewrite()))
 
-                srv.worker = append(srv.worker, w)
-                j++
-            }
+    // server certificate
+    // shared by DoT and DoH listeners
+    if conf.needsCerts() {
+        srv.certs, err = NewCertStore(conf.tlsCert, conf.tlsKey)
+        if err != nil {
+            panic(err)
         }
 
-        if conf.validNet6() {
-            for _, iface := range srv.cfg.localNetConnString6() {
-                w := NewWorkerUDP()
-                err := w.Start6(srv.netcfg, iface, srv.cfg.proxy, cache, packeter, d6, j)
-                if err != nil {
-                    panic(err)
-                }
+        go srv.certs.Watch()
+    }
 
-                srv.worker = append(srv.worker, w)
-                j++
-            }
+    // start worker on each
+    // configured net interface
+    for _, sp := range workerSpecs(conf) {
+        w, err := srv.startWorker(sp, conf, srv.certs)
+        if err != nil {
+            panic(err)
         }
+
+        srv.worker = append(srv.worker, w)
+        srv.spec = append(srv.spec, sp)
     }
 
-    for i:=0; i<conf.workerTCP; i++ {
-        if conf.validNet4() {
-            for _, iface := range srv.cfg.localNetConnString4() {
-                w := NewWorkerTCP()
-                err := w.Start4(srv.netcfg, iface, srv.cfg.proxy, cache, packeter, d4, j)
-                if err != nil {
-                    panic(err)
-                }
+    // metrics endpoint
+    // bound before dropping privileges
+    metrics.SetWorkers(srv.worker)
+    if conf.metricsListen != "" {
+        l, err := net.Listen("tcp", conf.metricsListen)
+        if err != nil {
+            panic(err)
+        }
 
-                srv.worker = append(srv.worker, w)
-                j++
-            }
+        go metrics.Serve(l)
+    }
+
+    // admin API
+    // bound before dropping privileges
+    if admin != nil {
+        l, err := net.Listen("tcp", conf.adminListen)
+        if err != nil {
+            panic(err)
         }
 
-        if conf.validNet6() {
-            for _, iface := range srv.cfg.localNetConnString6() {
-                w := NewWorkerTCP()
-                err := w.Start6(srv.netcfg, iface, srv.cfg.proxy, cache, packeter, d6, j)
-                if err != nil {
-                    panic(err)
-                }
+        go admin.Serve(l)
+    }
 
-                srv.worker = append(srv.worker, w)
-                j++
-            }
+    // control socket (dpxctl)
+    // created before dropping privileges
+    if conf.controlSocket != CONTROL_OFF {
+        srv.control, err = NewControl(conf.controlSocket, srv)
+        if err != nil {
+            panic(err)
         }
+
+        go srv.control.Serve()
     }
 
     // signals
 
     sigch := make(chan os.Signal, 1)
-    signal.Notify(sigch, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGHUP)
+    signal.Notify(sigch, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGHUP, syscall.SIGUSR1)
 
     go func(ch chan os.Signal, c *Cache) {
         for {
             sig := <-ch
             sInfo.Printf("Received signal: %s", sig)
 
+            // log files moved away (logrotate)
+            if sig == syscall.SIGUSR1 {
+                ReopenLogs()
+                sInfo.Printf("Log files reopened")
+                continue
+            }
+
             if sig != syscall.SIGHUP {
+                // not while reloading config
+                srv.mux.Lock()
+
                 // graceful shutdown
                 for i:=0; i<len(srv.worker); i++ {
                     srv.worker[i].Close()
@@ -257,6 +471,14 @@ func NewServer(config string, stdout bool) Server {
                 // therefore it's enough to close just one of them.
                 // logger.go will correctly deal with STDOUT handles
 
+                // query log
+                srv.res.Load().qlog.Close()
+
+                // control socket
+                if srv.control != nil {
+                    srv.control.Close()
+                }
+
                 // cache logger
                 cInfo.Print("Closing cache logger handles")
                 cInfo.Close()
@@ -269,64 +491,147 @@ func NewServer(config string, stdout bool) Server {
                 os.Exit(0)
             }
 
-            // reload cache
-            // when configured so on SIGHUP
-            if srv.cfg.cacheUpdate == SERVER_RELOAD {
-                sInfo.Printf("Reloading cache as per config")
-                cache.Reload()
-            }
+            srv.reload()
         }
     }(sigch, cache)
 
     if srv.cfg.cacheUpdate == FILE_CHANGE {
-        w := make([]*fstat, len(rf))
-        for i, f := range rf {
-            w[i] = newFstat(f)
+        w, err := NewRRWatcher(srv.cfg, cache, srv.views)
+        if err != nil {
+            panic(err)
         }
 
-        // RR files watcher
-        go func(wf []*fstat, c *Cache) {
-            noise := true
-            for {
-                reload := false
-                for _, f := range wf {
-                    s := newFstat(f.path)
-                    if !s.exists() {
-                        // file disappeared, do nothing and log
-                        if noise {
-                            // this is very noisy (every second)
-                            sCrit.Printf("RR file disappeared: " + s.path)
-                            // stopping it from logging > 1
-                            noise = false
-                        }
-
-                        reload = false
-                        break
-                    }
+        go w.Watch()
+    }
 
-                    // content change tracking
-                    // purely based on change time
-                    if f.ctime != s.ctime {
-                        // file changed
-                        // update f
-                        f.copy(s)
-                        reload = true
-                    }
-                }
+    return srv
+}
 
-                if reload {
-                    c.Reload()
+// workers in start order: UDP, TCP (worker.udp, worker.tcp
+// on each listener), TLS, HTTPS, HTTP
+func workerSpecs(conf *cfg) []workerSpec {
+    sp := make([]workerSpec, 0)
+
+    for _, kind := range []string{LISTENER_UDP, LISTENER_TCP} {
+        n := conf.workerUDP
+        if kind == LISTENER_TCP {
+            n = conf.workerTCP
+        }
+
+        for i:=0; i<n; i++ {
+            if conf.validNet4() {
+                for _, iface := range conf.localNetConnString4() {
+                    sp = append(sp, workerSpec{kind: kind, net: IPv4, addr: iface})
                 }
+            }
 
-                time.Sleep(1 * time.Second)
+            if conf.validNet6() {
+                for _, iface := range conf.localNetConnString6() {
+                    sp = append(sp, workerSpec{kind: kind, net: IPv6, addr: iface})
+                }
             }
-        }(w, cache)
+        }
     }
 
-    return srv
+    // one worker per listener, connections are served concurrently
+    for _, h := range conf.listenerTLS {
+        sp = append(sp, workerSpec{kind: LISTENER_TLS, net: h.proto, addr: h.netConnString()})
+    }
+
+    for i, hs := range [][]host{conf.listenerHTTPS, conf.listenerHTTP} {
+        kind := LISTENER_HTTPS
+        if i == 1 {
+            kind = LISTENER_HTTP
+        }
+
+        for _, h := range hs {
+            sp = append(sp, workerSpec{kind, h.proto, h.netConnString(), prefixString(conf.httpsTrusted), conf.httpsJSON})
+        }
+    }
+
+    return sp
+}
+
+// bound, not accepting yet
+func (s *Server) startWorker(sp workerSpec, conf *cfg, certs *CertStore) (Worker, error) {
+    var w Worker
+    switch sp.kind {
+    case LISTENER_UDP: w = NewWorkerUDP()
+    case LISTENER_TCP: w = NewWorkerTCP()
+    case LISTENER_TLS: w = NewWorkerTLS(certs)
+    case LISTENER_HTTPS: w = NewWorkerHTTPS(certs, conf.httpsTrusted, conf.httpsJSON)
+    // plain http behind reverse proxy
+    case LISTENER_HTTP: w = NewWorkerHTTPS(nil, conf.httpsTrusted, conf.httpsJSON)
+    default:
+        return nil, fmt.Errorf("Unknown listener: %s", sp.kind)
+    }
+
+    var err error
+    switch sp.net {
+    case IPv4: err = w.Start4(s.netcfg, sp.addr, &s.res, s.packeter, s.pool4.c, s.nextId)
+    case IPv6: err = w.Start6(s.netcfg, sp.addr, &s.res, s.packeter, s.pool6.c, s.nextId)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s listener %s: %s", sp.kind, sp.addr, err.Error())
+    }
+
+    s.nextId++
+    return w, nil
+}
+
+// SIGHUP, dpxctl reload-config
+// returns the first error, the rest is reloaded anyway
+func (s *Server) reload() error {
+    s.mux.Lock()
+    defer s.mux.Unlock()
+
+    // config file, all or nothing
+    err := s.reloadConfig()
+    if err != nil {
+        sCrit.Printf("Config not reloaded, keeping the current: %s", err.Error())
+    }
+
+    // server certificate
+    if s.certs != nil {
+        sInfo.Printf("Reloading TLS certificate")
+        if e := s.certs.Reload(); e != nil && err == nil {
+            err = e
+        }
+    }
+
+    // reload cache
+    // when configured so on SIGHUP
+    if s.cfg.cacheUpdate == SERVER_RELOAD {
+        sInfo.Printf("Reloading cache as per config")
+
+        if e := s.reloadRecords(); e != nil && err == nil {
+            err = e
+        }
+    }
+
+    return err
+}
+
+// RR files added, removed, changed
+func (s *Server) reloadRecords() error {
+    rf, err := s.cfg.rrFiles()
+    if err != nil {
+        return err
+    }
+
+    s.cache.SetFiles(rf)
+    err = s.cache.Reload()
+
+    for _, v := range s.views {
+        if e := v.reload(s.cfg); e != nil && err == nil {
+            err = e
+        }
+    }
+
+    return err
 }
 
-func (s Server) Run() {
+func (s *Server) Run() {
     // drop server process privs down to nobody
     // NOTE: needs to be able to read RR files
 
@@ -363,10 +668,13 @@ func (s Server) Run() {
     }
 
     // start listening for connections
-    for i, w := range s.worker {
+    s.mux.Lock()
+    for _, w := range s.worker {
         go w.ServeDNS()
-        sInfo.Printf("Listener #%d accepting %s connections on %s", i+1, w.Type(), w.ListenAddr().String())
+        sInfo.Worker(w.Id()).Printf("Listener #%d accepting %s connections on %s", w.Id()+1, w.Type(), w.ListenAddr().String())
     }
+    s.serving = true
+    s.mux.Unlock()
 
     // keep server running
     for {
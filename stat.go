@@ -11,6 +11,7 @@ type fstat struct {
     path string
     inode uint64
     ctime int64
+    size int64
     mode uint32
     err error
 }
@@ -25,7 +26,7 @@ func newFstat(path string) *fstat {
         }
     }
 
-    return &fstat{path, st.Ino, st.Ctim.Sec, st.Mode, err}
+    return &fstat{path, st.Ino, st.Ctim.Sec, st.Size, st.Mode, err}
 }
 
 func (fs *fstat) exists() bool {
@@ -39,6 +40,7 @@ func (fs *fstat) exists() bool {
 func (fs *fstat) copy(f *fstat) {
     fs.inode = f.inode
     fs.ctime = f.ctime
+    fs.size = f.size
     fs.mode = f.mode
     fs.err = f.err
 }
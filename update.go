@@ -0,0 +1,535 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "bytes"
+    "errors"
+    "strings"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+)
+
+//
+// Dynamic updates (RFC 2136), TSIG authenticated (RFC 8945, hmac-sha256)
+//
+// Accepted for configured zones only, A/AAAA/PTR/TXT records can be
+// added and deleted. Updated records go into the cache as dynamic
+// records (on top of RR files) and are journaled to disk.
+// Unsigned updates are refused.
+
+type Updater struct {
+    cache *Cache
+
+    // records changed by updates
+    rr *DynamicRecords
+
+    // zones accepting updates
+    zones []string
+
+    // TSIG keys, by name
+    keys map[string][]byte
+
+    // default domain
+    domain string
+}
+
+// rcode of failed update
+type updateError struct {
+    rcode int
+    msg string
+}
+
+func (e *updateError) Error() string {
+    return RcodeString(e.rcode) + ": " + e.msg
+}
+
+func updateErr(rcode int, format string, v ...any) error {
+    return &updateError{rcode, fmt.Sprintf(format, v...)}
+}
+
+// TSIG record
+type tsig struct {
+    key string
+    alg string
+    signed uint64
+    fudge uint16
+    mac []byte
+    id uint16
+    err uint16
+    other []byte
+}
+
+func NewUpdater(c *Cache, rr *DynamicRecords, zones []string, keys map[string][]byte, domain string) *Updater {
+    z := make([]string, len(zones))
+    for i, n := range zones {
+        z[i] = strings.ToLower(enddot.ReplaceAllString(n, ""))
+    }
+
+    return &Updater{c, rr, z, keys, domain}
+}
+
+// UPDATE message, returns response
+// nil updater (updates not configured) is NOTIMP
+func (u *Updater) Process(query []byte, client net.Addr, wid int) []byte {
+    if u == nil {
+        return rcodeOnly(query, NOTIMP, wid)
+    }
+
+    m, err := ParseMsg(query)
+    if err != nil {
+        wWarn.Worker(wid).Printf("#%d: Update from: %s, invalid message: %s", wid, client.String(), err.Error())
+        return rcodeOnly(query, FMTERROR, wid)
+    }
+
+    // signature
+    off, t, err := readTSIG(query, m)
+    if err != nil {
+        wWarn.Worker(wid).Printf("#%d: Update from: %s, invalid TSIG: %s", wid, client.String(), err.Error())
+        return rcodeOnly(query, FMTERROR, wid)
+    }
+
+    if t == nil {
+        wWarn.Worker(wid).Printf("#%d: Update from: %s, refused: not signed", wid, client.String())
+        return rcodeOnly(query, REFUSED, wid)
+    }
+
+    // TSIG itself is not part of the update
+    m.additional = m.additional[:len(m.additional)-1]
+
+    secret, ok := u.keys[t.key]
+    if !ok || t.alg != TSIG_ALG {
+        wWarn.Worker(wid).Printf("#%d: Update from: %s, bad key: %s (%s)", wid, client.String(), t.key, t.alg)
+        return u.response(m, NOTAUTH, t, nil, TSIG_BADKEY, wid)
+    }
+
+    if !hmac.Equal(t.mac, tsigMAC(secret, nil, tsigRequest(query[:off], t.id), t)) {
+        wWarn.Worker(wid).Printf("#%d: Update from: %s, bad signature, key: %s", wid, client.String(), t.key)
+        return u.response(m, NOTAUTH, t, nil, TSIG_BADSIG, wid)
+    }
+
+    now := uint64(time.Now().Unix())
+    if now > t.signed+uint64(t.fudge) || t.signed > now+uint64(t.fudge) {
+        wWarn.Worker(wid).Printf("#%d: Update from: %s, bad time: %d (now: %d), key: %s", wid, client.String(), t.signed, now, t.key)
+        return u.response(m, NOTAUTH, t, secret, TSIG_BADTIME, wid)
+    }
+
+    rcode := NOERROR
+    if err := u.update(m); err != nil {
+        var ue *updateError
+        if errors.As(err, &ue) {
+            rcode = ue.rcode
+        } else {
+            // records don't build or save
+            rcode = SERVFAIL
+        }
+
+        wWarn.Worker(wid).Printf("#%d: Update from: %s, key: %s, zone: %s, failed: %s", wid, client.String(), t.key, Question(query), err.Error())
+    } else {
+        wInfo.Worker(wid).Printf("#%d: Update from: %s, key: %s, zone: %s, prerequisites: %d, updates: %d", wid, client.String(), t.key, Question(query), len(m.answer), len(m.authority))
+    }
+
+    return u.response(m, rcode, t, secret, 0, wid)
+}
+
+// zone, prerequisite and update sections
+// applied all or nothing
+func (u *Updater) update(m *Msg) error {
+    // zone section
+    if len(m.question) != 1 || m.question[0].t != SOA || m.question[0].class != IN {
+        return updateErr(FMTERROR, "zone section")
+    }
+
+    zone := strings.ToLower(enddot.ReplaceAllString(m.question[0].name, ""))
+    if !u.zone(zone) {
+        return updateErr(NOTAUTH, "zone not configured: %s", zone)
+    }
+
+    // update section prescan (RFC 2136, 3.4.1)
+    for _, r := range m.authority {
+        if !inZone(r.name, zone) {
+            return updateErr(NOTZONE, "%s", r.name)
+        }
+
+        switch r.class {
+        case IN:
+            if !updateType(r.t) {
+                return updateErr(REFUSED, "type not supported: %s", RequestTypeString(r.t))
+            }
+        case CLASS_ANY:
+            if r.ttl != 0 || len(r.data) != 0 {
+                return updateErr(FMTERROR, "delete rrset: %s", r.name)
+            }
+        case CLASS_NONE:
+            if r.ttl != 0 || !updateType(r.t) {
+                return updateErr(FMTERROR, "delete rr: %s", r.name)
+            }
+        default:
+            return updateErr(FMTERROR, "class: %d", r.class)
+        }
+    }
+
+    return u.cache.Change(u.rr, func(rr []*Record) ([]*Record, error) {
+        // prerequisites against all records
+        if err := u.prerequisites(m.answer, zone, u.cache.records()); err != nil {
+            return nil, err
+        }
+
+        for _, r := range m.authority {
+            name := strings.ToLower(enddot.ReplaceAllString(r.name, ""))
+
+            switch r.class {
+            case IN:
+                rec, err := u.record(r)
+                if err != nil {
+                    return nil, err
+                }
+
+                dup := false
+                for _, o := range rr {
+                    if o.same(rec) {
+                        dup = true
+                        break
+                    }
+                }
+
+                if !dup {
+                    rr = append(rr, rec)
+                }
+
+            case CLASS_ANY, CLASS_NONE:
+                var rec *Record
+                if r.class == CLASS_NONE {
+                    var err error
+                    if rec, err = u.record(r); err != nil {
+                        return nil, err
+                    }
+                }
+
+                // RR files records stay
+                n := make([]*Record, 0, len(rr))
+                for _, o := range rr {
+                    switch {
+                    case o.host != name:
+                    case rec != nil:
+                        if o.same(rec) {
+                            continue
+                        }
+                    case r.t == TYPE_ANY || o.Type() == RequestTypeString(r.t):
+                        continue
+                    }
+
+                    n = append(n, o)
+                }
+
+                rr = n
+            }
+        }
+
+        return rr, nil
+    })
+}
+
+// RFC 2136, 3.2
+func (u *Updater) prerequisites(pr []MsgRR, zone string, all []*Record) error {
+    exists := func(name string, t int) bool {
+        for _, o := range all {
+            if o.host == name && (t == TYPE_ANY || o.Type() == RequestTypeString(t)) {
+                return true
+            }
+        }
+
+        return false
+    }
+
+    for _, r := range pr {
+        name := strings.ToLower(enddot.ReplaceAllString(r.name, ""))
+
+        if r.ttl != 0 {
+            return updateErr(FMTERROR, "prerequisite ttl: %s", name)
+        }
+        if !inZone(name, zone) {
+            return updateErr(NOTZONE, "%s", name)
+        }
+
+        switch r.class {
+        case CLASS_ANY:
+            if len(r.data) != 0 {
+                return updateErr(FMTERROR, "prerequisite rdata: %s", name)
+            }
+            if !exists(name, r.t) {
+                if r.t == TYPE_ANY {
+                    return updateErr(NXDOMAIN, "%s", name)
+                }
+
+                return updateErr(NXRRSET, "%s %s", name, RequestTypeString(r.t))
+            }
+
+        case CLASS_NONE:
+            if len(r.data) != 0 {
+                return updateErr(FMTERROR, "prerequisite rdata: %s", name)
+            }
+            if exists(name, r.t) {
+                if r.t == TYPE_ANY {
+                    return updateErr(YXDOMAIN, "%s", name)
+                }
+
+                return updateErr(YXRRSET, "%s %s", name, RequestTypeString(r.t))
+            }
+
+        case IN:
+            // value dependent, each record must exist
+            rec, err := u.record(r)
+            if err != nil {
+                return updateErr(NXRRSET, "%s", err.Error())
+            }
+
+            found := false
+            for _, o := range all {
+                if o.same(rec) {
+                    found = true
+                    break
+                }
+            }
+
+            if !found {
+                return updateErr(NXRRSET, "%s", rec.String())
+            }
+
+        default:
+            return updateErr(FMTERROR, "prerequisite class: %d", r.class)
+        }
+    }
+
+    return nil
+}
+
+func (u *Updater) zone(z string) bool {
+    for _, n := range u.zones {
+        if n == z {
+            return true
+        }
+    }
+
+    return false
+}
+
+func updateType(t int) bool {
+    switch t {
+    case A, AAAA, PTR, TXT:
+        return true
+    }
+
+    return false
+}
+
+// update rr as record, validated as RR file line
+func (u *Updater) record(r MsgRR) (*Record, error) {
+    rec := &Record{host: strings.ToLower(enddot.ReplaceAllString(r.name, ""))}
+
+    switch r.t {
+    case A, AAAA:
+        if len(r.data) != 4 && len(r.data) != 16 {
+            return nil, updateErr(FMTERROR, "address: %s", rec.host)
+        }
+        rec.value = net.IP(r.data).String()
+    case PTR:
+        rec.value = strings.ToLower(r.target())
+        rec.ptr = true
+    case TXT:
+        // character strings joined
+        var b bytes.Buffer
+        for d := r.data; len(d) > 0; {
+            l := int(d[0])
+            if l+1 > len(d) {
+                return nil, updateErr(FMTERROR, "txt: %s", rec.host)
+            }
+
+            b.Write(d[1:l+1])
+            d = d[l+1:]
+        }
+        rec.value = b.String()
+        rec.txt = true
+    default:
+        return nil, updateErr(REFUSED, "type not supported: %s", RequestTypeString(r.t))
+    }
+
+    p, err := parseRecord(rec.String(), u.domain)
+    if err != nil {
+        return nil, updateErr(REFUSED, "%s", err.Error())
+    }
+
+    p.src = UPDATE_SOURCE
+    return p, nil
+}
+
+// signed (secret not nil) response
+func (u *Updater) response(m *Msg, rcode int, t *tsig, secret []byte, tsigErr uint16, wid int) []byte {
+    r := &Msg{
+        id:       m.id,
+        flags:    FLAG_QR | m.flags&OPCODE_MASK | rcode,
+        question: m.question,
+    }
+
+    b, err := r.Pack()
+    if err != nil {
+        wCrit.Worker(wid).Printf("#%d: Failed to create update response: %s", wid, err.Error())
+        return nil
+    }
+
+    rt := &tsig{key: t.key, alg: t.alg, signed: uint64(time.Now().Unix()), fudge: t.fudge, id: t.id, err: tsigErr}
+    if tsigErr == TSIG_BADTIME {
+        // server time
+        rt.other = binary.BigEndian.AppendUint64(nil, rt.signed)[2:]
+    }
+
+    if secret != nil {
+        rt.mac = tsigMAC(secret, t.mac, b, rt)
+    }
+
+    tb, err := rt.pack()
+    if err != nil {
+        wCrit.Worker(wid).Printf("#%d: Failed to create update response: %s", wid, err.Error())
+        return nil
+    }
+
+    // one more additional
+    binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+    return append(b, tb...)
+}
+
+// TSIG must be the last additional record
+// returns its offset in b and the TSIG, nil if not signed
+func readTSIG(b []byte, m *Msg) (int, *tsig, error) {
+    if len(m.additional) == 0 || m.additional[len(m.additional)-1].t != TSIG {
+        for _, r := range m.additional {
+            if r.t == TSIG {
+                return 0, nil, errors.New("TSIG not last")
+            }
+        }
+
+        return 0, nil, nil
+    }
+
+    // skip to the last record
+    i := HEADER_LEN
+    for range m.question {
+        _, n, err := unpackName(b, i)
+        if err != nil {
+            return 0, nil, err
+        }
+        i = n + 4
+    }
+
+    for j := 0; j < len(m.answer)+len(m.authority)+len(m.additional)-1; j++ {
+        var err error
+        if _, i, err = unpackRR(b, i); err != nil {
+            return 0, nil, err
+        }
+    }
+
+    r := m.additional[len(m.additional)-1]
+    if r.class != CLASS_ANY || r.ttl != 0 {
+        return 0, nil, errors.New("TSIG class/ttl")
+    }
+
+    alg, j, err := unpackName(r.data, 0)
+    if err != nil {
+        return 0, nil, err
+    }
+
+    d := r.data[j:]
+    if len(d) < 10 {
+        return 0, nil, errMsgShort
+    }
+
+    t := &tsig{
+        key:    strings.ToLower(enddot.ReplaceAllString(r.name, "")),
+        alg:    strings.ToLower(alg),
+        signed: uint64(binary.BigEndian.Uint16(d[0:]))<<32 | uint64(binary.BigEndian.Uint32(d[2:])),
+        fudge:  binary.BigEndian.Uint16(d[6:]),
+    }
+
+    ml := int(binary.BigEndian.Uint16(d[8:]))
+    d = d[10:]
+    if len(d) < ml+6 {
+        return 0, nil, errMsgShort
+    }
+
+    t.mac = d[:ml]
+    t.id = binary.BigEndian.Uint16(d[ml:])
+    t.err = binary.BigEndian.Uint16(d[ml+2:])
+
+    ol := int(binary.BigEndian.Uint16(d[ml+4:]))
+    if len(d) < ml+6+ol {
+        return 0, nil, errMsgShort
+    }
+    t.other = d[ml+6:ml+6+ol]
+
+    return i, t, nil
+}
+
+// request without TSIG, original id and one additional less
+func tsigRequest(b []byte, id uint16) []byte {
+    r := append([]byte{}, b...)
+    binary.BigEndian.PutUint16(r[0:], id)
+    binary.BigEndian.PutUint16(r[10:], binary.BigEndian.Uint16(r[10:])-1)
+
+    return r
+}
+
+// MAC of message and TSIG variables, preceded by request MAC
+// when signing response (RFC 8945, 4.3)
+func tsigMAC(secret, reqMAC, msg []byte, t *tsig) []byte {
+    h := hmac.New(sha256.New, secret)
+
+    if reqMAC != nil {
+        binary.Write(h, binary.BigEndian, uint16(len(reqMAC)))
+        h.Write(reqMAC)
+    }
+
+    h.Write(msg)
+
+    // names are lower case, uncompressed
+    kn, _ := packName(t.key)
+    an, _ := packName(t.alg)
+
+    v := append(kn, 0, CLASS_ANY, 0, 0, 0, 0)
+    v = append(v, an...)
+    v = append(v, binary.BigEndian.AppendUint64(nil, t.signed)[2:]...)
+    v = binary.BigEndian.AppendUint16(v, t.fudge)
+    v = binary.BigEndian.AppendUint16(v, t.err)
+    v = binary.BigEndian.AppendUint16(v, uint16(len(t.other)))
+    v = append(v, t.other...)
+    h.Write(v)
+
+    return h.Sum(nil)
+}
+
+// TSIG record, uncompressed
+func (t *tsig) pack() ([]byte, error) {
+    kn, err := packName(t.key)
+    if err != nil {
+        return nil, err
+    }
+    an, err := packName(t.alg)
+    if err != nil {
+        return nil, err
+    }
+
+    d := append(an, binary.BigEndian.AppendUint64(nil, t.signed)[2:]...)
+    d = binary.BigEndian.AppendUint16(d, t.fudge)
+    d = binary.BigEndian.AppendUint16(d, uint16(len(t.mac)))
+    d = append(d, t.mac...)
+    d = binary.BigEndian.AppendUint16(d, t.id)
+    d = binary.BigEndian.AppendUint16(d, t.err)
+    d = binary.BigEndian.AppendUint16(d, uint16(len(t.other)))
+    d = append(d, t.other...)
+
+    b := append(kn, 0, TSIG, 0, CLASS_ANY, 0, 0, 0, 0)
+    b = binary.BigEndian.AppendUint16(b, uint16(len(d)))
+
+    return append(b, d...), nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "errors"
+    "strings"
+    "math/rand"
+    "sync/atomic"
+    crand "crypto/rand"
+    "encoding/binary"
+)
+
+// Upstream (remote) DNS server used for forwarding
+// queries that are not answered from local cache.
+//
+// Each forwarded query gets a fresh random ID (and on UDP is sent from
+// a random source port). Only a response matching the ID, question
+// (and the upstream address) is accepted, anything else is discarded
+// (spoofing attempts, late answers etc).
+
+type Upstream interface {
+    // forward query and copy validated response into answer
+    // returns length of the answer carrying the original query id
+    Exchange([]byte, []byte, int) (int, error)
+    String() string
+}
+
+// Random upstream of pool per query, workers read from c.
+// Pool is swapped on config reload.
+type UpstreamPool struct {
+    pool atomic.Pointer[[]Upstream]
+    c chan Upstream
+}
+
+func NewUpstreamPool(pool []Upstream) *UpstreamPool {
+    p := &UpstreamPool{c: make(chan Upstream, DIALER_PREP_Q_SIZE)}
+    p.pool.Store(&pool)
+
+    go func() {
+        for {
+            up := *p.pool.Load()
+            p.c <- up[rand.Intn(len(up))]
+        }
+    }()
+
+    return p
+}
+
+func (p *UpstreamPool) Set(pool []Upstream) {
+    p.pool.Store(&pool)
+
+    // drop upstreams picked from the old pool
+    for {
+        select {
+        case <-p.c:
+        default:
+            return
+        }
+    }
+}
+
+func NewUpstream(h host, c *cfg) (Upstream, error) {
+    switch h.scheme {
+    case SCHEME_UDP:
+        return NewUpstreamUDP(h.netConnString(), c.caseRand, c.bailiwick), nil
+    case SCHEME_TLS:
+        return NewUpstreamTLS(h, c)
+    case SCHEME_HTTPS:
+        return NewUpstreamHTTPS(h, c)
+    }
+
+    return nil, fmt.Errorf("Unknown upstream scheme: %s", h.scheme)
+}
+
+//
+// UDP
+
+type UpstreamUDP struct {
+    // ip:port
+    addr string
+
+    // DNS 0x20, randomize case of question name
+    caseRand bool
+
+    // drop out-of-bailiwick records
+    bailiwick bool
+}
+
+func NewUpstreamUDP(addr string, caseRand, bailiwick bool) *UpstreamUDP {
+    return &UpstreamUDP{addr, caseRand, bailiwick}
+}
+
+func (u *UpstreamUDP) String() string {
+    return u.addr
+}
+
+// Forward query upstream and copy validated response into answer.
+// Returns length of the answer which carries the original client query id.
+func (u *UpstreamUDP) Exchange(query, answer []byte, wid int) (int, error) {
+    qm, err := ParseMsg(query)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid query: %s", err.Error())
+    }
+    if len(qm.question) != 1 {
+        return 0, fmt.Errorf("Invalid query: question count %d", len(qm.question))
+    }
+
+    raddr, err := net.ResolveUDPAddr("udp", u.addr)
+    if err != nil {
+        return 0, err
+    }
+
+    // own copy of the query
+    // client id is restored from 'query' at the end
+    out := make([]byte, len(query))
+    copy(out, query)
+
+    id, err := randUint16()
+    if err != nil {
+        return 0, err
+    }
+    binary.BigEndian.PutUint16(out, id)
+
+    qs := qm.question[0]
+    if u.caseRand {
+        qs.name, err = caseRandomize(out)
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    conn, err := listenRandomPort(raddr)
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+
+    if uDebg.On() {
+        uDebg.Worker(wid).Printf("#%d: Dialing to upstream: %s, from: %s, upstream id: %d", wid, raddr.String(), conn.LocalAddr().String(), id)
+    }
+
+    // upstream connection timeout
+    conn.SetDeadline(time.Now().Add(time.Second * CONNECTION_TIMEOUT))
+
+    l, err := conn.WriteTo(out, raddr)
+    if err != nil {
+        return 0, fmt.Errorf("Failed to write query to upstream, written: %d, error: %s", l, err.Error())
+    }
+
+    if uDebg.On() {
+        uDebg.Worker(wid).Printf("#%d: Bytes written upstream: %d", wid, l)
+    }
+
+    resp := make([]byte, UPSTREAM_PACKET_SIZE)
+    for {
+        l, from, err := conn.ReadFrom(resp)
+        if err != nil {
+            return 0, fmt.Errorf("Failed to read from upstream, read: %d, error: %s", l, err.Error())
+        }
+
+        // keep on reading until the right answer shows up
+        // or connection times out
+        reason := validateSource(from, raddr)
+        if reason == "" {
+            reason = validateResponse(resp[:l], id, qs, u.caseRand)
+        }
+
+        if reason != "" {
+            uWarn.Worker(wid).Printf("#%d: Discarding upstream response from: %s, len: %d, reason: %s", wid, from.String(), l, reason)
+            continue
+        }
+
+        return finishResponse(query, resp[:l], answer, qs.name, u.bailiwick, wid)
+    }
+}
+
+// copies validated response into answer, optionally drops
+// out-of-bailiwick records and restores client's id and question
+func finishResponse(query, resp, answer []byte, qname string, bailiwick bool, wid int) (int, error) {
+    var err error
+
+    if bailiwick {
+        resp, err = scrubBailiwick(resp, qname, wid)
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    if len(resp) > len(answer) {
+        uWarn.Worker(wid).Printf("#%d: Upstream response too large: %d, truncating", wid, len(resp))
+        resp, err = Truncate(resp)
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    copy(answer, resp)
+
+    // restore client id
+    // and question (0x20 case)
+    copy(answer[:QUERY_ID_LEN], query[:QUERY_ID_LEN])
+    qb := QuestionByte(query)
+    copy(answer[QUESTION_START:QUESTION_START+len(qb)], qb)
+
+    return len(resp), nil
+}
+
+// returns reason for rejecting the response
+// or empty string when all is good
+func validateSource(from net.Addr, raddr *net.UDPAddr) string {
+    fa, ok := from.(*net.UDPAddr)
+    if !ok || !fa.IP.Equal(raddr.IP) || fa.Port != raddr.Port {
+        return "unexpected source address"
+    }
+
+    return ""
+}
+
+func validateResponse(b []byte, id uint16, qs MsgQuestion, exactCase bool) string {
+    m, err := ParseMsg(b)
+    if err != nil {
+        return "malformed: " + err.Error()
+    }
+
+    if m.id != int(id) {
+        return fmt.Sprintf("id mismatch: %d", m.id)
+    }
+
+    if !m.response() {
+        return "not a response"
+    }
+
+    if len(m.question) != 1 {
+        return fmt.Sprintf("question count: %d", len(m.question))
+    }
+
+    rq := m.question[0]
+    if rq.t != qs.t || rq.class != qs.class {
+        return fmt.Sprintf("question type/class mismatch: %s", RequestTypeString(rq.t))
+    }
+
+    // 0x20 requires exact match
+    // otherwise names are case insensitive
+    if exactCase {
+        if rq.name != qs.name {
+            return "question mismatch (0x20): " + rq.name
+        }
+    } else if !strings.EqualFold(rq.name, qs.name) {
+        return "question mismatch: " + rq.name
+    }
+
+    return ""
+}
+
+// Drops records which are not relevant to the question.
+// answer: question name and the CNAME chain from it
+// authority: names at or above the question name (zone cuts, SOA)
+// additional: OPT and names referenced by the above
+func scrubBailiwick(b []byte, qname string, wid int) ([]byte, error) {
+    m, err := ParseMsg(b)
+    if err != nil {
+        return nil, err
+    }
+
+    dropped := 0
+
+    chain := map[string]bool{strings.ToLower(qname): true}
+    answer := make([]MsgRR, 0, len(m.answer))
+    for _, r := range m.answer {
+        if !chain[strings.ToLower(r.name)] {
+            dropped++
+            continue
+        }
+
+        if r.t == CNAME {
+            chain[strings.ToLower(r.target())] = true
+        }
+
+        answer = append(answer, r)
+    }
+
+    ref := make(map[string]bool)
+    for _, r := range answer {
+        if t := r.target(); t != "" {
+            ref[strings.ToLower(t)] = true
+        }
+    }
+
+    authority := make([]MsgRR, 0, len(m.authority))
+    for _, r := range m.authority {
+        if !inZone(qname, r.name) {
+            dropped++
+            continue
+        }
+
+        if t := r.target(); t != "" {
+            ref[strings.ToLower(t)] = true
+        }
+
+        authority = append(authority, r)
+    }
+
+    additional := make([]MsgRR, 0, len(m.additional))
+    for _, r := range m.additional {
+        if r.t != OPT && !ref[strings.ToLower(r.name)] {
+            dropped++
+            continue
+        }
+
+        additional = append(additional, r)
+    }
+
+    if dropped == 0 {
+        return b, nil
+    }
+
+    uWarn.Worker(wid).Printf("#%d: Dropped %d out-of-bailiwick record(s) for: %s", wid, dropped, qname)
+
+    m.answer, m.authority, m.additional = answer, authority, additional
+    return m.Pack()
+}
+
+// randomize case of question name in place (DNS 0x20)
+// returns the resulting name
+func caseRandomize(q []byte) (string, error) {
+    qb := QuestionByte(q)
+
+    rb := make([]byte, len(qb))
+    if _, err := crand.Read(rb); err != nil {
+        return "", err
+    }
+
+    i := 0
+    for i < len(qb) {
+        l := int(qb[i])
+        if l&LABEL_POINTER != 0 {
+            return "", errors.New("Unexpected label pointer in question")
+        }
+
+        for j:=i+1; j<=i+l && j<len(qb); j++ {
+            c := qb[j]
+            if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+                if rb[j]&1 == 1 {
+                    c ^= 0x20
+                }
+            }
+
+            q[QUESTION_START+j] = c
+        }
+
+        i += l+1
+    }
+
+    return Question(q), nil
+}
+
+// bind to random local port, the OS will also pick
+// a random one when all attempts fail (port 0)
+func listenRandomPort(raddr *net.UDPAddr) (*net.UDPConn, error) {
+    network := "udp4"
+    if raddr.IP.To4() == nil {
+        network = "udp6"
+    }
+
+    for i:=0; i<SOURCE_PORT_ATTEMPTS; i++ {
+        p, err := randUint16()
+        if err != nil {
+            return nil, err
+        }
+
+        port := SOURCE_PORT_MIN + int(p)%(PORT_MAX-SOURCE_PORT_MIN+1)
+        conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+        if err == nil {
+            return conn, nil
+        }
+    }
+
+    return net.ListenUDP(network, &net.UDPAddr{})
+}
+
+func randUint16() (uint16, error) {
+    b := make([]byte, 2)
+    if _, err := crand.Read(b); err != nil {
+        return 0, err
+    }
+
+    return binary.BigEndian.Uint16(b), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "time"
+    "bytes"
+    "context"
+    "net/http"
+    "encoding/base64"
+)
+
+//
+// DNS over HTTPS (RFC 8484)
+//
+// Queries are sent as application/dns-message with POST (default)
+// or GET ?dns=<base64url>. Connections are kept open and reused,
+// HTTP/2 is negotiated when the server supports it.
+
+type UpstreamHTTPS struct {
+    // https://host[:port]/path
+    url string
+
+    client *http.Client
+
+    // GET instead of POST
+    get bool
+
+    // drop out-of-bailiwick records
+    bailiwick bool
+
+    // as defined in config
+    name string
+}
+
+func NewUpstreamHTTPS(h host, c *cfg) (*UpstreamHTTPS, error) {
+    conf, err := tlsClientConfig(h.tlsName, c)
+    if err != nil {
+        return nil, err
+    }
+
+    d := &net.Dialer{Timeout: TLS_TIMEOUT * time.Second}
+
+    t := &http.Transport{
+        TLSClientConfig:     conf,
+        ForceAttemptHTTP2:   true,
+        TLSHandshakeTimeout: TLS_TIMEOUT * time.Second,
+        IdleConnTimeout:     time.Duration(c.tlsIdle) * time.Second,
+        MaxIdleConnsPerHost: HTTPS_IDLE_CONNS,
+        DialContext:         d.DialContext,
+    }
+
+    // bootstrap address, connect there
+    // rather than resolving url host
+    if h.name != h.tlsName {
+        addr := h.netConnString()
+        t.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+            return d.DialContext(ctx, network, addr)
+        }
+    }
+
+    return &UpstreamHTTPS{
+        url: h.url,
+        client: &http.Client{
+            Transport: t,
+            Timeout:   time.Duration(c.httpsTimeout) * time.Second,
+        },
+        get:       c.httpsGet,
+        bailiwick: c.bailiwick,
+        name:      h.String(),
+    }, nil
+}
+
+func (u *UpstreamHTTPS) String() string {
+    return u.name
+}
+
+func (u *UpstreamHTTPS) Exchange(query, answer []byte, wid int) (int, error) {
+    qm, err := ParseMsg(query)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid query: %s", err.Error())
+    }
+    if len(qm.question) != 1 {
+        return 0, fmt.Errorf("Invalid query: question count %d", len(qm.question))
+    }
+
+    // id 0 as recommended by RFC 8484 (cache friendly)
+    // the client's is restored on the way back
+    out := make([]byte, len(query))
+    copy(out, query)
+    out[0], out[1] = 0, 0
+
+    var req *http.Request
+    if u.get {
+        req, err = http.NewRequest(http.MethodGet, u.url+"?dns="+base64.RawURLEncoding.EncodeToString(out), nil)
+    } else {
+        req, err = http.NewRequest(http.MethodPost, u.url, bytes.NewReader(out))
+        if err == nil {
+            req.Header.Set("Content-Type", DNS_MESSAGE)
+        }
+    }
+    if err != nil {
+        return 0, err
+    }
+
+    req.Header.Set("Accept", DNS_MESSAGE)
+
+    if uDebg.On() {
+        uDebg.Worker(wid).Printf("#%d: Sending %s to upstream: %s", wid, req.Method, u.name)
+    }
+
+    resp, err := u.client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    if uDebg.On() {
+        uDebg.Worker(wid).Printf("#%d: Upstream response: %s, proto: %s", wid, resp.Status, resp.Proto)
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("Upstream HTTP status: %s", resp.Status)
+    }
+
+    if ct := resp.Header.Get("Content-Type"); ct != DNS_MESSAGE {
+        return 0, fmt.Errorf("Unexpected upstream content type: %s", ct)
+    }
+
+    // over the max DNS message size
+    b, err := io.ReadAll(io.LimitReader(resp.Body, UPSTREAM_PACKET_SIZE+1))
+    if err != nil {
+        return 0, err
+    }
+    if len(b) > UPSTREAM_PACKET_SIZE {
+        return 0, fmt.Errorf("Upstream response too large: over %d bytes", UPSTREAM_PACKET_SIZE)
+    }
+
+    if reason := validateResponse(b, 0, qm.question[0], false); reason != "" {
+        return 0, fmt.Errorf("Invalid upstream response: %s", reason)
+    }
+
+    return finishResponse(query, b, answer, qm.question[0].name, u.bailiwick, wid)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+    "io"
+    "bytes"
+    "strings"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "encoding/base64"
+)
+
+// DoH upstream against httptest TLS server
+
+func testQuery(t *testing.T, id int, name string) []byte {
+    t.Helper()
+
+    q := &Msg{id: id, flags: FLAG_RD, question: []MsgQuestion{{name, A, IN}}}
+    b, err := q.Pack()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return b
+}
+
+// response to query (as received), A records of ips
+// Error (not Fatal), called from handlers
+func testResponse(t *testing.T, query []byte, ips ...[]byte) []byte {
+    t.Helper()
+
+    q, err := ParseMsg(query)
+    if err != nil {
+        t.Error(err)
+        return nil
+    }
+
+    m := &Msg{id: q.id, flags: FLAG_QR | FLAG_RD | FLAG_RA, question: q.question}
+    for _, ip := range ips {
+        m.answer = append(m.answer, MsgRR{q.question[0].name, A, IN, TTL, ip})
+    }
+
+    b, err := m.Pack()
+    if err != nil {
+        t.Error(err)
+        return nil
+    }
+
+    return b
+}
+
+func testUpstreamHTTPS(t *testing.T, get bool, h http.HandlerFunc) *UpstreamHTTPS {
+    t.Helper()
+
+    srv := httptest.NewTLSServer(h)
+    t.Cleanup(srv.Close)
+
+    return &UpstreamHTTPS{
+        url:    srv.URL + DOH_PATH,
+        client: srv.Client(),
+        get:    get,
+        name:   "test",
+    }
+}
+
+// query of the request, checked for wire format
+// Error (not Fatal), called from handlers
+func testRequestQuery(t *testing.T, r *http.Request, get bool) []byte {
+    t.Helper()
+
+    if r.URL.Path != DOH_PATH {
+        t.Errorf("path: %s", r.URL.Path)
+    }
+    if a := r.Header.Get("Accept"); a != DNS_MESSAGE {
+        t.Errorf("accept: %s", a)
+    }
+
+    if get {
+        if r.Method != http.MethodGet {
+            t.Errorf("method: %s, want GET", r.Method)
+        }
+
+        // base64url without padding
+        d := r.URL.Query().Get("dns")
+        if strings.ContainsAny(d, "=+/") {
+            t.Errorf("dns not base64url unpadded: %s", d)
+        }
+
+        q, err := base64.RawURLEncoding.DecodeString(d)
+        if err != nil {
+            t.Error(err)
+            return nil
+        }
+
+        return q
+    }
+
+    if r.Method != http.MethodPost {
+        t.Errorf("method: %s, want POST", r.Method)
+    }
+    if ct := r.Header.Get("Content-Type"); ct != DNS_MESSAGE {
+        t.Errorf("content type: %s", ct)
+    }
+
+    q, err := io.ReadAll(r.Body)
+    if err != nil {
+        t.Error(err)
+        return nil
+    }
+
+    return q
+}
+
+func TestUpstreamHTTPSWireFormat(t *testing.T) {
+    for _, get := range []bool{false, true} {
+        query := testQuery(t, 0x1234, "host.example.com")
+
+        u := testUpstreamHTTPS(t, get, func(w http.ResponseWriter, r *http.Request) {
+            q := testRequestQuery(t, r, get)
+            if len(q) < HEADER_LEN {
+                return
+            }
+
+            // id 0, the rest as sent by the client
+            if q[0] != 0 || q[1] != 0 {
+                t.Errorf("get %v: request id: %d, want 0", get, bytesToInt(q[:2]))
+            }
+            if !bytes.Equal(q[2:], query[2:]) {
+                t.Errorf("get %v: request query differs", get)
+            }
+
+            w.Header().Set("Content-Type", DNS_MESSAGE)
+            w.Write(testResponse(t, q, []byte{192, 0, 2, 1}))
+        })
+
+        answer := make([]byte, PACKET_SIZE)
+        n, err := u.Exchange(query, answer, 0)
+        if err != nil {
+            t.Fatalf("get %v: %s", get, err.Error())
+        }
+
+        m, err := ParseMsg(answer[:n])
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        // client id restored
+        if m.id != 0x1234 {
+            t.Errorf("get %v: answer id: %d, want %d", get, m.id, 0x1234)
+        }
+        if len(m.answer) != 1 || !bytes.Equal(m.answer[0].data, []byte{192, 0, 2, 1}) {
+            t.Errorf("get %v: answer: %s", get, Response(answer[:n]))
+        }
+    }
+}
+
+func TestUpstreamHTTPSErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        h http.HandlerFunc
+        err string
+    }{
+        {"status", func(w http.ResponseWriter, r *http.Request) {
+            http.Error(w, "busy", http.StatusServiceUnavailable)
+        }, "status: 503"},
+
+        {"content type", func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Content-Type", "text/plain")
+            w.Write(testResponse(t, testRequestQuery(t, r, false)))
+        }, "content type: text/plain"},
+
+        // response to id 0 only
+        {"id", func(w http.ResponseWriter, r *http.Request) {
+            q := testRequestQuery(t, r, false)
+            if len(q) < HEADER_LEN {
+                return
+            }
+            q[0], q[1] = 0x12, 0x34
+
+            w.Header().Set("Content-Type", DNS_MESSAGE)
+            w.Write(testResponse(t, q))
+        }, "id mismatch"},
+
+        {"not a response", func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Content-Type", DNS_MESSAGE)
+            w.Write(testRequestQuery(t, r, false))
+        }, "not a response"},
+
+        {"too large", func(w http.ResponseWriter, r *http.Request) {
+            b := testResponse(t, testRequestQuery(t, r, false))
+
+            w.Header().Set("Content-Type", DNS_MESSAGE)
+            w.Write(append(b, make([]byte, UPSTREAM_PACKET_SIZE)...))
+        }, "too large"},
+    }
+
+    for _, tc := range tests {
+        u := testUpstreamHTTPS(t, false, tc.h)
+
+        _, err := u.Exchange(testQuery(t, 1, "host.example.com"), make([]byte, PACKET_SIZE), 0)
+        if err == nil {
+            t.Errorf("%s: no error", tc.name)
+            continue
+        }
+
+        if !strings.Contains(err.Error(), tc.err) {
+            t.Errorf("%s: error: %s, want: %s", tc.name, err.Error(), tc.err)
+        }
+    }
+}
+
+// over the answer buffer, truncated (TC) for the client to retry
+func TestUpstreamHTTPSTruncate(t *testing.T) {
+    ips := make([][]byte, 0)
+    for i := 0; i < 200; i++ {
+        ips = append(ips, []byte{198, 51, 100, byte(i)})
+    }
+
+    u := testUpstreamHTTPS(t, false, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", DNS_MESSAGE)
+        w.Write(testResponse(t, testRequestQuery(t, r, false), ips...))
+    })
+
+    answer := make([]byte, 512)
+    n, err := u.Exchange(testQuery(t, 7, "big.example.com"), answer, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    m, err := ParseMsg(answer[:n])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !m.truncated() || m.id != 7 || len(m.answer) != 0 {
+        t.Errorf("answer not truncated: %s", Response(answer[:n]))
+    }
+}
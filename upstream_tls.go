@@ -0,0 +1,361 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "net"
+    "sync"
+    "time"
+    "errors"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+)
+
+//
+// DNS over TLS (RFC 7858)
+//
+// Single persistent connection per upstream, queries are pipelined
+// (each with its own random ID) and responses are matched back to
+// the waiting query by ID. Connection is closed when idle and
+// re-established on the next query.
+
+type UpstreamTLS struct {
+    // ip:port
+    addr string
+
+    // certificate verification
+    config *tls.Config
+
+    // close idle connection after
+    idle time.Duration
+
+    // drop out-of-bailiwick records
+    bailiwick bool
+
+    mux sync.Mutex
+    conn *dotConn
+
+    // as defined in config
+    name string
+}
+
+type dotConn struct {
+    conn *tls.Conn
+
+    // write lock
+    wmux sync.Mutex
+
+    // pending queries by id
+    mux sync.Mutex
+    pending map[uint16]chan []byte
+    closed bool
+    idle *time.Timer
+    timeout time.Duration
+}
+
+func NewUpstreamTLS(h host, c *cfg) (*UpstreamTLS, error) {
+    conf, err := tlsClientConfig(h.tlsName, c)
+    if err != nil {
+        return nil, err
+    }
+
+    return &UpstreamTLS{
+        addr:      h.netConnString(),
+        config:    conf,
+        idle:      time.Duration(c.tlsIdle) * time.Second,
+        bailiwick: c.bailiwick,
+        name:      h.String(),
+    }, nil
+}
+
+// verifies certificate against server name, CA bundle (system if not configured)
+// and pinned public keys (if any defined for the server name)
+func tlsClientConfig(name string, c *cfg) (*tls.Config, error) {
+    conf := &tls.Config{
+        ServerName: name,
+        MinVersion: tls.VersionTLS12,
+    }
+
+    if c.tlsCA != "" {
+        pool, err := loadCA(c.tlsCA)
+        if err != nil {
+            return nil, err
+        }
+
+        conf.RootCAs = pool
+    }
+
+    if pins, ok := c.tlsPin[name]; ok {
+        conf.VerifyConnection = func(cs tls.ConnectionState) error {
+            return verifyPin(cs, pins)
+        }
+    }
+
+    return conf, nil
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(b) {
+        return nil, fmt.Errorf("No certificates found in: %s", path)
+    }
+
+    return pool, nil
+}
+
+// SPKI pinning, base64(sha256(SubjectPublicKeyInfo))
+// any certificate in the chain may match
+func verifyPin(cs tls.ConnectionState, pins []string) error {
+    for _, cert := range cs.PeerCertificates {
+        sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+        spki := base64.StdEncoding.EncodeToString(sum[:])
+
+        for _, p := range pins {
+            if p == spki {
+                return nil
+            }
+        }
+    }
+
+    return fmt.Errorf("No pinned public key matches certificate of: %s", cs.ServerName)
+}
+
+func (u *UpstreamTLS) String() string {
+    return u.name
+}
+
+func (u *UpstreamTLS) Exchange(query, answer []byte, wid int) (int, error) {
+    qm, err := ParseMsg(query)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid query: %s", err.Error())
+    }
+    if len(qm.question) != 1 {
+        return 0, fmt.Errorf("Invalid query: question count %d", len(qm.question))
+    }
+
+    // broken connection is only detected on use
+    // give it another go with a fresh one
+    var resp []byte
+    var id uint16
+    for i:=0; i<2; i++ {
+        var dc *dotConn
+        dc, err = u.get(wid)
+        if err != nil {
+            return 0, err
+        }
+
+        resp, id, err = dc.exchange(query, wid)
+        if err == nil || !errors.Is(err, errDotConn) {
+            break
+        }
+    }
+
+    if err != nil {
+        return 0, err
+    }
+
+    if reason := validateResponse(resp, id, qm.question[0], false); reason != "" {
+        return 0, fmt.Errorf("Invalid upstream response: %s", reason)
+    }
+
+    return finishResponse(query, resp, answer, qm.question[0].name, u.bailiwick, wid)
+}
+
+// current connection, dial new one if needed
+func (u *UpstreamTLS) get(wid int) (*dotConn, error) {
+    u.mux.Lock()
+    defer u.mux.Unlock()
+
+    if u.conn != nil && !u.conn.isClosed() {
+        return u.conn, nil
+    }
+
+    if uDebg.On() {
+        uDebg.Worker(wid).Printf("#%d: Dialing to upstream: %s", wid, u.name)
+    }
+
+    d := &net.Dialer{Timeout: TLS_TIMEOUT * time.Second}
+    conn, err := tls.DialWithDialer(d, "tcp", u.addr, u.config)
+    if err != nil {
+        return nil, err
+    }
+
+    dc := &dotConn{
+        conn:    conn,
+        pending: make(map[uint16]chan []byte),
+        timeout: u.idle,
+    }
+    dc.idle = time.AfterFunc(u.idle, dc.closeIdle)
+
+    go dc.read()
+
+    u.conn = dc
+    return dc, nil
+}
+
+var errDotConn = errors.New("DoT connection closed")
+
+// send query with random id, wait for the response
+func (dc *dotConn) exchange(query []byte, wid int) ([]byte, uint16, error) {
+    ch := make(chan []byte, 1)
+
+    dc.mux.Lock()
+    if dc.closed {
+        dc.mux.Unlock()
+        return nil, 0, errDotConn
+    }
+
+    var id uint16
+    for {
+        r, err := randUint16()
+        if err != nil {
+            dc.mux.Unlock()
+            return nil, 0, err
+        }
+
+        if _, ok := dc.pending[r]; !ok {
+            id = r
+            break
+        }
+    }
+
+    dc.pending[id] = ch
+    dc.idle.Stop()
+    dc.mux.Unlock()
+
+    defer dc.done(id)
+
+    // length prefixed
+    out := make([]byte, 2+len(query))
+    binary.BigEndian.PutUint16(out, uint16(len(query)))
+    copy(out[2:], query)
+    binary.BigEndian.PutUint16(out[2:], id)
+
+    dc.wmux.Lock()
+    dc.conn.SetWriteDeadline(time.Now().Add(TLS_TIMEOUT * time.Second))
+    _, err := dc.conn.Write(out)
+    dc.wmux.Unlock()
+
+    if err != nil {
+        dc.close()
+        return nil, 0, fmt.Errorf("%w: %s", errDotConn, err.Error())
+    }
+
+    if uDebg.On() {
+        uDebg.Worker(wid).Printf("#%d: Bytes written upstream: %d, upstream id: %d", wid, len(out), id)
+    }
+
+    select {
+    case resp, ok := <-ch:
+        if !ok {
+            return nil, 0, errDotConn
+        }
+
+        return resp, id, nil
+
+    case <-time.After(TLS_TIMEOUT * time.Second):
+        return nil, 0, fmt.Errorf("Upstream timeout, id: %d", id)
+    }
+}
+
+// query finished, start idle timer
+// when nothing else is pending
+func (dc *dotConn) done(id uint16) {
+    dc.mux.Lock()
+    defer dc.mux.Unlock()
+
+    delete(dc.pending, id)
+    if len(dc.pending) == 0 && !dc.closed {
+        dc.idle.Reset(dc.timeout)
+    }
+}
+
+// reads responses and hands them over
+// to the waiting queries
+func (dc *dotConn) read() {
+    defer dc.close()
+
+    l := make([]byte, 2)
+    for {
+        if _, err := io.ReadFull(dc.conn, l); err != nil {
+            return
+        }
+
+        resp := make([]byte, binary.BigEndian.Uint16(l))
+        if _, err := io.ReadFull(dc.conn, resp); err != nil {
+            return
+        }
+
+        if len(resp) < HEADER_LEN {
+            continue
+        }
+
+        id := binary.BigEndian.Uint16(resp)
+
+        dc.mux.Lock()
+        ch, ok := dc.pending[id]
+        if ok {
+            // answered, stop matching
+            delete(dc.pending, id)
+        }
+        dc.mux.Unlock()
+
+        if !ok {
+            uWarn.Printf("Discarding upstream response from: %s, unknown id: %d", dc.conn.RemoteAddr().String(), id)
+            continue
+        }
+
+        ch <- resp
+    }
+}
+
+func (dc *dotConn) closeIdle() {
+    dc.mux.Lock()
+    busy := len(dc.pending) > 0
+    dc.mux.Unlock()
+
+    if busy {
+        return
+    }
+
+    if uDebg.On() {
+        uDebg.Printf("Closing idle upstream connection: %s", dc.conn.RemoteAddr().String())
+    }
+
+    dc.close()
+}
+
+func (dc *dotConn) close() {
+    dc.mux.Lock()
+    defer dc.mux.Unlock()
+
+    if dc.closed {
+        return
+    }
+
+    dc.closed = true
+    dc.idle.Stop()
+    dc.conn.Close()
+
+    // wake up anyone waiting
+    for id, ch := range dc.pending {
+        close(ch)
+        delete(dc.pending, id)
+    }
+}
+
+func (dc *dotConn) isClosed() bool {
+    dc.mux.Lock()
+    defer dc.mux.Unlock()
+
+    return dc.closed
+}
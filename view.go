@@ -0,0 +1,148 @@
+package main
+
+import (
+    "net"
+    "sort"
+    "regexp"
+    "strings"
+    "net/netip"
+)
+
+//
+// Split horizon views (view.clients, view.rr, view.dialer.v4/v6)
+//
+// Client is in the view of its longest matching prefix, clients
+// of no view get the base (rr.dir, hosts, dynamic records).
+// Records of view dir are layered over the base by name: name
+// with any record in the view is answered from the view only
+// (types it does not have go upstream), other names from the base.
+// Queries of view with own dialers are forwarded to those.
+//
+// View records are self-contained (CNAME, MX targets in the view)
+// and reloaded together with the base.
+
+var rView = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+type View struct {
+    name string
+    clients []netip.Prefix
+
+    // dir of records, nil cache = none
+    dir string
+    cache *Cache
+
+    // v4 and v6 dialers, nil = server's
+    pool *UpstreamPool
+}
+
+// caches loaded, panic on errors the same as the base
+func NewViews(conf *cfg) ([]*View, error) {
+    views := make([]*View, 0, len(conf.viewClients))
+    for _, n := range mapKeys(conf.viewClients) {
+        v := &View{name: n, clients: conf.viewClients[n], dir: conf.viewRR[n]}
+
+        if v.dir != "" {
+            rf, err := conf.rrFilesIn(v.dir)
+            if err != nil {
+                return nil, err
+            }
+
+            v.cache = NewCache(conf.defaultDomain, rf, nil, conf.rrConflict, conf.rrPriority)
+        }
+
+        hosts := append(append([]host{}, conf.viewDialer4[n]...), conf.viewDialer6[n]...)
+        if len(hosts) > 0 {
+            up := make([]Upstream, 0, len(hosts))
+            for _, h := range hosts {
+                u, err := NewUpstream(h, conf)
+                if err != nil {
+                    return nil, err
+                }
+
+                up = append(up, u)
+            }
+
+            v.pool = NewUpstreamPool(up)
+        }
+
+        views = append(views, v)
+    }
+
+    return views, nil
+}
+
+// view of client, nil = none
+func matchView(views []*View, addr net.Addr) *View {
+    if len(views) == 0 {
+        return nil
+    }
+
+    ip, ok := clientIP(addr)
+    if !ok {
+        return nil
+    }
+
+    var m *View
+    bits := -1
+    for _, v := range views {
+        for _, p := range v.clients {
+            if p.Bits() > bits && p.Contains(ip) {
+                m, bits = v, p.Bits()
+            }
+        }
+    }
+
+    return m
+}
+
+// local records answering the name, view or base
+func (v *View) records(base *Cache, name string) *Cache {
+    if v != nil && v.cache != nil && v.cache.Has(name) {
+        return v.cache
+    }
+
+    return base
+}
+
+// view dir scanned for .rr files again
+func (v *View) reload(conf *cfg) error {
+    if v.cache == nil {
+        return nil
+    }
+
+    rf, err := conf.rrFilesIn(v.dir)
+    if err != nil {
+        return err
+    }
+
+    v.cache.SetFiles(rf)
+    return v.cache.Reload()
+}
+
+func (v *View) String() string {
+    s := v.name + ": " + prefixString(v.clients)
+    if v.dir != "" {
+        s += ", rr: " + v.dir
+    }
+    if v.pool != nil {
+        up := make([]string, 0)
+        for _, u := range *v.pool.pool.Load() {
+            up = append(up, u.String())
+        }
+
+        s += ", dialers: " + strings.Join(up, ", ")
+    }
+
+    return s
+}
+
+// sorted
+func mapKeys[V any](m map[string]V) []string {
+    k := make([]string, 0, len(m))
+    for n := range m {
+        k = append(k, n)
+    }
+
+    sort.Strings(k)
+    return k
+}
@@ -2,37 +2,45 @@ package main
 
 import (
     "fmt"
+    "io"
     "sync"
+    "sync/atomic"
     "net"
-    "context"
     "time"
+    "errors"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
 )
 
 type Worker interface {
-    Start4(net.ListenConfig, string, bool, *Cache, chan []byte, chan string, int) error
-    Start6(net.ListenConfig, string, bool, *Cache, chan []byte, chan string, int) error
+    Start4(net.ListenConfig, string, *atomic.Pointer[Resolver], chan []byte, chan Upstream, int) error
+    Start6(net.ListenConfig, string, *atomic.Pointer[Resolver], chan []byte, chan Upstream, int) error
     ServeDNS()
     Close()
     Type() string
     ListenAddr() net.Addr
+    Id() int
+    Inflight() int
 }
 
 type WorkerCommon struct {
-    // cache
-    cache *Cache
+    // query processing
+    // swapped on config reload
+    res *atomic.Pointer[Resolver]
 
     // predeclared empty packets
     packeter chan []byte
 
     // upstream dialer
-    dialer chan string
+    dialer chan Upstream
+
+    // queries being processed
+    inflight chan bool
 
     // sync
     wg sync.WaitGroup
 
-    // proxy mode
-    proxy bool
-
     // shutdown request
     exit chan bool
 
@@ -46,6 +54,15 @@ type WorkerCommon struct {
     net string
 }
 
+func (w *WorkerCommon) Id() int {
+    return w.id
+}
+
+// queries (connections) in processing
+func (w *WorkerCommon) Inflight() int {
+    return len(w.inflight)
+}
+
 //
 // UDP
 
@@ -72,15 +89,15 @@ func (w *WorkerUDP) ListenAddr() net.Addr {
     return w.listener.LocalAddr()
 }
 
-func (w *WorkerUDP) Start4(lc net.ListenConfig, iface string, x bool, c *Cache, p chan []byte, d chan string, id int) error {
-    return w.Start(lc, iface, x, c, p, d, id, IPv4)
+func (w *WorkerUDP) Start4(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv4)
 }
 
-func (w *WorkerUDP) Start6(lc net.ListenConfig, iface string, x bool, c *Cache, p chan []byte, d chan string, id int) error {
-    return w.Start(lc, iface, x, c, p, d, id, IPv6)
+func (w *WorkerUDP) Start6(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv6)
 }
 
-func (w *WorkerUDP) Start(lc net.ListenConfig, iface string, x bool, c *Cache, p chan []byte, d chan string, id int, net string) error {
+func (w *WorkerUDP) Start(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int, net string) error {
     var lnet string
     switch net {
     case IPv4: lnet = "udp4"
@@ -95,13 +112,14 @@ func (w *WorkerUDP) Start(lc net.ListenConfig, iface string, x bool, c *Cache, p
     }
 
     w.listener = l
-    w.cache = c
+    w.res = r
     w.packeter = p
     w.dialer = d
-    w.proxy = x
+    w.inflight = make(chan bool, r.Load().limit.inflight)
     w.exit = make(chan bool)
     w.exited = make(chan bool)
     w.id = id
+    w.net = net
 
     return nil
 }
@@ -126,7 +144,7 @@ func (w *WorkerUDP) ServeDNS() {
         if err != nil {
             select {
             case <-w.exit:
-                sInfo.Printf("Listener #%d closing %s socket", w.id, w.Type())
+                wInfo.Worker(w.id).Printf("Listener #%d closing %s socket", w.id, w.Type())
                 w.wg.Wait()
                 close(w.exited)
 
@@ -134,23 +152,52 @@ func (w *WorkerUDP) ServeDNS() {
                 return
 
             default:
-                sCrit.Printf("Listener #%d %s request receive error: bytes read %d, err: %s: ", w.id, w.Type(), ql, err.Error())
+                wCrit.Worker(w.id).Printf("Listener #%d %s request receive error: bytes read %d, err: %s: ", w.id, w.Type(), ql, err.Error())
             }
 
             continue
         }
 
+        // per client query limit
+        if !w.res.Load().limit.AllowQuery(addr) {
+            metrics.Query(w.Type(), w.id, query[:ql], nil)
+            continue
+        }
+
+        // bounded number of queries in processing
+        // drop when too busy
+        select {
+        case w.inflight <- true:
+        default:
+            w.res.Load().limit.Busy(addr)
+            continue
+        }
+
         // offload processing
         // to free up the listener
         w.wg.Add(1)
-        go func(q, a []byte, c *Cache, d string, p bool, i int, l net.PacketConn, addr net.Addr) {
-                answer := ProcessQuery(q, a, c, d, p, i)
+        go func(q, a []byte, r *Resolver, d Upstream, i int, l net.PacketConn, addr net.Addr) {
+                defer func() {
+                    <-w.inflight
+                    w.wg.Done()
+                }()
+
+                answer := ProcessQuery(q, a, r, d, addr, w.Type(), i)
+                if answer != nil {
+                    // response rate limit
+                    answer = r.limit.Response(addr, answer)
+                }
+
+                metrics.Query(w.Type(), i, q, answer)
+                if answer == nil {
+                    return
+                }
+
                 _, err := l.WriteTo(answer, addr)
                 if err != nil {
-                    sCrit.Printf("Listener #%d failed to write answer back to the client: %s", i, err.Error())
+                    wCrit.Worker(i).Printf("Listener #%d failed to write answer back to the client: %s", i, err.Error())
                 }
-                w.wg.Done()
-        }(query[0:ql], <-w.packeter, w.cache, <-w.dialer, w.proxy, w.id, w.listener, addr)
+        }(query[0:ql], <-w.packeter, w.res.Load(), <-w.dialer, w.id, w.listener, addr)
     }
 }
 
@@ -181,15 +228,15 @@ func (w *WorkerTCP) ListenAddr() net.Addr {
     return w.listener.Addr()
 }
 
-func (w *WorkerTCP) Start4(lc net.ListenConfig, iface string, x bool, c *Cache, p chan []byte, d chan string, id int) error {
-    return w.Start(lc, iface, x, c, p, d, id, IPv4)
+func (w *WorkerTCP) Start4(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv4)
 }
 
-func (w *WorkerTCP) Start6(lc net.ListenConfig, iface string, x bool, c *Cache, p chan []byte, d chan string, id int) error {
-    return w.Start(lc, iface, x, c, p, d, id, IPv6)
+func (w *WorkerTCP) Start6(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv6)
 }
 
-func (w *WorkerTCP) Start(lc net.ListenConfig, iface string, x bool, c *Cache, p chan []byte, d chan string, id int, net string) error {
+func (w *WorkerTCP) Start(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int, net string) error {
     var lnet string
     switch net {
     case IPv4: lnet = "tcp4"
@@ -204,10 +251,10 @@ func (w *WorkerTCP) Start(lc net.ListenConfig, iface string, x bool, c *Cache, p
     }
 
     w.listener = l
-    w.cache = c
+    w.res = r
     w.packeter = p
     w.dialer = d
-    w.proxy = x
+    w.inflight = make(chan bool, r.Load().limit.inflight)
     w.exit = make(chan bool)
     w.exited = make(chan bool)
     w.id = id
@@ -227,7 +274,7 @@ func (w *WorkerTCP) Close() {
     <-w.exited
 }
 
-func (w WorkerTCP) ServeDNS() {
+func (w *WorkerTCP) ServeDNS() {
     for {
         query := <-w.packeter
 
@@ -236,7 +283,7 @@ func (w WorkerTCP) ServeDNS() {
         if err != nil {
             select {
             case <-w.exit:
-                sInfo.Printf("Listener #%d closing %s socket", w.id, w.Type())
+                wInfo.Worker(w.id).Printf("Listener #%d closing %s socket", w.id, w.Type())
                 w.wg.Wait()
                 close(w.exited)
 
@@ -244,7 +291,7 @@ func (w WorkerTCP) ServeDNS() {
                 return
 
             default:
-                sCrit.Printf("Listener #%d %s request receive error: %s", w.id, w.Type(), err.Error())
+                wCrit.Worker(w.id).Printf("Listener #%d %s request receive error: %s", w.id, w.Type(), err.Error())
             }
 
             continue
@@ -252,93 +299,512 @@ func (w WorkerTCP) ServeDNS() {
 
         ql, err := conn.Read(query)
         if err != nil {
-            sCrit.Printf("Listener #%d %s request read error: bytes read %d, err: %s: ", w.id, w.Type(), ql, err.Error())
+            wCrit.Worker(w.id).Printf("Listener #%d %s request read error: bytes read %d, err: %s: ", w.id, w.Type(), ql, err.Error())
+            conn.Close()
+            continue
+        }
+
+        // per client query limit
+        if !w.res.Load().limit.AllowQuery(conn.RemoteAddr()) {
+            metrics.Query(w.Type(), w.id, query[:ql], nil)
+            conn.Close()
+            continue
+        }
+
+        select {
+        case w.inflight <- true:
+        default:
+            w.res.Load().limit.Busy(conn.RemoteAddr())
+            conn.Close()
             continue
         }
 
         w.wg.Add(1)
-        go func(q, a []byte, c *Cache, d string, p bool, i int, conn net.Conn) {
-                answer := ProcessQuery(q, a, c, d, p, i)
+        go func(q, a []byte, r *Resolver, d Upstream, i int, conn net.Conn) {
+                defer func() {
+                    conn.Close()
+                    <-w.inflight
+                    w.wg.Done()
+                }()
+
+                answer := ProcessQuery(q, a, r, d, conn.RemoteAddr(), w.Type(), i)
+                metrics.Query(w.Type(), i, q, answer)
+                if answer == nil {
+                    return
+                }
+
                 _, err := conn.Write(answer)
                 if err != nil {
-                    sCrit.Printf("Listner #%d failed to write answer back to the client: %s", i, err.Error())
+                    wCrit.Worker(i).Printf("Listener #%d failed to write answer back to the client: %s", i, err.Error())
                 }
-                w.wg.Done()
-        }(query[0:ql], <-w.packeter, w.cache, <-w.dialer, w.proxy, w.id, conn)
+        }(query[0:ql], <-w.packeter, w.res.Load(), <-w.dialer, w.id, conn)
+    }
+}
+
+
+//
+// TLS (DNS over TLS, RFC 7858)
+
+type WorkerTLS struct {
+    // tls listener
+    listener net.Listener
+
+    // server certificate
+    certs *CertStore
+
+    WorkerCommon
+}
+
+func NewWorkerTLS(cs *CertStore) *WorkerTLS {
+    return &WorkerTLS{certs: cs}
+}
+
+func (w *WorkerTLS) Type() string {
+    if w.net == IPv4 {
+        return "TLSv4"
+    }
+
+    return "TLSv6"
+}
+
+func (w *WorkerTLS) ListenAddr() net.Addr {
+    return w.listener.Addr()
+}
+
+func (w *WorkerTLS) Start4(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv4)
+}
+
+func (w *WorkerTLS) Start6(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv6)
+}
+
+func (w *WorkerTLS) Start(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int, net string) error {
+    var lnet string
+    switch net {
+    case IPv4: lnet = "tcp4"
+    case IPv6: lnet = "tcp6"
+    default:
+        return fmt.Errorf("Uknown net: %s", net)
+    }
+
+    l, err := lc.Listen(context.Background(), lnet, iface)
+    if err != nil {
+        return err
     }
+
+    // certificate is looked up on each handshake
+    // reloading it does not affect open connections
+    w.listener = tls.NewListener(l, &tls.Config{
+        GetCertificate: w.certs.GetCertificate,
+        MinVersion:     tls.VersionTLS12,
+    })
+    w.res = r
+    w.packeter = p
+    w.dialer = d
+    w.inflight = make(chan bool, r.Load().limit.inflight)
+    w.exit = make(chan bool)
+    w.exited = make(chan bool)
+    w.id = id
+    w.net = net
+
+    return nil
+}
+
+func (w *WorkerTLS) Close() {
+    // exit request
+    close(w.exit)
+
+    // close listening socket
+    w.listener.Close()
+
+    // exit confirmation
+    <-w.exited
+}
+
+func (w *WorkerTLS) ServeDNS() {
+    w.serveListener(w.listener, w.Type())
 }
 
-func ProcessQuery(query, answer []byte, cache *Cache, dialer string, proxy bool, wid int) []byte {
+
+//
+// TLS connections
+
+func (w *WorkerCommon) serveListener(l net.Listener, t string) {
+    // open connections
+    // closed on exit
+    conns := make(map[net.Conn]bool)
+    var cmux sync.Mutex
+
+    for {
+        // blocking receiver
+        conn, err := l.Accept()
+        if err != nil {
+            select {
+            case <-w.exit:
+                wInfo.Worker(w.id).Printf("Listener #%d closing %s socket", w.id, t)
+
+                cmux.Lock()
+                for c := range conns {
+                    c.Close()
+                }
+                cmux.Unlock()
+
+                w.wg.Wait()
+                close(w.exited)
+
+                // jump out
+                return
+
+            default:
+                wCrit.Worker(w.id).Printf("Listener #%d %s request receive error: %s", w.id, t, err.Error())
+            }
+
+            continue
+        }
+
+        // bounded number of connections (not queries)
+        select {
+        case w.inflight <- true:
+        default:
+            w.res.Load().limit.Busy(conn.RemoteAddr())
+            conn.Close()
+            continue
+        }
+
+        cmux.Lock()
+        conns[conn] = true
+        cmux.Unlock()
+
+        w.wg.Add(1)
+        go func(conn net.Conn) {
+                defer func() {
+                    conn.Close()
+
+                    cmux.Lock()
+                    delete(conns, conn)
+                    cmux.Unlock()
+
+                    <-w.inflight
+                    w.wg.Done()
+                }()
+
+                w.serveStream(conn, t)
+        }(conn)
+    }
+}
+
+// Length prefixed messages (RFC 7766), connection is kept
+// open for further queries until the client closes it or goes idle.
+func (w *WorkerCommon) serveStream(conn net.Conn, t string) {
+    l := make([]byte, 2)
+
+    for {
+        conn.SetReadDeadline(time.Now().Add(STREAM_IDLE * time.Second))
+
+        if _, err := io.ReadFull(conn, l); err != nil {
+            if wDebg.On() && !errors.Is(err, io.EOF) {
+                wDebg.Worker(w.id).Printf("Listener #%d %s connection from %s closed: %s", w.id, t, conn.RemoteAddr().String(), err.Error())
+            }
+
+            return
+        }
+
+        ql := int(binary.BigEndian.Uint16(l))
+        if ql < HEADER_LEN {
+            wCrit.Worker(w.id).Printf("Listener #%d %s request too short: %d", w.id, t, ql)
+            return
+        }
+
+        query := <-w.packeter
+        if ql > len(query) {
+            query = make([]byte, ql)
+        }
+
+        if _, err := io.ReadFull(conn, query[:ql]); err != nil {
+            wCrit.Worker(w.id).Printf("Listener #%d %s request read error: bytes expected %d, err: %s", w.id, t, ql, err.Error())
+            return
+        }
+
+        // per client query limit
+        if !w.res.Load().limit.AllowQuery(conn.RemoteAddr()) {
+            metrics.Query(t, w.id, query[:ql], nil)
+            continue
+        }
+
+        answer := ProcessQuery(query[:ql], <-w.packeter, w.res.Load(), <-w.dialer, conn.RemoteAddr(), t, w.id)
+        metrics.Query(t, w.id, query[:ql], answer)
+        if answer == nil {
+            continue
+        }
+
+        out := make([]byte, 2+len(answer))
+        binary.BigEndian.PutUint16(out, uint16(len(answer)))
+        copy(out[2:], answer)
+
+        conn.SetWriteDeadline(time.Now().Add(STREAM_IDLE * time.Second))
+        if _, err := conn.Write(out); err != nil {
+            wCrit.Worker(w.id).Printf("Listener #%d failed to write answer back to the client: %s", w.id, err.Error())
+            return
+        }
+    }
+}
+
+//
+// Query processing
+// shared by all workers
+
+type Resolver struct {
+    // local records
+    cache *Cache
+
+    // proxy mode
+    proxy bool
+
+    // access control
+    acl *ACL
+
+    // client rate limits
+    limit *RateLimit
+
+    // query log, nil = off
+    qlog *QueryLog
+
+    // dynamic updates, nil = off
+    update *Updater
+
+    // split horizon views
+    views []*View
+
+    // AAAA synthesis, nil = off
+    dns64 *DNS64
+
+    // rewrite rules, nil = none
+    rewrites *Rewrite
+}
+
+func NewResolver(c *Cache, proxy bool, acl *ACL, rl *RateLimit, ql *QueryLog, up *Updater, views []*View, dns64 *DNS64, rw *Rewrite) *Resolver {
+    return &Resolver{c, proxy, acl, rl, ql, up, views, dns64, rw}
+}
+
+func ProcessQuery(query, answer []byte, r *Resolver, dialer Upstream, client net.Addr, transport string, wid int) (resp []byte) {
     qs := Question(query)
     rt := RequestType(query)
 
-    sInfo.Printf("#%d: Query id: %d, type: %s, len: %d, question: %s", wid, bytesToInt(query[:2]), RequestTypeString(rt), len(query), qs)
-    if debug {
-        sDebg.Printf("#%d: Query id: %d, bytes: %+v", wid, bytesToInt(query[:2]), query)
+    // query log, on return
+    start := time.Now()
+    source, upstream := QUERY_LOCAL, ""
+    var qerr error
+    defer func() {
+        r.qlog.Log(query, resp, client, transport, source, upstream, qerr, time.Since(start))
+    }()
+
+    wInfo.Worker(wid).Printf("#%d: Query id: %d, client: %s, type: %s, len: %d, question: %s", wid, bytesToInt(query[:2]), client.String(), RequestTypeString(rt), len(query), qs)
+    if wTrce.On() {
+        wTrce.Worker(wid).Printf("#%d: Query id: %d, bytes: %+v", wid, bytesToInt(query[:2]), query)
+    }
+
+    if !r.acl.AllowQuery(client) {
+        source = QUERY_DENIED
+        return denied(query, r.acl, "query", client, wid)
+    }
+
+    // opcode
+    switch int(query[2]) >> 3 & 0xf {
+    case 0:
+    case OPCODE_UPDATE:
+        source = QUERY_UPDATE
+        return r.update.Process(query, client, wid)
+    default:
+        return rcodeOnly(query, NOTIMP, wid)
     }
 
     // answer length
     al := 0
 
-    if a := cache.Get(rt, qs); a != nil {
-        a.CopyRequestId(query)
-        al = a.serializePacket(answer)
+    // split horizon
+    view := matchView(r.views, client)
+    if view != nil {
+        if wDebg.On() {
+            wDebg.Worker(wid).Printf("#%d: View: %s, client: %s", wid, view.name, client.String())
+        }
 
-        sInfo.Printf("#%d: Resp id: %d, len: %d, answer: %s", wid, bytesToInt(answer[:2]), al, a.ResponseString())
+        // view's own dialers
+        if view.pool != nil {
+            dialer = <-view.pool.c
+        }
+    }
 
-        return answer[0:al]
+    records := view.records(r.cache, qs)
+
+    // rewrites go before local records,
+    // names blocked locally stay blocked
+    if rule := r.rewrites.Match(qs); rule != nil && !records.Blocked(qs) {
+        wInfo.Worker(wid).Printf("#%d: Rewrite id: %d, client: %s, question: %s, rule: %s", wid, bytesToInt(query[:2]), client.String(), qs, rule.String())
+
+        if rw := r.rewrite(query, rule, view, dialer, r.proxy && r.acl.AllowRecursion(client), wid); rw != nil {
+            source = QUERY_REWRITE
+            wInfo.Worker(wid).Printf("#%d: Resp id: %d, len: %d, answer: %s", wid, bytesToInt(rw[:2]), len(rw), Response(rw))
+            return rw
+        }
     }
 
-    if proxy {
-        // TODO should tcp worker be calling tcp here too??
-        // proxy on, dial upstream
-        conn, err := net.Dial("udp4", dialer)
-        if err != nil {
-            if debug {
-                sDebg.Printf("#%d: Failed to dial upstream: %s", wid, err.Error())
-            }
+    a := records.Get(rt, qs)
+    metrics.Cache(a != nil)
+
+    // local names, AAAA of A records
+    // ip6.arpa of the prefix, PTR of in-addr.arpa
+    if a == nil && r.dns64.On(client) {
+        var s []byte
+        switch rt {
+        case AAAA:
+            s = r.dns64Local(query, records, wid)
+        case PTR:
+            s = r.dns64Ptr(query, view, dialer, r.proxy && r.acl.AllowRecursion(client), wid)
+        }
 
-            return answer
+        if s != nil {
+            return s
         }
-        defer conn.Close()
+    }
 
-        if debug {
-            sDebg.Printf("#%d: Dialing to upstream: %s", wid, conn.RemoteAddr().String())
+    if a != nil {
+        al = a.serializePacket(answer)
+        // copy request id into the (serialized) answer, the cached
+        // answer itself is shared between queries
+        copy(answer[:QUERY_ID_LEN], query[:QUERY_ID_LEN])
+
+        // local nxdomain records
+        if int(answer[3]) & RCODE_MASK == NXDOMAIN {
+            source = QUERY_BLOCKED
+            bInfo.Worker(wid).Printf("#%d: Blocked id: %d, client: %s, question: %s", wid, bytesToInt(answer[:2]), client.String(), qs)
+        } else {
+            wInfo.Worker(wid).Printf("#%d: Resp id: %d, len: %d, answer: %s", wid, bytesToInt(answer[:2]), al, a.ResponseString())
         }
 
-        // upstream connection timeout
-        conn.SetDeadline(time.Now().Add(time.Second * CONNECTION_TIMEOUT))
+        return answer[0:al]
+    }
 
-        al, err = conn.Write(query)
-        if err != nil {
-            sCrit.Printf("#%d: Failed to write query to upstream, written: %d, error: %s", wid, al, err.Error())
-            return answer
+    if r.proxy {
+        if !r.acl.AllowRecursion(client) {
+            source = QUERY_DENIED
+            return denied(query, r.acl, "recursion", client, wid)
         }
 
-        if debug {
-            sDebg.Printf("#%d: Bytes written upstream: %d", wid, al)
+        // TODO should tcp worker be calling tcp here too??
+        // proxy on, forward upstream
+        source, upstream = QUERY_UPSTREAM, dialer.String()
+
+        ustart := time.Now()
+        al, qerr = dialer.Exchange(query, answer, wid)
+        metrics.Upstream(dialer.String(), time.Since(ustart), qerr)
+        if qerr != nil {
+            wCrit.Worker(wid).Printf("#%d: Upstream %s failed: %s", wid, dialer.String(), qerr.Error())
+
+            sf, err := RcodeResponse(query, SERVFAIL)
+            if err != nil {
+                wCrit.Worker(wid).Printf("#%d: Failed to create SERVFAIL: %s", wid, err.Error())
+                return nil
+            }
+
+            return sf
         }
 
-        al = 0
-        al, err = conn.Read(answer)
-        if err != nil {
-            sCrit.Printf("#%d: Failed to read from upstream, read: %d, error: %s", wid, al, err.Error())
-            return answer
+        wInfo.Worker(wid).Printf("#%d, X-ON, Resp id: %d, upstream: %s, len: %d, answer: %s", wid, bytesToInt(answer[:2]), dialer.String(), al, Response(answer))
+
+        // no AAAA records, A asked
+        if rt == AAAA && r.dns64.On(client) {
+            return r.dns64Upstream(query, answer[0:al], dialer, wid)
         }
 
-        sInfo.Printf("#%d, X-ON, Resp id: %d, upstream: %s, len: %d, answer: %s", wid, bytesToInt(answer[:2]), conn.RemoteAddr().String(), al, Response(answer))
         return answer[0:al]
     }
 
-    a := NewRefused(qs)
-    a.CopyRequestId(query)
+    source = QUERY_REFUSED
+    a = NewRefused(qs)
     al = a.serializePacket(answer)
+    copy(answer[:QUERY_ID_LEN], query[:QUERY_ID_LEN])
 
-    sInfo.Printf("#%d: X-OFF, Resp id: %d, len: %d, answer: %s", wid, bytesToInt(answer[:2]), al, a.ResponseString())
+    wInfo.Worker(wid).Printf("#%d: X-OFF, Resp id: %d, len: %d, answer: %s", wid, bytesToInt(answer[:2]), al, a.ResponseString())
     
-    if debug {
-        sDebg.Printf("#%d: Resp id: %d, bytes: %+v", wid, bytesToInt(answer[:2]), answer[:al])
+    if wTrce.On() {
+        wTrce.Worker(wid).Printf("#%d: Resp id: %d, bytes: %+v", wid, bytesToInt(answer[:2]), answer[:al])
     }
 
     return answer[0:al]
 }
+
+// ACL denied, REFUSED or nil (drop)
+func denied(query []byte, acl *ACL, what string, client net.Addr, wid int) []byte {
+    wWarn.Worker(wid).Printf("#%d: ACL %s denied for client: %s, question: %s, action: %s", wid, what, client.String(), Question(query), acl.Action())
+
+    if acl.drop {
+        return nil
+    }
+
+    rf, err := RcodeResponse(query, REFUSED)
+    if err != nil {
+        wCrit.Worker(wid).Printf("#%d: Failed to create REFUSED: %s", wid, err.Error())
+        return nil
+    }
+
+    return rf
+}
+
+// rcode only response, not recursive
+func rcodeOnly(query []byte, rcode, wid int) []byte {
+    b, err := RcodeResponse(query, rcode)
+    if err != nil {
+        wCrit.Worker(wid).Printf("#%d: Failed to create %s: %s", wid, RcodeString(rcode), err.Error())
+        return nil
+    }
+
+    // not recursive
+    b[3] &^= RA
+    return b
+}
+
+// question asked again as t (name)
+func requery(query []byte, name string, t int) []byte {
+    m, err := ParseMsg(query)
+    if err != nil || len(m.question) != 1 {
+        return nil
+    }
+
+    m.question[0].name, m.question[0].t = name, t
+    b, err := m.Pack()
+    if err != nil {
+        return nil
+    }
+
+    return b
+}
+
+// q answered from local records, nil when not found
+func localAnswer(q []byte, cache *Cache) []byte {
+    a := cache.Get(RequestType(q), Question(q))
+    if a == nil {
+        return nil
+    }
+
+    b := make([]byte, PACKET_SIZE)
+    l := a.serializePacket(b)
+    copy(b[:QUERY_ID_LEN], q[:QUERY_ID_LEN])
+
+    return b[:l]
+}
+
+// q answered upstream, nil on failure (logged)
+func upstreamAnswer(q []byte, dialer Upstream, wid int) []byte {
+    b := make([]byte, PACKET_SIZE)
+
+    start := time.Now()
+    l, err := dialer.Exchange(q, b, wid)
+    metrics.Upstream(dialer.String(), time.Since(start), err)
+    if err != nil {
+        wCrit.Worker(wid).Printf("#%d: Upstream %s failed: %s", wid, dialer.String(), err.Error())
+        return nil
+    }
+
+    return b[:l]
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "net"
+    "time"
+    "errors"
+    "context"
+    "sync/atomic"
+    "strings"
+    "net/http"
+    "net/netip"
+    "crypto/tls"
+    "encoding/json"
+    "encoding/base64"
+)
+
+//
+// HTTPS (DNS over HTTPS, RFC 8484)
+//
+// GET with base64url encoded '?dns=' or POST with application/dns-message
+// body on /dns-query. Optionally JSON API (application/dns-json) with
+// '?name=&type=' on /dns-query or /resolve.
+// Plain http (no certificate) is meant to sit behind a reverse proxy,
+// client IP is then taken from X-Forwarded-For of trusted proxies.
+
+type WorkerHTTPS struct {
+    // tcp listener
+    listener net.Listener
+
+    server *http.Server
+
+    // server certificate
+    // nil = plain http
+    certs *CertStore
+
+    // proxies allowed to set X-Forwarded-For
+    trusted []netip.Prefix
+
+    // JSON API
+    json bool
+
+    WorkerCommon
+}
+
+func NewWorkerHTTPS(cs *CertStore, trusted []netip.Prefix, js bool) *WorkerHTTPS {
+    return &WorkerHTTPS{certs: cs, trusted: trusted, json: js}
+}
+
+func (w *WorkerHTTPS) Type() string {
+    t := "HTTPS"
+    if w.certs == nil {
+        t = "HTTP"
+    }
+
+    if w.net == IPv4 {
+        return t + "v4"
+    }
+
+    return t + "v6"
+}
+
+func (w *WorkerHTTPS) ListenAddr() net.Addr {
+    return w.listener.Addr()
+}
+
+func (w *WorkerHTTPS) Start4(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv4)
+}
+
+func (w *WorkerHTTPS) Start6(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int) error {
+    return w.Start(lc, iface, r, p, d, id, IPv6)
+}
+
+func (w *WorkerHTTPS) Start(lc net.ListenConfig, iface string, r *atomic.Pointer[Resolver], p chan []byte, d chan Upstream, id int, net string) error {
+    var lnet string
+    switch net {
+    case IPv4: lnet = "tcp4"
+    case IPv6: lnet = "tcp6"
+    default:
+        return fmt.Errorf("Uknown net: %s", net)
+    }
+
+    l, err := lc.Listen(context.Background(), lnet, iface)
+    if err != nil {
+        return err
+    }
+
+    w.listener = l
+    w.server = &http.Server{
+        Handler:           w,
+        ReadHeaderTimeout: STREAM_IDLE * time.Second,
+        IdleTimeout:       STREAM_IDLE * time.Second,
+        ErrorLog:          wWarn.Logger,
+    }
+
+    // certificate is looked up on each handshake
+    // h2 is added by the server
+    if w.certs != nil {
+        w.server.TLSConfig = &tls.Config{
+            GetCertificate: w.certs.GetCertificate,
+            MinVersion:     tls.VersionTLS12,
+        }
+    }
+
+    w.res = r
+    w.packeter = p
+    w.dialer = d
+    w.inflight = make(chan bool, r.Load().limit.inflight)
+    w.exit = make(chan bool)
+    w.exited = make(chan bool)
+    w.id = id
+    w.net = net
+
+    return nil
+}
+
+func (w *WorkerHTTPS) Close() {
+    // exit request
+    close(w.exit)
+
+    // stop accepting, wait (a while) for requests in progress
+    ctx, cancel := context.WithTimeout(context.Background(), STREAM_IDLE * time.Second)
+    defer cancel()
+
+    if err := w.server.Shutdown(ctx); err != nil {
+        w.server.Close()
+    }
+
+    // exit confirmation
+    <-w.exited
+}
+
+func (w *WorkerHTTPS) ServeDNS() {
+    var err error
+    if w.certs != nil {
+        err = w.server.ServeTLS(w.listener, "", "")
+    } else {
+        err = w.server.Serve(w.listener)
+    }
+
+    select {
+    case <-w.exit:
+        wInfo.Worker(w.id).Printf("Listener #%d closing %s socket", w.id, w.Type())
+    default:
+        wCrit.Worker(w.id).Printf("Listener #%d %s failed: %s", w.id, w.Type(), err.Error())
+    }
+
+    // requests in progress are waited for by Shutdown (Close)
+    close(w.exited)
+}
+
+func (w *WorkerHTTPS) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    client := w.clientAddr(r)
+
+    js := w.json && r.URL.Query().Has("name")
+    switch r.URL.Path {
+    case DOH_PATH:
+    case DOH_JSON_PATH:
+        if js {
+            break
+        }
+        fallthrough
+    default:
+        http.NotFound(rw, r)
+        return
+    }
+
+    var query []byte
+    var err error
+    if js {
+        query, err = w.jsonQuery(r)
+    } else {
+        query, err = w.wireQuery(rw, r)
+    }
+
+    if err != nil {
+        if wDebg.On() {
+            wDebg.Worker(w.id).Printf("Listener #%d %s bad request from: %s, %s", w.id, w.Type(), client.String(), err.Error())
+        }
+
+        if err != errHttpStatus {
+            http.Error(rw, err.Error(), http.StatusBadRequest)
+        }
+
+        return
+    }
+
+    // per client query limit
+    if !w.res.Load().limit.AllowQuery(client) {
+        http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+        return
+    }
+
+    // bounded number of queries in processing
+    select {
+    case w.inflight <- true:
+    default:
+        w.res.Load().limit.Busy(client)
+        http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+        return
+    }
+    defer func() { <-w.inflight }()
+
+    answer := ProcessQuery(query, <-w.packeter, w.res.Load(), <-w.dialer, client, w.Type(), w.id)
+    metrics.Query(w.Type(), w.id, query, answer)
+    if answer == nil {
+        // acl drop, there is no silent drop over http
+        http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+        return
+    }
+
+    m, err := ParseMsg(answer)
+    if err != nil {
+        wCrit.Worker(w.id).Printf("Listener #%d %s invalid answer: %s", w.id, w.Type(), err.Error())
+        http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+        return
+    }
+
+    if ttl, ok := minTTL(m); ok {
+        rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+    }
+
+    if js {
+        rw.Header().Set("Content-Type", DNS_JSON)
+        if err := writeJSON(rw, m); err != nil {
+            wCrit.Worker(w.id).Printf("Listener #%d failed to write answer back to the client: %s", w.id, err.Error())
+        }
+
+        return
+    }
+
+    rw.Header().Set("Content-Type", DNS_MESSAGE)
+    if _, err := rw.Write(answer); err != nil {
+        wCrit.Worker(w.id).Printf("Listener #%d failed to write answer back to the client: %s", w.id, err.Error())
+    }
+}
+
+// response status already written
+var errHttpStatus = errors.New("http status sent")
+
+// RFC 8484 wire format query
+func (w *WorkerHTTPS) wireQuery(rw http.ResponseWriter, r *http.Request) ([]byte, error) {
+    var query []byte
+    var err error
+
+    switch r.Method {
+    case http.MethodGet:
+        q := r.URL.Query().Get("dns")
+        if q == "" {
+            return nil, fmt.Errorf("Missing 'dns' parameter")
+        }
+
+        // unpadded base64url, tolerate padding
+        query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(q, "="))
+        if err != nil {
+            return nil, fmt.Errorf("Invalid 'dns' parameter: %s", err.Error())
+        }
+
+    case http.MethodPost:
+        if ct := r.Header.Get("Content-Type"); ct != DNS_MESSAGE {
+            http.Error(rw, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+            return nil, errHttpStatus
+        }
+
+        query, err = io.ReadAll(io.LimitReader(r.Body, DOH_MAX_BODY+1))
+        if err != nil {
+            return nil, err
+        }
+
+        if len(query) > DOH_MAX_BODY {
+            http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+            return nil, errHttpStatus
+        }
+
+    default:
+        rw.Header().Set("Allow", "GET, POST")
+        http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+        return nil, errHttpStatus
+    }
+
+    m, err := ParseMsg(query)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid query: %s", err.Error())
+    }
+    if m.response() || len(m.question) != 1 {
+        return nil, fmt.Errorf("Invalid query")
+    }
+
+    return query, nil
+}
+
+// JSON API query, ?name=example.com&type=A
+func (w *WorkerHTTPS) jsonQuery(r *http.Request) ([]byte, error) {
+    if r.Method != http.MethodGet {
+        return nil, fmt.Errorf("JSON API supports GET only")
+    }
+
+    p := r.URL.Query()
+
+    name := strings.TrimSuffix(p.Get("name"), ".")
+    if name == "" {
+        return nil, fmt.Errorf("Missing 'name' parameter")
+    }
+
+    t := A
+    if s := p.Get("type"); s != "" {
+        t = TypeFromString(s)
+        if t == 0 {
+            return nil, fmt.Errorf("Invalid 'type' parameter: %s", s)
+        }
+    }
+
+    flags := FLAG_RD
+    if cd := p.Get("cd"); cd == "1" || cd == "true" {
+        flags |= FLAG_CD
+    }
+
+    m := &Msg{
+        flags:    flags,
+        question: []MsgQuestion{{name: name, t: t, class: IN}},
+    }
+
+    return m.Pack()
+}
+
+// client address, real client from X-Forwarded-For
+// when the request comes through trusted proxies
+func (w *WorkerHTTPS) clientAddr(r *http.Request) net.Addr {
+    ap, err := netip.ParseAddrPort(r.RemoteAddr)
+    if err != nil {
+        return &net.TCPAddr{}
+    }
+
+    ip := ap.Addr().Unmap()
+    addr := &net.TCPAddr{IP: ip.AsSlice(), Port: int(ap.Port())}
+    if !w.isTrusted(ip) {
+        return addr
+    }
+
+    // right to left, first one not trusted is the client
+    // anything further left is client controlled
+    xff := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i:=len(xff)-1; i>=0; i-- {
+        s := strings.TrimSpace(xff[i])
+        if s == "" {
+            continue
+        }
+
+        a, err := netip.ParseAddr(s)
+        if err != nil {
+            break
+        }
+
+        ip = a.Unmap()
+        addr = &net.TCPAddr{IP: ip.AsSlice()}
+        if !w.isTrusted(ip) {
+            break
+        }
+    }
+
+    return addr
+}
+
+func (w *WorkerHTTPS) isTrusted(ip netip.Addr) bool {
+    for _, p := range w.trusted {
+        if p.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// lowest ttl in the answer, for http caching
+func minTTL(m *Msg) (uint32, bool) {
+    var ttl uint32
+    found := false
+
+    for _, s := range [][]MsgRR{m.answer, m.authority, m.additional} {
+        for _, r := range s {
+            if r.t == OPT {
+                continue
+            }
+
+            if !found || r.ttl < ttl {
+                ttl = r.ttl
+                found = true
+            }
+        }
+    }
+
+    return ttl, found
+}
+
+//
+// JSON API
+
+type jsonMsg struct {
+    Status     int
+    TC         bool
+    RD         bool
+    RA         bool
+    AD         bool
+    CD         bool
+    Question   []jsonQuestion
+    Answer     []jsonRR `json:",omitempty"`
+    Authority  []jsonRR `json:",omitempty"`
+    Additional []jsonRR `json:",omitempty"`
+}
+
+type jsonQuestion struct {
+    Name string `json:"name"`
+    Type int    `json:"type"`
+}
+
+type jsonRR struct {
+    Name string `json:"name"`
+    Type int    `json:"type"`
+    TTL  uint32 `json:"TTL"`
+    Data string `json:"data"`
+}
+
+func writeJSON(wr io.Writer, m *Msg) error {
+    jm := jsonMsg{
+        Status:   m.rcode(),
+        TC:       m.truncated(),
+        RD:       m.flags&FLAG_RD != 0,
+        RA:       m.flags&FLAG_RA != 0,
+        AD:       m.flags&FLAG_AD != 0,
+        CD:       m.flags&FLAG_CD != 0,
+        Question: make([]jsonQuestion, len(m.question)),
+    }
+
+    for i, q := range m.question {
+        jm.Question[i] = jsonQuestion{q.name + ".", q.t}
+    }
+
+    rrs := func(s []MsgRR) []jsonRR {
+        j := make([]jsonRR, 0, len(s))
+        for _, r := range s {
+            if r.t == OPT {
+                continue
+            }
+
+            j = append(j, jsonRR{r.name + ".", r.t, r.ttl, r.DataString()})
+        }
+
+        return j
+    }
+
+    jm.Answer = rrs(m.answer)
+    jm.Authority = rrs(m.authority)
+    jm.Additional = rrs(m.additional)
+
+    return json.NewEncoder(wr).Encode(jm)
+}